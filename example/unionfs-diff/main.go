@@ -0,0 +1,107 @@
+// unionfs-diff prints or exports the changes that the writable branch
+// of a union makes to its read-only branches, or applies such a
+// changeset to a directory.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/hanwen/go-fuse/unionfs"
+)
+
+func main() {
+	deldirname := flag.String(
+		"deletion_dirname", "GOUNIONFS_DELETIONS", "Directory name to use for deletions.")
+	whiteouts := flag.String("whiteouts", "store",
+		"How deletions are recorded: store, overlay or overlay-user.")
+	out := flag.String("o", "", "Write the changeset to this tarball; - for stdout.")
+	apply := flag.String("apply", "", "Apply the changeset tarball, - for stdin, to DIRECTORY.")
+	commit := flag.Bool("commit", false, "Apply the changes to RO-DIRECTORY, which must be the only one.")
+
+	flag.Parse()
+	if *apply != "" {
+		if len(flag.Args()) != 1 {
+			usage()
+		}
+		var in io.Reader = os.Stdin
+		if *apply != "-" {
+			f, err := os.Open(*apply)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			in = f
+		}
+		if err := unionfs.ApplyChangeset(in, flag.Arg(0)); err != nil {
+			log.Fatal("Apply failed: ", err)
+		}
+		return
+	}
+	if len(flag.Args()) < 2 || (*commit && len(flag.Args()) != 2) {
+		usage()
+	}
+
+	var format unionfs.WhiteoutFormat
+	switch *whiteouts {
+	case "store":
+		format = unionfs.WhiteoutDeletionStore
+	case "overlay":
+		format = unionfs.WhiteoutOverlay
+	case "overlay-user":
+		format = unionfs.WhiteoutOverlayUser
+	default:
+		log.Fatalf("unknown whiteout format %q", *whiteouts)
+	}
+
+	var fses []pathfs.FileSystem
+	for _, d := range flag.Args() {
+		fses = append(fses, pathfs.NewLoopbackFileSystem(d))
+	}
+	cs, err := unionfs.Diff(fses, unionfs.UnionFsOptions{
+		DeletionDirName: *deldirname,
+		Whiteouts:       format,
+	})
+	if err != nil {
+		log.Fatal("Diff failed: ", err)
+	}
+
+	switch {
+	case *commit:
+		r, w := io.Pipe()
+		go func() {
+			w.CloseWithError(cs.WriteTar(w))
+		}()
+		if err := unionfs.ApplyChangeset(r, flag.Arg(1)); err != nil {
+			log.Fatal("Commit failed: ", err)
+		}
+	case *out != "":
+		var w io.Writer = os.Stdout
+		if *out != "-" {
+			f, err := os.Create(*out)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			w = f
+		}
+		if err := cs.WriteTar(w); err != nil {
+			log.Fatal("Export failed: ", err)
+		}
+	default:
+		for _, c := range cs.Changes {
+			fmt.Println(c)
+		}
+	}
+}
+
+func usage() {
+	fmt.Println("Usage:\n" +
+		"  unionfs-diff [-o CHANGES.tar | -commit] RW-DIRECTORY RO-DIRECTORY ...\n" +
+		"  unionfs-diff -apply CHANGES.tar DIRECTORY")
+	os.Exit(2)
+}
@@ -23,17 +23,55 @@ func main() {
 	branchcache_ttl := flag.Float64("branchcache_ttl", 5.0, "Branch cache TTL in seconds.")
 	deldirname := flag.String(
 		"deletion_dirname", "GOUNIONFS_DELETIONS", "Directory name to use for deletions.")
+	whiteouts := flag.String("whiteouts", "store",
+		"How to record deletions: store, overlay or overlay-user.")
+	migrate := flag.Bool("migrate_deletions", false,
+		"Convert the deletion store of RW-DIRECTORY to overlay whiteouts before mounting.")
+	control := flag.String("branch_control", "",
+		"Name of a file in the root that lists the branches, and takes add, remove and order commands.")
 
 	flag.Parse()
 	if len(flag.Args()) < 2 {
-		fmt.Println("Usage:\n  unionfs MOUNTPOINT RW-DIRECTORY RO-DIRECTORY ...")
+		fmt.Println("Usage:\n  unionfs MOUNTPOINT RW-DIRECTORY RO-ROOT ...\n\n" +
+			"RO-ROOT is a directory, or a .zip, .tar, .tar.gz or .tar.bz2 archive.")
 		os.Exit(2)
 	}
 
+	var format unionfs.WhiteoutFormat
+	switch *whiteouts {
+	case "store":
+		format = unionfs.WhiteoutDeletionStore
+	case "overlay":
+		format = unionfs.WhiteoutOverlay
+	case "overlay-user":
+		format = unionfs.WhiteoutOverlayUser
+	default:
+		log.Fatalf("unknown whiteout format %q", *whiteouts)
+	}
+	if *migrate {
+		rw := pathfs.NewLoopbackFileSystem(flag.Arg(1))
+		var ro []pathfs.FileSystem
+		for _, root := range flag.Args()[2:] {
+			fs, err := unionfs.NewRootFileSystem(root)
+			if err != nil {
+				log.Fatal("Migration failed: ", err)
+			}
+			ro = append(ro, fs)
+		}
+		if err := unionfs.MigrateDeletionStore(rw, *deldirname, ro...); err != nil {
+			log.Fatal("Migration failed: ", err)
+		}
+		if format == unionfs.WhiteoutDeletionStore {
+			format = unionfs.WhiteoutOverlay
+		}
+	}
+
 	ufsOptions := unionfs.UnionFsOptions{
-		DeletionCacheTTL: time.Duration(*delcache_ttl * float64(time.Second)),
-		BranchCacheTTL:   time.Duration(*branchcache_ttl * float64(time.Second)),
-		DeletionDirName:  *deldirname,
+		DeletionCacheTTL:  time.Duration(*delcache_ttl * float64(time.Second)),
+		BranchCacheTTL:    time.Duration(*branchcache_ttl * float64(time.Second)),
+		DeletionDirName:   *deldirname,
+		Whiteouts:         format,
+		BranchControlFile: *control,
 	}
 
 	ufs, err := unionfs.NewUnionFsFromRoots(flag.Args()[1:], &ufsOptions, true)
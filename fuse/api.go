@@ -43,6 +43,15 @@ type MountOptions struct {
 	// capped at the kernel maximum.
 	MaxWrite int
 
+	// Maximum readahead in bytes.  If 0, the kernel's proposal
+	// is accepted, otherwise the smaller of the two is used.
+	MaxReadAhead int
+
+	// If AsyncDirectIO is set, the kernel may issue concurrent
+	// read and write requests for files opened with
+	// FOPEN_DIRECT_IO, if it supports doing so.
+	AsyncDirectIO bool
+
 	// If IgnoreSecurityLabels is set, all security related xattr
 	// requests will return NO_DATA without passing through the
 	// user defined filesystem.  You should only set this if you
@@ -57,6 +66,13 @@ type MountOptions struct {
 	// This may be useful for NFS.
 	RememberInodes bool
 
+	// If ExportSupport is set, negotiate CAP_EXPORT_SUPPORT, so
+	// the mount can be exported over NFS.  The file system must
+	// then answer lookups of "." and ".." in any directory, and
+	// resolve node IDs from NFS file handles it has not handed
+	// out in this process.
+	ExportSupport bool
+
 	// The Name will show up on the output of the mount. Keep this string
 	// small.
 	Name string
@@ -89,6 +105,9 @@ type RawFileSystem interface {
 	Unlink(context *Context, name string) (code Status)
 	Rmdir(context *Context, name string) (code Status)
 	Rename(context *Context, input *raw.RenameIn, oldName string, newName string) (code Status)
+
+	// Rename2 is Rename with the RENAME_* flags of renameat2(2).
+	Rename2(context *Context, input *raw.Rename2In, oldName string, newName string) (code Status)
 	Link(out *raw.EntryOut, context *Context, input *raw.LinkIn, filename string) (code Status)
 
 	Symlink(out *raw.EntryOut, context *Context, pointedTo string, linkName string) (code Status)
@@ -104,6 +123,11 @@ type RawFileSystem interface {
 
 	// File handling.
 	Create(out *raw.CreateOut, context *Context, input *raw.CreateIn, name string) (code Status)
+
+	// TmpFile creates an open file without a name in the
+	// directory, for open(2) with O_TMPFILE.  It can be given a
+	// name later with Link.
+	TmpFile(out *raw.CreateOut, context *Context, input *raw.CreateIn) (code Status)
 	Open(out *raw.OpenOut, context *Context, input *raw.OpenIn) (status Status)
 	Read(*Context, *raw.ReadIn, []byte) (ReadResult, Status)
 
@@ -113,6 +137,14 @@ type RawFileSystem interface {
 	Fsync(*Context, *raw.FsyncIn) (code Status)
 	Fallocate(Context *Context, in *raw.FallocateIn) (code Status)
 
+	// Lseek finds data and holes in sparse files, for lseek(2)
+	// with SEEK_DATA and SEEK_HOLE.
+	Lseek(context *Context, in *raw.LseekIn, out *raw.LseekOut) (code Status)
+
+	// CopyFileRange copies data between two open files without
+	// passing it through the kernel, for copy_file_range(2).
+	CopyFileRange(context *Context, input *raw.CopyFileRangeIn) (written uint32, code Status)
+
 	// Directory handling
 	OpenDir(out *raw.OpenOut, context *Context, input *raw.OpenIn) (status Status)
 	ReadDir(out *DirEntryList, context *Context, input *raw.ReadIn) Status
@@ -75,6 +75,10 @@ func (fs *defaultRawFileSystem) Rename(context *Context, input *raw.RenameIn, ol
 	return ENOSYS
 }
 
+func (fs *defaultRawFileSystem) Rename2(context *Context, input *raw.Rename2In, oldName string, newName string) (code Status) {
+	return ENOSYS
+}
+
 func (fs *defaultRawFileSystem) Link(out *raw.EntryOut, context *Context, input *raw.LinkIn, name string) (code Status) {
 	return ENOSYS
 }
@@ -107,6 +111,10 @@ func (fs *defaultRawFileSystem) Create(out *raw.CreateOut, context *Context, inp
 	return ENOSYS
 }
 
+func (fs *defaultRawFileSystem) TmpFile(out *raw.CreateOut, context *Context, input *raw.CreateIn) (code Status) {
+	return ENOSYS
+}
+
 func (fs *defaultRawFileSystem) OpenDir(out *raw.OpenOut, context *Context, input *raw.OpenIn) (status Status) {
 	return ENOSYS
 }
@@ -141,6 +149,14 @@ func (fs *defaultRawFileSystem) FsyncDir(context *Context, input *raw.FsyncIn) (
 	return ENOSYS
 }
 
+func (fs *defaultRawFileSystem) Lseek(context *Context, in *raw.LseekIn, out *raw.LseekOut) (code Status) {
+	return ENOSYS
+}
+
+func (fs *defaultRawFileSystem) CopyFileRange(context *Context, input *raw.CopyFileRangeIn) (written uint32, code Status) {
+	return 0, ENOSYS
+}
+
 func (fs *defaultRawFileSystem) Fallocate(context *Context, in *raw.FallocateIn) (code Status) {
 	return ENOSYS
 }
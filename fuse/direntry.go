@@ -19,6 +19,10 @@ const direntSize = int(unsafe.Sizeof(raw.Dirent{}))
 type DirEntry struct {
 	Mode uint32
 	Name string
+
+	// Ino is the inode number for the entry, or 0 if unknown.
+	// It should match the Ino returned by GetAttr.
+	Ino uint64
 }
 
 type DirEntryList struct {
@@ -39,10 +43,29 @@ func NewDirEntryList(data []byte, off uint64) *DirEntryList {
 
 // AddDirEntry tries to add an entry.
 func (l *DirEntryList) AddDirEntry(e DirEntry) bool {
-	return l.Add(e.Name, uint64(raw.FUSE_UNKNOWN_INO), e.Mode)
+	return l.Add(e.Name, e.inode(), e.Mode)
+}
+
+func (e *DirEntry) inode() uint64 {
+	if e.Ino == 0 {
+		return uint64(raw.FUSE_UNKNOWN_INO)
+	}
+	return e.Ino
 }
 
 func (l *DirEntryList) Add(name string, inode uint64, mode uint32) bool {
+	return l.add(name, inode, mode, l.Offset+1)
+}
+
+// AddWithOffset tries to add an entry, using off as the directory
+// offset of the entry that follows it.  The kernel passes this
+// offset back to continue reading, and it is also what telldir()
+// reports.
+func (l *DirEntryList) AddWithOffset(e DirEntry, off uint64) bool {
+	return l.add(e.Name, e.inode(), e.Mode, off)
+}
+
+func (l *DirEntryList) add(name string, inode uint64, mode uint32, off uint64) bool {
 	padding := (8 - len(name)&7) & 7
 	delta := padding + direntSize + len(name)
 	oldLen := len(l.buf)
@@ -53,7 +76,7 @@ func (l *DirEntryList) Add(name string, inode uint64, mode uint32) bool {
 	}
 	l.buf = l.buf[:newLen]
 	dirent := (*raw.Dirent)(unsafe.Pointer(&l.buf[oldLen]))
-	dirent.Off = l.Offset + 1
+	dirent.Off = off
 	dirent.Ino = inode
 	dirent.NameLen = uint32(len(name))
 	dirent.Typ = ModeToType(mode)
@@ -99,6 +99,11 @@ func (fs *lockingRawFileSystem) Rename(header *Context, input *raw.RenameIn, old
 	return fs.RawFS.Rename(header, input, oldName, newName)
 }
 
+func (fs *lockingRawFileSystem) Rename2(header *Context, input *raw.Rename2In, oldName string, newName string) (code Status) {
+	defer fs.locked()()
+	return fs.RawFS.Rename2(header, input, oldName, newName)
+}
+
 func (fs *lockingRawFileSystem) Link(out *raw.EntryOut, header *Context, input *raw.LinkIn, name string) (code Status) {
 	defer fs.locked()()
 	return fs.RawFS.Link(out, header, input, name)
@@ -139,6 +144,11 @@ func (fs *lockingRawFileSystem) Create(out *raw.CreateOut, header *Context, inpu
 	return fs.RawFS.Create(out, header, input, name)
 }
 
+func (fs *lockingRawFileSystem) TmpFile(out *raw.CreateOut, header *Context, input *raw.CreateIn) (code Status) {
+	defer fs.locked()()
+	return fs.RawFS.TmpFile(out, header, input)
+}
+
 func (fs *lockingRawFileSystem) OpenDir(out *raw.OpenOut, header *Context, input *raw.OpenIn) (status Status) {
 	defer fs.locked()()
 	return fs.RawFS.OpenDir(out, header, input)
@@ -194,6 +204,16 @@ func (fs *lockingRawFileSystem) StatFs(out *raw.StatfsOut, context *Context) (co
 	return fs.RawFS.StatFs(out, context)
 }
 
+func (fs *lockingRawFileSystem) Lseek(c *Context, in *raw.LseekIn, out *raw.LseekOut) (code Status) {
+	defer fs.locked()()
+	return fs.RawFS.Lseek(c, in, out)
+}
+
+func (fs *lockingRawFileSystem) CopyFileRange(c *Context, input *raw.CopyFileRangeIn) (written uint32, code Status) {
+	defer fs.locked()()
+	return fs.RawFS.CopyFileRange(c, input)
+}
+
 func (fs *lockingRawFileSystem) Fallocate(c *Context, in *raw.FallocateIn) (code Status) {
 	defer fs.locked()()
 	return fs.RawFS.Fallocate(c, in)
@@ -100,7 +100,6 @@ type Node interface {
 // the struct to inherit a default null implementation.
 //
 // TODO - should File be thread safe?
-// TODO - should we pass a *fuse.Context argument?
 type File interface {
 	// Called upon registering the filehandle in the inode.
 	SetInode(*Inode)
@@ -128,6 +127,104 @@ type File interface {
 	Allocate(off uint64, size uint64, mode uint32) (code fuse.Status)
 }
 
+// LseekFile may be implemented by a File that knows where its holes
+// are, for lseek(2) with SEEK_DATA and SEEK_HOLE.  For other files,
+// or if Lseek returns ENOSYS, the whole file is reported as data.
+type LseekFile interface {
+	File
+
+	Lseek(off int64, whence int) (int64, fuse.Status)
+}
+
+// CopyFileRangeFile may be implemented by a File that can copy data
+// to another open file of the same mount, for copy_file_range(2).
+// For files that do not implement it, the kernel falls back to
+// reading and writing.  Returning ENOSYS disables the offload for the
+// whole mount.
+type CopyFileRangeFile interface {
+	File
+
+	CopyFileRange(offIn int64, dst File, offOut int64, size uint64, flags uint32) (written uint32, code fuse.Status)
+}
+
+// DirStream iterates over the entries of a directory.  Each entry
+// comes with a cookie that identifies the position after it; the
+// cookies are reported as directory offsets, so they must be stable
+// for the lifetime of the stream, and smaller than 1<<62.
+type DirStream interface {
+	// HasNext returns whether there are more entries.
+	HasNext() bool
+
+	// Next returns the next entry, and the cookie for the position
+	// after it.
+	Next() (entry fuse.DirEntry, cookie uint64, code fuse.Status)
+
+	// Seek moves the stream to the position after the entry for
+	// which Next returned cookie.  Cookie 0 is the start of the
+	// directory.
+	Seek(cookie uint64) fuse.Status
+
+	// Close is called when the directory is released.
+	Close()
+}
+
+// DirStreamNode may be implemented by a Node whose directories are
+// too large to list with OpenDir.  If implemented, OpenDirStream is
+// called instead of OpenDir, and entries are fetched as the kernel
+// reads them.
+type DirStreamNode interface {
+	Node
+
+	OpenDirStream(context *fuse.Context) (DirStream, fuse.Status)
+}
+
+// Rename2Node may be implemented by a directory Node that supports
+// the RENAME_NOREPLACE, RENAME_EXCHANGE and RENAME_WHITEOUT flags of
+// renameat2(2).  Renames with flags on other nodes fail with EINVAL.
+// As with Rename, the node is responsible for updating the Inode
+// tree; for RENAME_EXCHANGE both children change places.
+type Rename2Node interface {
+	Node
+
+	Rename2(oldName string, newParent Node, newName string, flags uint32, context *fuse.Context) (code fuse.Status)
+}
+
+// TmpFileNode may be implemented by a directory Node that supports
+// open(2) with O_TMPFILE.  TmpFile returns an open file and a new
+// Node that is not added to the tree.  The Node can be given a name
+// later through Link, typically from linkat(2) on the open file.
+type TmpFileNode interface {
+	Node
+
+	TmpFile(flags uint32, mode uint32, context *fuse.Context) (file File, child Node, code fuse.Status)
+}
+
+// ContextFile is a File whose operations also receive the
+// *fuse.Context of the calling process.  If the File returned from
+// Open or Create implements ContextFile, the FileSystemConnector
+// calls the XxxContext methods instead of their File counterparts.
+// Include the NewDefaultContextFile return value into the struct to
+// inherit a default null implementation.
+//
+// Wrappers such as NewReadOnlyFile only expose the File methods of
+// the file they wrap.
+type ContextFile interface {
+	File
+
+	ReadContext(dest []byte, off int64, context *fuse.Context) (fuse.ReadResult, fuse.Status)
+	WriteContext(data []byte, off int64, context *fuse.Context) (written uint32, code fuse.Status)
+	FlushContext(context *fuse.Context) fuse.Status
+	ReleaseContext(context *fuse.Context)
+	FsyncContext(flags int, context *fuse.Context) (code fuse.Status)
+
+	TruncateContext(size uint64, context *fuse.Context) fuse.Status
+	GetAttrContext(out *fuse.Attr, context *fuse.Context) fuse.Status
+	ChownContext(uid uint32, gid uint32, context *fuse.Context) fuse.Status
+	ChmodContext(perms uint32, context *fuse.Context) fuse.Status
+	UtimensContext(atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status
+	AllocateContext(off uint64, size uint64, mode uint32, context *fuse.Context) (code fuse.Status)
+}
+
 // Wrap a File return in this to set FUSE flags.  Also used internally
 // to store open file data.
 type WithFlags struct {
@@ -143,6 +240,42 @@ type WithFlags struct {
 	OpenFlags uint32
 }
 
+// Timeouts holds the kernel cache timeouts for a single node.
+type Timeouts struct {
+	// How long the kernel may cache the name of the node.
+	Entry time.Duration
+
+	// How long the kernel may cache the attributes of the node.
+	Attr time.Duration
+
+	// How long the kernel may cache the absence of a name.  This
+	// is only used for Timeouts returned from a LookupTimeout
+	// call that fails with ENOENT.
+	Negative time.Duration
+}
+
+// TimeoutNode may be implemented by a Node that needs other entry
+// and attribute timeouts than the ones from the mount Options.
+type TimeoutNode interface {
+	Node
+
+	// Timeouts returns the timeouts for this node, or nil to use
+	// the timeouts of the mount.
+	Timeouts() *Timeouts
+}
+
+// AttrTimeoutNode may be implemented by a Node that decides on the
+// entry and attribute timeouts for each Lookup or GetAttr call.  If
+// implemented, LookupTimeout and GetAttrTimeout are called instead
+// of Lookup and GetAttr.  Returning nil Timeouts falls back to
+// TimeoutNode and the mount Options.
+type AttrTimeoutNode interface {
+	Node
+
+	LookupTimeout(out *fuse.Attr, name string, context *fuse.Context) (node Node, timeouts *Timeouts, code fuse.Status)
+	GetAttrTimeout(out *fuse.Attr, file File, context *fuse.Context) (timeouts *Timeouts, code fuse.Status)
+}
+
 // Options contains time out options for a node FileSystem.  The
 // default copied from libfuse and set in NewMountOptions() is
 // (1s,1s,0s).
@@ -161,4 +294,46 @@ type Options struct {
 	// back to callers) stay within int32, which is necessary for
 	// making stat() succeed in 32-bit programs.
 	PortableInodes bool
+
+	// If set, the inode number (Attr.Ino) returned from Lookup
+	// and GetAttr is reported to the kernel as st_ino, rather
+	// than the node ID.  This keeps inode numbers of a file system
+	// backed by another one stable across mounts.  The node ID
+	// is still used as the kernel's handle for the node, and is
+	// also reported for nodes that return Ino 0.
+	ReportInodes bool
+
+	// If set, node IDs are chosen by the FileSystem, which must
+	// implement ExportFileSystem, rather than derived from memory
+	// addresses.  Combined with fuse.MountOptions.ExportSupport,
+	// this lets NFS clients keep using file handles after the
+	// file system is mounted again.
+	ExportNodeIds bool
+
+	// If set, all operations that change the file system fail
+	// with EROFS, and open files are wrapped with
+	// NewReadOnlyFile.  MountFileSystem also mounts with "ro", so
+	// statfs reports ST_RDONLY.
+	ReadOnly bool
+}
+
+// ExportFileSystem is implemented by a FileSystem that hands out
+// stable node IDs, for use with Options.ExportNodeIds.
+type ExportFileSystem interface {
+	FileSystem
+
+	// NodeId returns the node ID and generation for a node of
+	// this file system.  The ID must be one for which inUse
+	// returns false: it is larger than 1, below 1<<63, and not
+	// held by another node.  An ID that replaces a taken one must
+	// be recorded, so ResolveNodeId finds it after a restart.  The
+	// generation must change when an ID is reused for a different
+	// file.
+	NodeId(node Node, inUse func(id uint64) bool) (id uint64, generation uint64)
+
+	// ResolveNodeId returns the node with the given ID, as handed
+	// out by NodeId, possibly in an earlier process.  The node
+	// must be reachable from Root().  It returns nil if the node
+	// no longer exists.
+	ResolveNodeId(id uint64, context *fuse.Context) Node
 }
@@ -0,0 +1,246 @@
+package nodefs
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// AutomountResolver returns the file system to mount for a name in
+// the root of an automount file system.  It should return ENOENT for
+// names that do not exist.
+type AutomountResolver func(name string, context *fuse.Context) (FileSystem, fuse.Status)
+
+// AutomountOptions configures NewAutomountFileSystem.
+type AutomountOptions struct {
+	// If positive, submounts without open files are unmounted
+	// after being idle this long.  Lookups, GetAttr and OpenDir
+	// of the root of a submount count as using it.
+	IdleTimeout time.Duration
+
+	// Options for the submounts.  If nil, the options of the
+	// connector root are used.
+	MountOptions *Options
+}
+
+// NewAutomountFileSystem returns a file system whose root directory
+// mounts the file system returned by the resolver on the first
+// lookup of a name.
+func NewAutomountFileSystem(resolver AutomountResolver, opts *AutomountOptions) FileSystem {
+	if opts == nil {
+		opts = &AutomountOptions{}
+	}
+	fs := &automountFs{
+		resolver: resolver,
+		options:  *opts,
+		clock:    realClock{},
+		mounts:   map[string]*automount{},
+	}
+	fs.root = &automountRoot{
+		Node: NewDefaultNode(),
+		fs:   fs,
+	}
+	return fs
+}
+
+// clock lets tests drive the idle timers.
+type clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) timer
+}
+
+type timer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) timer {
+	return time.AfterFunc(d, f)
+}
+
+type automount struct {
+	fs    FileSystem
+	timer timer
+
+	// Protected by automountFs.mutex.
+	lastUsed time.Time
+
+	// Closed once the mount is done or has failed; nil after
+	// that.  Protected by automountFs.mutex.
+	mounting chan struct{}
+}
+
+type automountFs struct {
+	resolver AutomountResolver
+	options  AutomountOptions
+	clock    clock
+	root     *automountRoot
+
+	connector *FileSystemConnector
+	debug     bool
+
+	// Protects mounts.
+	mutex  sync.Mutex
+	mounts map[string]*automount
+}
+
+func (fs *automountFs) String() string {
+	return "AutomountFs"
+}
+
+func (fs *automountFs) Root() Node {
+	return fs.root
+}
+
+func (fs *automountFs) SetDebug(debug bool) {
+	fs.debug = debug
+}
+
+func (fs *automountFs) OnMount(conn *FileSystemConnector) {
+	fs.connector = conn
+}
+
+func (fs *automountFs) OnUnmount() {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	for _, m := range fs.mounts {
+		if m.timer != nil {
+			m.timer.Stop()
+		}
+	}
+}
+
+// mount resolves name and mounts the result.  It returns the root
+// of the mounted file system.  Concurrent mounts of the same name
+// wait for the first one.
+func (fs *automountFs) mount(name string, context *fuse.Context) (Node, fuse.Status) {
+	fs.mutex.Lock()
+	for {
+		m := fs.mounts[name]
+		if m == nil {
+			break
+		}
+		if m.mounting != nil {
+			wait := m.mounting
+			fs.mutex.Unlock()
+			<-wait
+			fs.mutex.Lock()
+			continue
+		}
+		if fs.root.Inode().GetChild(name) == m.fs.Root().Inode() {
+			fs.mutex.Unlock()
+			return m.fs.Root(), fuse.OK
+		}
+		// Unmounted behind our back.
+		if m.timer != nil {
+			m.timer.Stop()
+		}
+		delete(fs.mounts, name)
+	}
+	m := &automount{mounting: make(chan struct{})}
+	fs.mounts[name] = m
+	fs.mutex.Unlock()
+
+	sub, code := fs.resolver(name, context)
+	if code.Ok() {
+		code = fs.connector.Mount(fs.root.Inode(), name, sub, fs.options.MountOptions)
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	close(m.mounting)
+	m.mounting = nil
+	if !code.Ok() {
+		delete(fs.mounts, name)
+		return nil, code
+	}
+	if fs.debug {
+		log.Printf("Automount: mounted %v on %q", sub, name)
+	}
+
+	m.fs = sub
+	m.lastUsed = fs.clock.Now()
+	if fs.options.IdleTimeout > 0 {
+		m.timer = fs.clock.AfterFunc(fs.options.IdleTimeout, func() {
+			fs.expire(name, m)
+		})
+	}
+	return sub.Root(), fuse.OK
+}
+
+// expire unmounts m if it was not used for the idle timeout and
+// has no open files.  Otherwise, it tries again later.
+func (fs *automountFs) expire(name string, m *automount) {
+	fs.mutex.Lock()
+	if fs.mounts[name] != m {
+		fs.mutex.Unlock()
+		return
+	}
+	idle := fs.clock.Now().Sub(m.lastUsed)
+	fs.mutex.Unlock()
+	if idle < fs.options.IdleTimeout {
+		m.timer.Reset(fs.options.IdleTimeout - idle)
+		return
+	}
+
+	code := fs.connector.Unmount(m.fs.Root().Inode())
+	if code == fuse.EBUSY {
+		m.timer.Reset(fs.options.IdleTimeout)
+		return
+	}
+	if !code.Ok() {
+		log.Printf("Automount: unmounting %q failed: %v", name, code)
+	} else if fs.debug {
+		log.Printf("Automount: unmounted idle %q", name)
+	}
+
+	fs.mutex.Lock()
+	if fs.mounts[name] == m {
+		delete(fs.mounts, name)
+	}
+	fs.mutex.Unlock()
+}
+
+type automountRoot struct {
+	Node
+	fs *automountFs
+}
+
+func (n *automountRoot) mountUsed(mountInode *Inode) {
+	n.fs.mutex.Lock()
+	defer n.fs.mutex.Unlock()
+	for _, m := range n.fs.mounts {
+		if m.mounting == nil && m.fs.Root().Inode() == mountInode {
+			m.lastUsed = n.fs.clock.Now()
+		}
+	}
+}
+
+func (n *automountRoot) GetAttr(out *fuse.Attr, file File, context *fuse.Context) fuse.Status {
+	out.Mode = fuse.S_IFDIR | 0555
+	return fuse.OK
+}
+
+// OpenDir returns nothing; the connector adds the mounted entries.
+func (n *automountRoot) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	return nil, fuse.OK
+}
+
+func (n *automountRoot) Lookup(out *fuse.Attr, name string, context *fuse.Context) (Node, fuse.Status) {
+	root, code := n.fs.mount(name, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	if code := root.GetAttr(out, nil, context); !code.Ok() {
+		out.Mode = fuse.S_IFDIR | 0755
+	}
+	return root, fuse.OK
+}
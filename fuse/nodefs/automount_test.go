@@ -0,0 +1,170 @@
+package nodefs
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// fakeClock fires its timers when the test advances it.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	when   time.Time
+	f      func()
+	active bool
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) timer {
+	t := &fakeTimer{clock: c, f: f}
+	t.Reset(d)
+	c.mu.Lock()
+	c.timers = append(c.timers, t)
+	c.mu.Unlock()
+	return t
+}
+
+// Advance moves the clock forward, and runs the timers that are
+// due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeTimer
+	for _, t := range c.timers {
+		if t.active && !t.when.After(c.now) {
+			t.active = false
+			due = append(due, t)
+		}
+	}
+	c.mu.Unlock()
+	for _, t := range due {
+		t.f()
+	}
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	was := t.active
+	t.active = false
+	return was
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	was := t.active
+	t.when = t.clock.now.Add(d)
+	t.active = true
+	return was
+}
+
+func TestAutomount(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "go-fuse-automount_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	mnt := tmp + "/mnt"
+	os.Mkdir(mnt, 0700)
+
+	var resolved int32
+	resolver := func(name string, context *fuse.Context) (FileSystem, fuse.Status) {
+		if name != "sub" {
+			return nil, fuse.ENOENT
+		}
+		atomic.AddInt32(&resolved, 1)
+		back := tmp + "/back"
+		os.Mkdir(back, 0700)
+		return NewMemNodeFs(back + "/"), fuse.OK
+	}
+	const idle = time.Minute
+	fs := NewAutomountFileSystem(resolver, &AutomountOptions{IdleTimeout: idle})
+	clock := &fakeClock{now: time.Now()}
+	fs.(*automountFs).clock = clock
+
+	// Without kernel caching, every access reaches the mount.
+	connector := NewFileSystemConnector(fs, &Options{})
+	connector.SetDebug(fuse.VerboseTest())
+	state, err := fuse.NewServer(connector.RawFS(), mnt, nil)
+	if err != nil {
+		t.Fatal("NewServer", err)
+	}
+	state.SetDebug(fuse.VerboseTest())
+	go state.Serve()
+	defer state.Unmount()
+
+	if _, err := os.Lstat(mnt + "/other"); !os.IsNotExist(err) {
+		t.Errorf("Lstat other: got %v, want ENOENT", err)
+	}
+	if err := ioutil.WriteFile(mnt+"/sub/file", []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	entries, err := ioutil.ReadDir(mnt)
+	if err != nil || len(entries) != 1 || entries[0].Name() != "sub" {
+		t.Errorf("ReadDir: got %v, %v", entries, err)
+	}
+	if mounts := connector.Mounts(); len(mounts) != 1 || mounts[0].Path != "sub" {
+		t.Fatalf("got mounts %+v", mounts)
+	}
+
+	f, err := os.Open(mnt + "/sub/file")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	clock.Advance(2 * idle)
+	if mounts := connector.Mounts(); len(mounts) != 1 {
+		t.Errorf("busy mount was unmounted: %+v", mounts)
+	}
+	f.Close()
+
+	// The kernel releases the file asynchronously.
+	for end := time.Now().Add(5 * time.Second); ; {
+		if mounts := connector.Mounts(); len(mounts) == 1 && mounts[0].OpenFiles == 0 {
+			break
+		}
+		if time.Now().After(end) {
+			t.Fatal("file was not released")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Using it keeps it mounted.
+	for i := 0; i < 4; i++ {
+		if _, err := os.Lstat(mnt + "/sub"); err != nil {
+			t.Fatalf("Lstat failed: %v", err)
+		}
+		clock.Advance(idle / 2)
+	}
+	if mounts := connector.Mounts(); len(mounts) != 1 {
+		t.Errorf("used mount was unmounted: %+v", mounts)
+	}
+
+	clock.Advance(idle)
+	if mounts := connector.Mounts(); len(mounts) != 0 {
+		t.Errorf("idle mount was not unmounted: %+v", mounts)
+	}
+
+	if _, err := os.Lstat(mnt + "/sub"); err != nil {
+		t.Fatalf("Lstat after expiry failed: %v", err)
+	}
+	if n := atomic.LoadInt32(&resolved); n != 2 {
+		t.Errorf("got %d resolves, want 2", n)
+	}
+}
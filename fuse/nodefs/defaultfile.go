@@ -73,3 +73,52 @@ func (f *defaultFile) Ioctl(input *raw.IoctlIn) (output *raw.IoctlOut, data []by
 func (f *defaultFile) Allocate(off uint64, size uint64, mode uint32) (code fuse.Status) {
 	return fuse.ENOSYS
 }
+
+// NewDefaultContextFile returns a ContextFile instance that returns
+// ENOSYS for every operation.
+func NewDefaultContextFile() ContextFile {
+	return (*defaultFile)(nil)
+}
+
+func (f *defaultFile) ReadContext(buf []byte, off int64, context *fuse.Context) (fuse.ReadResult, fuse.Status) {
+	return nil, fuse.ENOSYS
+}
+
+func (f *defaultFile) WriteContext(data []byte, off int64, context *fuse.Context) (uint32, fuse.Status) {
+	return 0, fuse.ENOSYS
+}
+
+func (f *defaultFile) FlushContext(context *fuse.Context) fuse.Status {
+	return fuse.OK
+}
+
+func (f *defaultFile) ReleaseContext(context *fuse.Context) {
+}
+
+func (f *defaultFile) FsyncContext(flags int, context *fuse.Context) (code fuse.Status) {
+	return fuse.ENOSYS
+}
+
+func (f *defaultFile) TruncateContext(size uint64, context *fuse.Context) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (f *defaultFile) GetAttrContext(out *fuse.Attr, context *fuse.Context) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (f *defaultFile) ChownContext(uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (f *defaultFile) ChmodContext(perms uint32, context *fuse.Context) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (f *defaultFile) UtimensContext(atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (f *defaultFile) AllocateContext(off uint64, size uint64, mode uint32, context *fuse.Context) (code fuse.Status) {
+	return fuse.ENOSYS
+}
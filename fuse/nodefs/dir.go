@@ -7,32 +7,80 @@ import (
 	"github.com/hanwen/go-fuse/raw"
 )
 
+// extraOffset is the directory offset of the entries that the
+// connector adds after those of the node: mount points, "." and "..".
+const extraOffset = 1 << 62
+
 type connectorDir struct {
-	node       Node
-	stream     []fuse.DirEntry
+	node   Node
+	stream DirStream
+	extra  []fuse.DirEntry
+
+	// If not set, inode numbers from the node are not passed on,
+	// since they would not match the node IDs reported by stat.
+	reportInodes bool
+
+	// The stream is positioned after cookie.  If pending is set,
+	// it was read from the stream, but did not fit in the
+	// previous ReadDir.
+	cookie  uint64
+	pending *dirStreamEntry
+
 	lastOffset uint64
 }
 
+type dirStreamEntry struct {
+	entry  fuse.DirEntry
+	cookie uint64
+}
+
+// openDirStream opens the listing of a node, using OpenDirStream if
+// the node supports it.
+func openDirStream(node Node, context *fuse.Context) (DirStream, fuse.Status) {
+	if sn, ok := node.(DirStreamNode); ok {
+		return sn.OpenDirStream(context)
+	}
+	entries, code := node.OpenDir(context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return NewDirStream(entries), fuse.OK
+}
+
 func (d *connectorDir) ReadDir(list *fuse.DirEntryList, input *raw.ReadIn) (code fuse.Status) {
 	if d.stream == nil {
 		return fuse.OK
 	}
 	// rewinddir() should be as if reopening directory.
-	// TODO - test this.
 	if d.lastOffset > 0 && input.Offset == 0 {
-		d.stream, code = d.node.OpenDir(nil)
+		d.stream.Close()
+		d.stream, code = openDirStream(d.node, nil)
 		if !code.Ok() {
 			return code
 		}
+		d.cookie = 0
+		d.pending = nil
 	}
 
-	todo := d.stream[input.Offset:]
-	for _, e := range todo {
-		if e.Name == "" {
-			log.Printf("got emtpy directory entry, mode %o.", e.Mode)
-			continue
+	off := input.Offset
+	if off < extraOffset {
+		if off != d.cookie {
+			d.pending = nil
+			if code = d.stream.Seek(off); !code.Ok() {
+				return code
+			}
+			d.cookie = off
+		}
+		eof, code := d.readStream(list)
+		if !eof {
+			d.lastOffset = list.Offset
+			return code
 		}
-		if !list.AddDirEntry(e) {
+		off = extraOffset
+	}
+
+	for i := off - extraOffset; i < uint64(len(d.extra)); i++ {
+		if !list.AddWithOffset(d.extra[i], extraOffset+i+1) {
 			break
 		}
 	}
@@ -40,11 +88,82 @@ func (d *connectorDir) ReadDir(list *fuse.DirEntryList, input *raw.ReadIn) (code
 	return fuse.OK
 }
 
-// Read everything so we make goroutines exit.
+// readStream adds entries from the stream to list, and returns
+// whether the end of the stream was reached.  Errors from the stream
+// are only returned if no entries were added.
+func (d *connectorDir) readStream(list *fuse.DirEntryList) (eof bool, code fuse.Status) {
+	for {
+		e := d.pending
+		d.pending = nil
+		if e == nil {
+			if !d.stream.HasNext() {
+				return true, fuse.OK
+			}
+			entry, cookie, code := d.stream.Next()
+			if !code.Ok() {
+				if len(list.Bytes()) > 0 {
+					return false, fuse.OK
+				}
+				return false, code
+			}
+			e = &dirStreamEntry{entry, cookie}
+		}
+		if e.entry.Name == "" {
+			log.Printf("got emtpy directory entry, mode %o.", e.entry.Mode)
+			d.cookie = e.cookie
+			continue
+		}
+		if !d.reportInodes {
+			e.entry.Ino = 0
+		}
+		if !list.AddWithOffset(e.entry, e.cookie) {
+			d.pending = e
+			return false, fuse.OK
+		}
+		d.cookie = e.cookie
+	}
+}
+
 func (d *connectorDir) Release() {
+	if d.stream != nil {
+		d.stream.Close()
+	}
 }
 
 type rawDir interface {
 	ReadDir(out *fuse.DirEntryList, input *raw.ReadIn) fuse.Status
 	Release()
 }
+
+// NewDirStream returns a DirStream over a fixed list of entries,
+// for nodes that implement OpenDir only.  The cookies are positions
+// in the list.
+func NewDirStream(entries []fuse.DirEntry) DirStream {
+	return &sliceDirStream{entries: entries}
+}
+
+type sliceDirStream struct {
+	entries []fuse.DirEntry
+	pos     int
+}
+
+func (s *sliceDirStream) HasNext() bool {
+	return s.pos < len(s.entries)
+}
+
+func (s *sliceDirStream) Next() (fuse.DirEntry, uint64, fuse.Status) {
+	e := s.entries[s.pos]
+	s.pos++
+	return e, uint64(s.pos), fuse.OK
+}
+
+func (s *sliceDirStream) Seek(cookie uint64) fuse.Status {
+	if cookie > uint64(len(s.entries)) {
+		cookie = uint64(len(s.entries))
+	}
+	s.pos = int(cookie)
+	return fuse.OK
+}
+
+func (s *sliceDirStream) Close() {
+}
@@ -249,6 +249,13 @@ func (f *readOnlyFile) Chown(uid uint32, gid uint32) fuse.Status {
 	return fuse.EPERM
 }
 
+func (f *readOnlyFile) Lseek(off int64, whence int) (int64, fuse.Status) {
+	if lf, ok := f.File.(LseekFile); ok {
+		return lf.Lseek(off, whence)
+	}
+	return 0, fuse.ENOSYS
+}
+
 func (f *readOnlyFile) Allocate(off uint64, sz uint64, mode uint32) fuse.Status {
 	return fuse.EPERM
 }
@@ -1,10 +1,14 @@
 package nodefs
 
 import (
+	"math"
+	"runtime"
 	"syscall"
 	"time"
+	"unsafe"
 
 	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/splice"
 )
 
 func (f *loopbackFile) Allocate(off uint64, sz uint64, mode uint32) fuse.Status {
@@ -39,3 +43,75 @@ func (f *loopbackFile) Utimens(a *time.Time, m *time.Time) fuse.Status {
 	err := syscall.Futimes(int(f.File.Fd()), tv)
 	return fuse.ToStatus(err)
 }
+
+// copy_file_range is not in package syscall; these are its numbers
+// for the architectures we build on.
+var sysCopyFileRange = map[string]uintptr{
+	"386":   377,
+	"amd64": 326,
+	"arm":   391,
+	"arm64": 285,
+}
+
+func copyFileRange(fdIn uintptr, offIn int64, fdOut uintptr, offOut int64, size uint64, flags uint32) (int, error) {
+	nr, ok := sysCopyFileRange[runtime.GOARCH]
+	if !ok {
+		return 0, syscall.ENOSYS
+	}
+	n, _, errNo := syscall.Syscall6(nr,
+		fdIn, uintptr(unsafe.Pointer(&offIn)),
+		fdOut, uintptr(unsafe.Pointer(&offOut)),
+		uintptr(size), uintptr(flags))
+	if errNo != 0 {
+		return 0, errNo
+	}
+	return int(n), nil
+}
+
+// CopyFileRange uses copy_file_range(2) on the backing files, and
+// copies through a splice pair if the backing file system cannot.
+func (f *loopbackFile) CopyFileRange(offIn int64, dst File, offOut int64, size uint64, flags uint32) (uint32, fuse.Status) {
+	d := innerLoopbackFile(dst)
+	if d == nil {
+		return 0, fuse.Status(syscall.EOPNOTSUPP)
+	}
+	src, out := f.File, d.File
+
+	// The reply counts at most 4G bytes; copying less than asked
+	// is allowed.
+	if size > math.MaxUint32 {
+		size = math.MaxUint32
+	}
+	n, err := copyFileRange(src.Fd(), offIn, out.Fd(), offOut, size, flags)
+	switch err {
+	case syscall.ENOSYS, syscall.EXDEV, syscall.EOPNOTSUPP:
+		if flags != 0 {
+			break
+		}
+		m, err := splice.CopyRange(out, offOut, src, offIn, int64(size))
+		return uint32(m), fuse.ToStatus(err)
+	}
+	return uint32(n), fuse.ToStatus(err)
+}
+
+func (f *loopbackFile) Lseek(off int64, whence int) (int64, fuse.Status) {
+	f.lock.Lock()
+	n, err := syscall.Seek(int(f.File.Fd()), off, whence)
+	f.lock.Unlock()
+	return n, fuse.ToStatus(err)
+}
+
+// innerLoopbackFile returns the loopbackFile that f wraps, if any.
+func innerLoopbackFile(f File) *loopbackFile {
+	for f != nil {
+		switch t := f.(type) {
+		case *loopbackFile:
+			return t
+		case *WithFlags:
+			f = t.File
+		default:
+			f = f.InnerFile()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package nodefs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// wrappedFile hides the File it wraps from type assertions, as
+// pathfs does for O_TMPFILE files.
+type wrappedFile struct {
+	File
+}
+
+func (f *wrappedFile) InnerFile() File {
+	return f.File
+}
+
+func TestLoopbackCopyFileRangeWrapped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-files_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/src", []byte("0123456789"), 0644)
+	ioutil.WriteFile(dir+"/dst", []byte("abcdefghij"), 0644)
+
+	src, err := os.Open(dir + "/src")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(dir+"/dst", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer dst.Close()
+
+	f := NewLoopbackFile(src).(*loopbackFile)
+	d := &WithFlags{File: &wrappedFile{NewLoopbackFile(dst)}}
+	n, code := f.CopyFileRange(2, d, 4, 5, 0)
+	if !code.Ok() || n != 5 {
+		t.Fatalf("CopyFileRange: got %d, %v, want 5, OK", n, code)
+	}
+	want := "abcd23456j"
+	if c, err := ioutil.ReadFile(dir + "/dst"); err != nil || string(c) != want {
+		t.Errorf("got %q, %v, want %q", c, err, want)
+	}
+}
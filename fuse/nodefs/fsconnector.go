@@ -8,7 +8,9 @@ import (
 	"log"
 	"path/filepath"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 	"unsafe"
 
@@ -45,6 +47,11 @@ type FileSystemConnector struct {
 
 	// The root of the FUSE file system.
 	rootNode *Inode
+
+	// Mounts that were detached with UnmountDetach but still have
+	// open files, keyed to the path they were mounted on.
+	detachedMutex sync.Mutex
+	detached      map[*fileSystemMount]string
 }
 
 func NewOptions() *Options {
@@ -62,7 +69,12 @@ func NewFileSystemConnector(nodeFs FileSystem, opts *Options) (c *FileSystemConn
 		opts = NewOptions()
 	}
 	c.nodeFs = nodeFs
-	c.inodeMap = newHandleMap(opts.PortableInodes)
+	c.detached = map[*fileSystemMount]string{}
+	if opts.ExportNodeIds {
+		c.inodeMap = newExportHandleMap(c.exportNodeId)
+	} else {
+		c.inodeMap = newHandleMap(opts.PortableInodes)
+	}
 	c.rootNode = newInode(true, nodeFs.Root())
 
 	// Make sure we don't reuse generation numbers.
@@ -98,10 +110,10 @@ func (c *FileSystemConnector) verify() {
 
 func (c *rawBridge) childLookup(out *raw.EntryOut, fsi Node) {
 	n := fsi.Inode()
-	fsi.GetAttr((*fuse.Attr)(&out.Attr), nil, nil)
-	n.mount.fillEntry(out)
-	out.Ino = c.fsConn().lookupUpdate(n)
-	out.NodeId = out.Ino
+	t, _ := getAttr(n, (*fuse.Attr)(&out.Attr), nil, nil)
+	n.mount.fillEntry(out, n, t)
+	out.NodeId = c.fsConn().lookupUpdate(n)
+	n.mount.fillIno(&out.Attr, out.NodeId)
 	if out.Nlink == 0 {
 		// With Nlink == 0, newer kernels will refuse link
 		// operations.
@@ -117,6 +129,73 @@ func (c *rawBridge) toInode(nodeid uint64) *Inode {
 	return i
 }
 
+// exportNodeId asks the FileSystem for the node ID to use for the
+// given inode.  It is used as the ID function of the handle map if
+// Options.ExportNodeIds is set.  Only IDs of the root FileSystem are
+// resolved after a restart, so nodes of submounts, and of a root
+// FileSystem that does not implement ExportFileSystem, get IDs
+// derived from the address of the inode, with localNodeId set.
+func (c *FileSystemConnector) exportNodeId(obj *handled, inUse func(uint64) bool) uint64 {
+	node := (*Inode)(unsafe.Pointer(obj))
+	if node == c.rootNode {
+		return raw.FUSE_ROOT_ID
+	}
+	fs, ok := node.mount.fs.(ExportFileSystem)
+	if !ok || node.mount != c.rootNode.mount {
+		node.generation = c.nextGeneration()
+		return localNodeId | uint64(uintptr(unsafe.Pointer(obj)))>>3
+	}
+	id, generation := fs.NodeId(node.fsInode, inUse)
+	node.generation = generation
+	return id
+}
+
+// resolveNodeId returns the inode for a node ID from the kernel.
+// With Options.ExportNodeIds, this may be an ID from an earlier
+// process, which is resolved through the root FileSystem.
+func (c *FileSystemConnector) resolveNodeId(nodeId uint64, context *fuse.Context) *Inode {
+	if nodeId == raw.FUSE_ROOT_ID {
+		return c.rootNode
+	}
+	if _, ok := c.inodeMap.(*exportHandleMap); !ok {
+		return (*Inode)(unsafe.Pointer(c.inodeMap.Decode(nodeId)))
+	}
+	if h := c.inodeMap.Decode(nodeId); h != nil {
+		return (*Inode)(unsafe.Pointer(h))
+	}
+	fs, ok := c.rootNode.mount.fs.(ExportFileSystem)
+	if !ok {
+		return nil
+	}
+	node := fs.ResolveNodeId(nodeId, context)
+	if node == nil {
+		return nil
+	}
+	return node.Inode()
+}
+
+// findParent returns the directory that contains node, by searching
+// the tree from the root.  The root is its own parent.
+func (c *FileSystemConnector) findParent(node *Inode) *Inode {
+	if node == c.rootNode {
+		return node
+	}
+	todo := []*Inode{c.rootNode}
+	for len(todo) > 0 {
+		n := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		for _, ch := range n.Children() {
+			if ch == node {
+				return n
+			}
+			if ch.IsDir() {
+				todo = append(todo, ch)
+			}
+		}
+	}
+	return nil
+}
+
 // Must run outside treeLock.  Returns the nodeId.
 func (c *FileSystemConnector) lookupUpdate(node *Inode) (id uint64) {
 	id = c.inodeMap.Register(&node.handled)
@@ -230,7 +309,7 @@ func (c *FileSystemConnector) LookupNode(parent *Inode, path string) *Inode {
 	components := strings.Split(path, "/")
 	for _, r := range components {
 		var a fuse.Attr
-		child, _ := c.internalLookup(&a, parent, r, nil)
+		child, _, _ := c.internalLookup(&a, parent, r, nil)
 		if child == nil {
 			return nil
 		}
@@ -241,6 +320,23 @@ func (c *FileSystemConnector) LookupNode(parent *Inode, path string) *Inode {
 	return parent
 }
 
+// mountUser is implemented by nodes that want to know when the file
+// systems mounted on their children are used.
+type mountUser interface {
+	mountUsed(mountInode *Inode)
+}
+
+// noteMountUse tells the node that n is mounted on that n was used.
+func (c *FileSystemConnector) noteMountUse(n *Inode) {
+	m := n.mountPoint
+	if m == nil || m.parentInode == nil {
+		return
+	}
+	if u, ok := m.parentInode.fsInode.(mountUser); ok {
+		u.mountUsed(n)
+	}
+}
+
 ////////////////////////////////////////////////////////////////
 
 func (c *FileSystemConnector) MountRoot(nodeFs FileSystem, opts *Options) {
@@ -301,6 +397,12 @@ func (c *FileSystemConnector) Unmount(node *Inode) fuse.Status {
 		log.Println("not a mountpoint:", c.inodeMap.Handle(&node.handled))
 		return fuse.EINVAL
 	}
+	c.detachedMutex.Lock()
+	_, detached := c.detached[node.mountPoint]
+	c.detachedMutex.Unlock()
+	if detached {
+		return fuse.EINVAL
+	}
 
 	nodeId := c.inodeMap.Handle(&node.handled)
 
@@ -364,6 +466,189 @@ func (c *FileSystemConnector) Unmount(node *Inode) fuse.Status {
 	return fuse.OK
 }
 
+// UnmountDetach is the lazy variant of Unmount.  It removes the
+// mount from the tree right away, and asks the kernel to drop its
+// directory entry.  Open files of the mount keep working; the file
+// system gets its OnUnmount call once the last of them is released.
+//
+// Returns the following error codes:
+//
+// EINVAL: node is not a mount point.
+//
+// EBUSY: there are submounts below this node.
+func (c *FileSystemConnector) UnmountDetach(node *Inode) fuse.Status {
+	if node.mountPoint == nil || node == c.rootNode {
+		return fuse.EINVAL
+	}
+	path := c.mountPath(node)
+
+	mount := node.mountPoint
+	parentNode := mount.parentInode
+	parentNode.mount.treeLock.Lock()
+	if mount.mountInode != node {
+		parentNode.mount.treeLock.Unlock()
+		return fuse.EINVAL
+	}
+	mount.treeLock.RLock()
+	busy := node.hasSubmounts()
+	mount.treeLock.RUnlock()
+	if busy {
+		parentNode.mount.treeLock.Unlock()
+		return fuse.EBUSY
+	}
+	name := mount.mountName()
+	delete(parentNode.children, name)
+	parentNode.mount.treeLock.Unlock()
+
+	c.detachedMutex.Lock()
+	c.detached[mount] = path
+	c.detachedMutex.Unlock()
+	if c.debug {
+		log.Println("UnmountDetach:", mount.fs, "from", path)
+	}
+
+	code := c.EntryNotify(parentNode, name)
+	c.releaseDetached(mount)
+	return code
+}
+
+// releaseDetached finishes a detached mount if it has no open files
+// left.  Counting the files shares the releaseMu of the mount with
+// registerOpen, so no file can be opened on a finished mount.
+func (c *FileSystemConnector) releaseDetached(mount *fileSystemMount) {
+	c.detachedMutex.Lock()
+	_, ok := c.detached[mount]
+	c.detachedMutex.Unlock()
+	if !ok {
+		return
+	}
+
+	mount.releaseMu.Lock()
+	if mount.released || mount.openFiles.Count() > 0 {
+		mount.releaseMu.Unlock()
+		return
+	}
+	mount.released = true
+	mount.releaseMu.Unlock()
+
+	c.detachedMutex.Lock()
+	delete(c.detached, mount)
+	c.detachedMutex.Unlock()
+
+	// Like Unmount, so the kernel can forget the root.
+	mount.treeLock.Lock()
+	mount.mountInode.mountPoint = nil
+	mount.mountInode = nil
+	mount.treeLock.Unlock()
+	mount.fs.OnUnmount()
+}
+
+// registerOpen registers an opened file or directory of node.  It
+// returns ESTALE if the mount of node was detached and finished.
+func (c *FileSystemConnector) registerOpen(node *Inode, dir rawDir, f File, flags uint32) (uint64, *openedFile, fuse.Status) {
+	node.mount.releaseMu.Lock()
+	defer node.mount.releaseMu.Unlock()
+	if node.mount.released {
+		return 0, nil, fuse.Status(syscall.ESTALE)
+	}
+	h, opened := node.mount.registerFileHandle(node, dir, f, flags)
+	return h, opened, fuse.OK
+}
+
+// MountInfo describes a submount of a FileSystemConnector.
+type MountInfo struct {
+	// Path of the mount point, relative to the root.  For
+	// detached mounts, this is the path it was mounted on.
+	Path string
+
+	FileSystem FileSystem
+
+	// Root of the mounted file system.
+	Root *Inode
+
+	// Number of open file and directory handles.
+	OpenFiles int
+
+	// Number of inodes of this mount in the tree.
+	Inodes int
+
+	// Set if the mount was detached with UnmountDetach, and is
+	// waiting for its open files to be released.
+	Detached bool
+}
+
+// Mounts returns the submounts below the root, including detached
+// ones.  The root mount itself is not listed.
+func (c *FileSystemConnector) Mounts() []MountInfo {
+	var out []MountInfo
+	c.collectMounts(c.rootNode, "", false, &out)
+
+	c.detachedMutex.Lock()
+	detached := make(map[*fileSystemMount]string, len(c.detached))
+	for m, p := range c.detached {
+		detached[m] = p
+	}
+	c.detachedMutex.Unlock()
+
+	for m, p := range detached {
+		root := m.detachedRoot()
+		if root == nil {
+			continue
+		}
+		out = append(out, MountInfo{
+			Path:       p,
+			FileSystem: m.fs,
+			Root:       root,
+			OpenFiles:  m.openFiles.Count(),
+			Inodes:     root.fsInodeCount(),
+			Detached:   true,
+		})
+		c.collectMounts(root, p, true, &out)
+	}
+	return out
+}
+
+func (c *FileSystemConnector) collectMounts(n *Inode, path string, detached bool, out *[]MountInfo) {
+	for name, ch := range n.Children() {
+		p := filepath.Join(path, name)
+		if m := ch.mountPoint; m != nil {
+			*out = append(*out, MountInfo{
+				Path:       p,
+				FileSystem: m.fs,
+				Root:       ch,
+				OpenFiles:  m.openFiles.Count(),
+				Inodes:     ch.fsInodeCount(),
+				Detached:   detached,
+			})
+		}
+		if ch.IsDir() {
+			c.collectMounts(ch, p, detached, out)
+		}
+	}
+}
+
+// mountPath returns the path of node relative to the root, by
+// searching the tree.
+func (c *FileSystemConnector) mountPath(node *Inode) string {
+	var find func(n *Inode, path string) (string, bool)
+	find = func(n *Inode, path string) (string, bool) {
+		for name, ch := range n.Children() {
+			p := filepath.Join(path, name)
+			if ch == node {
+				return p, true
+			}
+			if ch.IsDir() {
+				if r, ok := find(ch, p); ok {
+					return r, true
+				}
+			}
+		}
+		return "", false
+	}
+	p, _ := find(c.rootNode, "")
+	return p
+}
+
 func (c *FileSystemConnector) FileNotify(node *Inode, off int64, length int64) fuse.Status {
 	var nId uint64
 	if node == c.rootNode {
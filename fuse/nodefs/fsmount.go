@@ -3,6 +3,7 @@ package nodefs
 import (
 	"log"
 	"sync"
+	"time"
 	"unsafe"
 
 	"github.com/hanwen/go-fuse/fuse"
@@ -43,11 +44,30 @@ type fileSystemMount struct {
 	// Manage filehandles of open files.
 	openFiles handleMap
 
+	// Set when a detached mount is finished.  releaseMu also
+	// keeps files from being opened while it is finished.
+	releaseMu sync.Mutex
+	released  bool
+
 	Debug bool
 
 	connector *FileSystemConnector
 }
 
+// detachedRoot returns the root of a detached mount, or nil if the
+// mount was finished.
+func (m *fileSystemMount) detachedRoot() *Inode {
+	m.releaseMu.Lock()
+	released := m.released
+	m.releaseMu.Unlock()
+	if released {
+		return nil
+	}
+	m.treeLock.RLock()
+	defer m.treeLock.RUnlock()
+	return m.mountInode
+}
+
 // Must called with lock for parent held.
 func (m *fileSystemMount) mountName() string {
 	for k, v := range m.parentInode.children {
@@ -65,19 +85,46 @@ func (m *fileSystemMount) setOwner(attr *raw.Attr) {
 	}
 }
 
-func (m *fileSystemMount) fillEntry(out *raw.EntryOut) {
-	splitDuration(m.options.EntryTimeout, &out.EntryValid, &out.EntryValidNsec)
-	splitDuration(m.options.AttrTimeout, &out.AttrValid, &out.AttrValidNsec)
+// timeouts returns the entry and attribute timeouts for the given
+// inode.  Timeouts t returned from the operation itself take
+// precedence over those of the Node.
+func (m *fileSystemMount) timeouts(n *Inode, t *Timeouts) (entry time.Duration, attr time.Duration) {
+	entry, attr = m.options.EntryTimeout, m.options.AttrTimeout
+	if t != nil {
+		return t.Entry, t.Attr
+	}
+	if tn, ok := n.fsInode.(TimeoutNode); ok {
+		if t := tn.Timeouts(); t != nil {
+			entry, attr = t.Entry, t.Attr
+		}
+	}
+	return entry, attr
+}
+
+func (m *fileSystemMount) fillEntry(out *raw.EntryOut, n *Inode, t *Timeouts) {
+	entry, attr := m.timeouts(n, t)
+	splitDuration(entry, &out.EntryValid, &out.EntryValidNsec)
+	splitDuration(attr, &out.AttrValid, &out.AttrValidNsec)
 	m.setOwner(&out.Attr)
 	if out.Mode&fuse.S_IFDIR == 0 && out.Nlink == 0 {
 		out.Nlink = 1
 	}
 }
 
-func (m *fileSystemMount) fillAttr(out *raw.AttrOut, nodeId uint64) {
-	splitDuration(m.options.AttrTimeout, &out.AttrValid, &out.AttrValidNsec)
+func (m *fileSystemMount) fillAttr(out *raw.AttrOut, nodeId uint64, n *Inode, t *Timeouts) {
+	_, attr := m.timeouts(n, t)
+	splitDuration(attr, &out.AttrValid, &out.AttrValidNsec)
 	m.setOwner(&out.Attr)
-	out.Ino = nodeId
+	m.fillIno(&out.Attr, nodeId)
+}
+
+// fillIno sets the inode number reported to the kernel.  This is
+// the node ID, unless Options.ReportInodes is set and the node
+// returned an inode number of its own.
+func (m *fileSystemMount) fillIno(out *raw.Attr, nodeId uint64) {
+	if !m.options.ReportInodes || out.Ino == 0 {
+		out.Ino = nodeId
+	}
 }
 
 func (m *fileSystemMount) getOpenedFile(h uint64) *openedFile {
@@ -140,10 +187,14 @@ func (m *fileSystemMount) registerFileHandle(node *Inode, dir rawDir, f File, fl
 }
 
 // Creates a return entry for a non-existent path.
-func (m *fileSystemMount) negativeEntry(out *raw.EntryOut) bool {
-	if m.options.NegativeTimeout > 0.0 {
+func (m *fileSystemMount) negativeEntry(out *raw.EntryOut, t *Timeouts) bool {
+	negative := m.options.NegativeTimeout
+	if t != nil {
+		negative = t.Negative
+	}
+	if negative > 0.0 {
 		out.NodeId = 0
-		splitDuration(m.options.NegativeTimeout, &out.EntryValid, &out.EntryValidNsec)
+		splitDuration(negative, &out.EntryValid, &out.EntryValidNsec)
 		return true
 	}
 	return false
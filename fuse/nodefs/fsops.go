@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
@@ -24,7 +25,12 @@ func (c *FileSystemConnector) RawFS() fuse.RawFileSystem {
 type rawBridge FileSystemConnector
 
 func (c *rawBridge) Fsync(context *fuse.Context, input *raw.FsyncIn) fuse.Status {
-	return fuse.ENOSYS
+	node := c.toInode(context.NodeId)
+	opened := node.mount.getOpenedFile(input.Fh)
+	if cf, ok := opened.WithFlags.File.(ContextFile); ok {
+		return cf.FsyncContext(int(input.FsyncFlags), context)
+	}
+	return opened.WithFlags.File.Fsync(int(input.FsyncFlags))
 }
 
 func (c *rawBridge) SetDebug(debug bool) {
@@ -68,10 +74,21 @@ func (c *FileSystemConnector) lookupMountUpdate(out *fuse.Attr, mount *fileSyste
 	return mount.mountInode, fuse.OK
 }
 
-func (c *FileSystemConnector) internalLookup(out *fuse.Attr, parent *Inode, name string, context *fuse.Context) (node *Inode, code fuse.Status) {
+// getAttr calls GetAttrTimeout if the node implements
+// AttrTimeoutNode, and GetAttr otherwise.
+func getAttr(n *Inode, out *fuse.Attr, file File, context *fuse.Context) (*Timeouts, fuse.Status) {
+	if tn, ok := n.fsInode.(AttrTimeoutNode); ok {
+		return tn.GetAttrTimeout(out, file, context)
+	}
+	return nil, n.fsInode.GetAttr(out, file, context)
+}
+
+func (c *FileSystemConnector) internalLookup(out *fuse.Attr, parent *Inode, name string, context *fuse.Context) (node *Inode, timeouts *Timeouts, code fuse.Status) {
 	child := parent.GetChild(name)
 	if child != nil && child.mountPoint != nil {
-		return c.lookupMountUpdate(out, child.mountPoint)
+		c.noteMountUse(child)
+		node, code = c.lookupMountUpdate(out, child.mountPoint)
+		return node, nil, code
 	}
 
 	if child != nil {
@@ -79,8 +96,10 @@ func (c *FileSystemConnector) internalLookup(out *fuse.Attr, parent *Inode, name
 	}
 	var fsNode Node
 	if child != nil {
-		code = child.fsInode.GetAttr(out, nil, context)
+		timeouts, code = getAttr(child, out, nil, context)
 		fsNode = child.Node()
+	} else if tn, ok := parent.fsInode.(AttrTimeoutNode); ok {
+		fsNode, timeouts, code = tn.LookupTimeout(out, name, context)
 	} else {
 		fsNode, code = parent.fsInode.Lookup(out, name, context)
 	}
@@ -92,18 +111,48 @@ func (c *FileSystemConnector) internalLookup(out *fuse.Attr, parent *Inode, name
 		}
 	}
 
-	return child, code
+	return child, timeouts, code
+}
+
+// lookupDot answers lookups of "." and "..", which the kernel only
+// issues for exported file systems, possibly for node IDs that it
+// never looked up through us.
+func (c *rawBridge) lookupDot(out *raw.EntryOut, context *fuse.Context, name string) (code fuse.Status) {
+	node := c.fsConn().resolveNodeId(context.NodeId, context)
+	if node != nil && name == ".." {
+		node = c.fsConn().findParent(node)
+	}
+	if node == nil {
+		return fuse.ENOENT
+	}
+
+	timeouts, code := getAttr(node, (*fuse.Attr)(&out.Attr), nil, context)
+	if !code.Ok() {
+		return code
+	}
+	node.mount.fillEntry(out, node, timeouts)
+	if node == c.rootNode {
+		out.NodeId = raw.FUSE_ROOT_ID
+	} else {
+		out.NodeId = c.fsConn().lookupUpdate(node)
+		out.Generation = node.generation
+	}
+	node.mount.fillIno(&out.Attr, out.NodeId)
+	return fuse.OK
 }
 
 func (c *rawBridge) Lookup(out *raw.EntryOut, context *fuse.Context, name string) (code fuse.Status) {
+	if name == "." || name == ".." {
+		return c.lookupDot(out, context, name)
+	}
 	parent := c.toInode(context.NodeId)
 	if !parent.IsDir() {
 		log.Printf("Lookup %q called on non-Directory node %d", name, context.NodeId)
 		return fuse.ENOTDIR
 	}
 	outAttr := (*fuse.Attr)(&out.Attr)
-	child, code := c.fsConn().internalLookup(outAttr, parent, name, context)
-	if code == fuse.ENOENT && parent.mount.negativeEntry(out) {
+	child, timeouts, code := c.fsConn().internalLookup(outAttr, parent, name, context)
+	if code == fuse.ENOENT && parent.mount.negativeEntry(out, timeouts) {
 		return fuse.OK
 	}
 	if !code.Ok() {
@@ -113,10 +162,10 @@ func (c *rawBridge) Lookup(out *raw.EntryOut, context *fuse.Context, name string
 		log.Println("Lookup returned fuse.OK with nil child", name)
 	}
 
-	child.mount.fillEntry(out)
+	child.mount.fillEntry(out, child, timeouts)
 	out.NodeId = c.fsConn().lookupUpdate(child)
 	out.Generation = child.generation
-	out.Ino = out.NodeId
+	child.mount.fillIno(&out.Attr, out.NodeId)
 
 	return fuse.OK
 }
@@ -127,6 +176,7 @@ func (c *rawBridge) Forget(nodeID, nlookup uint64) {
 
 func (c *rawBridge) GetAttr(out *raw.AttrOut, context *fuse.Context, input *raw.GetAttrIn) (code fuse.Status) {
 	node := c.toInode(context.NodeId)
+	c.fsConn().noteMountUse(node)
 
 	var f File
 	if input.Flags()&raw.FUSE_GETATTR_FH != 0 {
@@ -136,29 +186,35 @@ func (c *rawBridge) GetAttr(out *raw.AttrOut, context *fuse.Context, input *raw.
 	}
 
 	dest := (*fuse.Attr)(&out.Attr)
-	code = node.fsInode.GetAttr(dest, f, context)
+	timeouts, code := getAttr(node, dest, f, context)
 	if !code.Ok() {
 		return code
 	}
 
-	node.mount.fillAttr(out, context.NodeId)
+	node.mount.fillAttr(out, context.NodeId, node, timeouts)
 	return fuse.OK
 }
 
 func (c *rawBridge) OpenDir(out *raw.OpenOut, context *fuse.Context, input *raw.OpenIn) (code fuse.Status) {
 	node := c.toInode(context.NodeId)
-	stream, err := node.fsInode.OpenDir(context)
+	c.fsConn().noteMountUse(node)
+	stream, err := openDirStream(node.fsInode, context)
 	if err != fuse.OK {
 		return err
 	}
-	stream = append(stream, node.getMountDirEntries()...)
 	de := &connectorDir{
-		node: node.Node(),
-		stream: append(stream,
-			fuse.DirEntry{fuse.S_IFDIR, "."},
-			fuse.DirEntry{fuse.S_IFDIR, ".."}),
+		node:         node.Node(),
+		stream:       stream,
+		reportInodes: node.mount.options.ReportInodes,
+		extra: append(node.getMountDirEntries(),
+			fuse.DirEntry{Mode: fuse.S_IFDIR, Name: "."},
+			fuse.DirEntry{Mode: fuse.S_IFDIR, Name: ".."}),
+	}
+	h, opened, code := c.fsConn().registerOpen(node, de, nil, input.Flags)
+	if !code.Ok() {
+		de.Release()
+		return code
 	}
-	h, opened := node.mount.registerFileHandle(node, de, nil, input.Flags)
 	out.OpenFlags = opened.FuseFlags
 	out.Fh = h
 	return fuse.OK
@@ -172,11 +228,22 @@ func (c *rawBridge) ReadDir(l *fuse.DirEntryList, context *fuse.Context, input *
 
 func (c *rawBridge) Open(out *raw.OpenOut, context *fuse.Context, input *raw.OpenIn) (status fuse.Status) {
 	node := c.toInode(context.NodeId)
+	readOnly := node.mount.options.ReadOnly
+	if readOnly && input.Flags&fuse.O_ANYWRITE != 0 {
+		return fuse.EROFS
+	}
 	f, code := node.fsInode.Open(input.Flags, context)
 	if !code.Ok() {
 		return code
 	}
-	h, opened := node.mount.registerFileHandle(node, nil, f, input.Flags)
+	h, opened, code := c.fsConn().registerOpen(node, nil, f, input.Flags)
+	if !code.Ok() {
+		f.Release()
+		return code
+	}
+	if readOnly {
+		opened.WithFlags.File = NewReadOnlyFile(opened.WithFlags.File)
+	}
 	out.OpenFlags = opened.FuseFlags
 	out.Fh = h
 	return fuse.OK
@@ -184,6 +251,9 @@ func (c *rawBridge) Open(out *raw.OpenOut, context *fuse.Context, input *raw.Ope
 
 func (c *rawBridge) SetAttr(out *raw.AttrOut, context *fuse.Context, input *raw.SetAttrIn) (code fuse.Status) {
 	node := c.toInode(context.NodeId)
+	if node.mount.options.ReadOnly {
+		return fuse.EROFS
+	}
 	var f File
 	if input.Valid&raw.FATTR_FH != 0 {
 		opened := node.mount.getOpenedFile(input.Fh)
@@ -233,18 +303,69 @@ func (c *rawBridge) SetAttr(out *raw.AttrOut, context *fuse.Context, input *raw.
 	// Must call GetAttr(); the filesystem may override some of
 	// the changes we effect here.
 	attr := (*fuse.Attr)(&out.Attr)
-	code = node.fsInode.GetAttr(attr, nil, context)
+	timeouts, code := getAttr(node, attr, nil, context)
 	if code.Ok() {
-		node.mount.fillAttr(out, context.NodeId)
+		node.mount.fillAttr(out, context.NodeId, node, timeouts)
 	}
 	return code
 }
 
 func (c *rawBridge) Fallocate(context *fuse.Context, in *raw.FallocateIn) (code fuse.Status) {
+	n := c.toInode(context.NodeId)
+	if n.mount.options.ReadOnly {
+		return fuse.EROFS
+	}
+	opened := n.mount.getOpenedFile(in.Fh)
+
+	return n.fsInode.Fallocate(opened.WithFlags.File, in.Offset, in.Length, in.Mode, context)
+}
+
+func (c *rawBridge) Lseek(context *fuse.Context, in *raw.LseekIn, out *raw.LseekOut) (code fuse.Status) {
 	n := c.toInode(context.NodeId)
 	opened := n.mount.getOpenedFile(in.Fh)
+	if lf, ok := opened.WithFlags.File.(LseekFile); ok {
+		off, code := lf.Lseek(int64(in.Offset), int(in.Whence))
+		if code != fuse.ENOSYS {
+			out.Offset = uint64(off)
+			return code
+		}
+	}
 
-	return n.fsInode.Fallocate(opened, in.Offset, in.Length, in.Mode, context)
+	// The file is all data, followed by the hole at EOF.
+	var a fuse.Attr
+	if _, code = getAttr(n, &a, opened.WithFlags.File, context); !code.Ok() {
+		return code
+	}
+	if in.Offset >= a.Size {
+		return fuse.Status(syscall.ENXIO)
+	}
+	switch in.Whence {
+	case raw.SEEK_DATA:
+		out.Offset = in.Offset
+	case raw.SEEK_HOLE:
+		out.Offset = a.Size
+	default:
+		return fuse.EINVAL
+	}
+	return fuse.OK
+}
+
+func (c *rawBridge) CopyFileRange(context *fuse.Context, input *raw.CopyFileRangeIn) (written uint32, code fuse.Status) {
+	in := c.toInode(context.NodeId)
+	out := c.toInode(input.NodeIdOut)
+	if out.mount.options.ReadOnly {
+		return 0, fuse.EROFS
+	}
+	if in.mount != out.mount {
+		return 0, fuse.EXDEV
+	}
+	src := in.mount.getOpenedFile(input.FhIn)
+	dst := out.mount.getOpenedFile(input.FhOut)
+	cf, ok := src.WithFlags.File.(CopyFileRangeFile)
+	if !ok {
+		return 0, fuse.Status(syscall.EOPNOTSUPP)
+	}
+	return cf.CopyFileRange(int64(input.OffIn), dst.WithFlags.File, int64(input.OffOut), input.Len, uint32(input.Flags))
 }
 
 func (c *rawBridge) Readlink(context *fuse.Context) (out []byte, code fuse.Status) {
@@ -254,6 +375,9 @@ func (c *rawBridge) Readlink(context *fuse.Context) (out []byte, code fuse.Statu
 
 func (c *rawBridge) Mknod(out *raw.EntryOut, context *fuse.Context, input *raw.MknodIn, name string) (code fuse.Status) {
 	parent := c.toInode(context.NodeId)
+	if parent.mount.options.ReadOnly {
+		return fuse.EROFS
+	}
 	ctx := context
 	fsNode, code := parent.fsInode.Mknod(name, input.Mode, uint32(input.Rdev), ctx)
 	if code.Ok() {
@@ -265,6 +389,9 @@ func (c *rawBridge) Mknod(out *raw.EntryOut, context *fuse.Context, input *raw.M
 
 func (c *rawBridge) Mkdir(out *raw.EntryOut, context *fuse.Context, input *raw.MkdirIn, name string) (code fuse.Status) {
 	parent := c.toInode(context.NodeId)
+	if parent.mount.options.ReadOnly {
+		return fuse.EROFS
+	}
 	ctx := context
 	fsNode, code := parent.fsInode.Mkdir(name, input.Mode, ctx)
 	if code.Ok() {
@@ -276,16 +403,25 @@ func (c *rawBridge) Mkdir(out *raw.EntryOut, context *fuse.Context, input *raw.M
 
 func (c *rawBridge) Unlink(context *fuse.Context, name string) (code fuse.Status) {
 	parent := c.toInode(context.NodeId)
+	if parent.mount.options.ReadOnly {
+		return fuse.EROFS
+	}
 	return parent.fsInode.Unlink(name, context)
 }
 
 func (c *rawBridge) Rmdir(context *fuse.Context, name string) (code fuse.Status) {
 	parent := c.toInode(context.NodeId)
+	if parent.mount.options.ReadOnly {
+		return fuse.EROFS
+	}
 	return parent.fsInode.Rmdir(name, context)
 }
 
 func (c *rawBridge) Symlink(out *raw.EntryOut, context *fuse.Context, pointedTo string, linkName string) (code fuse.Status) {
 	parent := c.toInode(context.NodeId)
+	if parent.mount.options.ReadOnly {
+		return fuse.EROFS
+	}
 	ctx := context
 	fsNode, code := parent.fsInode.Symlink(linkName, pointedTo, ctx)
 	if code.Ok() {
@@ -296,7 +432,14 @@ func (c *rawBridge) Symlink(out *raw.EntryOut, context *fuse.Context, pointedTo
 }
 
 func (c *rawBridge) Rename(context *fuse.Context, input *raw.RenameIn, oldName string, newName string) (code fuse.Status) {
+	return c.Rename2(context, &raw.Rename2In{Newdir: input.Newdir}, oldName, newName)
+}
+
+func (c *rawBridge) Rename2(context *fuse.Context, input *raw.Rename2In, oldName string, newName string) (code fuse.Status) {
 	oldParent := c.toInode(context.NodeId)
+	if oldParent.mount.options.ReadOnly {
+		return fuse.EROFS
+	}
 
 	child := oldParent.GetChild(oldName)
 	if child.mountPoint != nil {
@@ -308,12 +451,27 @@ func (c *rawBridge) Rename(context *fuse.Context, input *raw.RenameIn, oldName s
 		return fuse.EXDEV
 	}
 
-	return oldParent.fsInode.Rename(oldName, newParent.fsInode, newName, context)
+	if input.Flags == 0 {
+		return oldParent.fsInode.Rename(oldName, newParent.fsInode, newName, context)
+	}
+	if input.Flags&raw.RENAME_EXCHANGE != 0 {
+		if target := newParent.GetChild(newName); target != nil && target.mountPoint != nil {
+			return fuse.EBUSY
+		}
+	}
+	rn, ok := oldParent.fsInode.(Rename2Node)
+	if !ok {
+		return fuse.EINVAL
+	}
+	return rn.Rename2(oldName, newParent.fsInode, newName, input.Flags, context)
 }
 
 func (c *rawBridge) Link(out *raw.EntryOut, context *fuse.Context, input *raw.LinkIn, name string) (code fuse.Status) {
 	existing := c.toInode(input.Oldnodeid)
 	parent := c.toInode(context.NodeId)
+	if parent.mount.options.ReadOnly {
+		return fuse.EROFS
+	}
 
 	if existing.mount != parent.mount {
 		return fuse.EXDEV
@@ -335,29 +493,70 @@ func (c *rawBridge) Access(context *fuse.Context, input *raw.AccessIn) (code fus
 
 func (c *rawBridge) Create(out *raw.CreateOut, context *fuse.Context, input *raw.CreateIn, name string) (code fuse.Status) {
 	parent := c.toInode(context.NodeId)
+	if parent.mount.options.ReadOnly {
+		return fuse.EROFS
+	}
 	f, fsNode, code := parent.fsInode.Create(name, uint32(input.Flags), input.Mode, context)
 	if !code.Ok() {
 		return code
 	}
 
+	handle, opened, code := c.fsConn().registerOpen(fsNode.Inode(), nil, f, input.Flags)
+	if !code.Ok() {
+		f.Release()
+		return code
+	}
 	c.childLookup(&out.EntryOut, fsNode)
-	handle, opened := parent.mount.registerFileHandle(fsNode.Inode(), nil, f, input.Flags)
 
 	out.OpenOut.OpenFlags = opened.FuseFlags
 	out.OpenOut.Fh = handle
 	return code
 }
 
+func (c *rawBridge) TmpFile(out *raw.CreateOut, context *fuse.Context, input *raw.CreateIn) (code fuse.Status) {
+	parent := c.toInode(context.NodeId)
+	if parent.mount.options.ReadOnly {
+		return fuse.EROFS
+	}
+	tn, ok := parent.fsInode.(TmpFileNode)
+	if !ok {
+		// Not ENOSYS, as that would disable O_TMPFILE for the
+		// whole mount.
+		return fuse.Status(syscall.EOPNOTSUPP)
+	}
+	f, fsNode, code := tn.TmpFile(uint32(input.Flags), input.Mode, context)
+	if !code.Ok() {
+		return code
+	}
+
+	handle, opened, code := c.fsConn().registerOpen(fsNode.Inode(), nil, f, input.Flags)
+	if !code.Ok() {
+		f.Release()
+		return code
+	}
+	c.childLookup(&out.EntryOut, fsNode)
+
+	out.OpenOut.OpenFlags = opened.FuseFlags
+	out.OpenOut.Fh = handle
+	return fuse.OK
+}
+
 func (c *rawBridge) Release(context *fuse.Context, input *raw.ReleaseIn) {
 	node := c.toInode(context.NodeId)
 	opened := node.mount.unregisterFileHandle(input.Fh, node)
-	opened.WithFlags.File.Release()
+	if cf, ok := opened.WithFlags.File.(ContextFile); ok {
+		cf.ReleaseContext(context)
+	} else {
+		opened.WithFlags.File.Release()
+	}
+	c.fsConn().releaseDetached(node.mount)
 }
 
 func (c *rawBridge) ReleaseDir(context *fuse.Context, input *raw.ReleaseIn) {
 	node := c.toInode(context.NodeId)
 	opened := node.mount.unregisterFileHandle(input.Fh, node)
 	opened.dir.Release()
+	c.fsConn().releaseDetached(node.mount)
 }
 
 func (c *rawBridge) GetXAttrSize(context *fuse.Context, attribute string) (sz int, code fuse.Status) {
@@ -373,11 +572,17 @@ func (c *rawBridge) GetXAttrData(context *fuse.Context, attribute string) (data
 
 func (c *rawBridge) RemoveXAttr(context *fuse.Context, attr string) fuse.Status {
 	node := c.toInode(context.NodeId)
+	if node.mount.options.ReadOnly {
+		return fuse.EROFS
+	}
 	return node.fsInode.RemoveXAttr(attr, context)
 }
 
 func (c *rawBridge) SetXAttr(context *fuse.Context, input *raw.SetXAttrIn, attr string, data []byte) fuse.Status {
 	node := c.toInode(context.NodeId)
+	if node.mount.options.ReadOnly {
+		return fuse.EROFS
+	}
 	return node.fsInode.SetXAttr(attr, data, int(input.Flags), context)
 }
 
@@ -402,14 +607,22 @@ func (c *rawBridge) ListXAttr(context *fuse.Context) (data []byte, code fuse.Sta
 
 func (c *rawBridge) Write(context *fuse.Context, input *raw.WriteIn, data []byte) (written uint32, code fuse.Status) {
 	node := c.toInode(context.NodeId)
+	if node.mount.options.ReadOnly {
+		return 0, fuse.EROFS
+	}
 	opened := node.mount.getOpenedFile(input.Fh)
+	if cf, ok := opened.WithFlags.File.(ContextFile); ok {
+		return cf.WriteContext(data, int64(input.Offset), context)
+	}
 	return opened.WithFlags.File.Write(data, int64(input.Offset))
 }
 
 func (c *rawBridge) Read(context *fuse.Context, input *raw.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
 	node := c.toInode(context.NodeId)
 	opened := node.mount.getOpenedFile(input.Fh)
-
+	if cf, ok := opened.WithFlags.File.(ContextFile); ok {
+		return cf.ReadContext(buf, int64(input.Offset), context)
+	}
 	return opened.WithFlags.File.Read(buf, int64(input.Offset))
 }
 
@@ -426,5 +639,8 @@ func (c *rawBridge) StatFs(out *raw.StatfsOut, context *fuse.Context) fuse.Statu
 func (c *rawBridge) Flush(context *fuse.Context, input *raw.FlushIn) fuse.Status {
 	node := c.toInode(context.NodeId)
 	opened := node.mount.getOpenedFile(input.Fh)
+	if cf, ok := opened.WithFlags.File.(ContextFile); ok {
+		return cf.FlushContext(context)
+	}
 	return opened.WithFlags.File.Flush()
 }
@@ -6,7 +6,11 @@ import (
 
 func MountFileSystem(mountpoint string, nodeFs FileSystem, opts *Options) (*fuse.Server, *FileSystemConnector, error) {
 	conn := NewFileSystemConnector(nodeFs, opts)
-	s, err := fuse.NewServer(conn.RawFS(), mountpoint, nil)
+	var mountOpts *fuse.MountOptions
+	if opts != nil && opts.ReadOnly {
+		mountOpts = &fuse.MountOptions{Options: []string{"ro"}}
+	}
+	s, err := fuse.NewServer(conn.RawFS(), mountpoint, mountOpts)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -343,3 +343,93 @@ func (m *int64HandleMap) Decode(handle uint64) (val *handled) {
 	}
 	return val
 }
+
+// localNodeId is set in the handles of objects that are not
+// exported, so they cannot clash with exported handles.
+const localNodeId = 1 << 63
+
+// exportHandleMap hands out handles chosen by a callback rather than
+// derived from the object address, so they can stay valid across
+// restarts of the process.  Decode returns nil for unknown handles.
+// The callback is passed a function that says whether a handle is
+// taken, and must return a free one.
+type exportHandleMap struct {
+	mutex   sync.RWMutex
+	id      func(obj *handled, inUse func(uint64) bool) uint64
+	handles map[uint64]*handled
+}
+
+func newExportHandleMap(id func(obj *handled, inUse func(uint64) bool) uint64) *exportHandleMap {
+	return &exportHandleMap{
+		id:      id,
+		handles: make(map[uint64]*handled),
+	}
+}
+
+func (m *exportHandleMap) Register(obj *handled) (handle uint64) {
+	m.mutex.Lock()
+	if obj.count == 0 {
+		handle = m.id(obj, func(h uint64) bool {
+			if h <= 1 || h&localNodeId != 0 {
+				return true
+			}
+			other := m.handles[h]
+			return other != nil && other != obj
+		})
+		if other := m.handles[handle]; other != nil && other != obj {
+			panic(fmt.Sprintf("handle %d is in use", handle))
+		}
+		m.handles[handle] = obj
+		obj.handle = handle
+	} else {
+		handle = obj.handle
+	}
+	obj.count++
+	m.mutex.Unlock()
+	return handle
+}
+
+func (m *exportHandleMap) Handle(obj *handled) (h uint64) {
+	m.mutex.RLock()
+	if obj.count > 0 {
+		h = obj.handle
+	}
+	m.mutex.RUnlock()
+	return h
+}
+
+func (m *exportHandleMap) Count() int {
+	m.mutex.RLock()
+	c := len(m.handles)
+	m.mutex.RUnlock()
+	return c
+}
+
+func (m *exportHandleMap) Decode(h uint64) *handled {
+	m.mutex.RLock()
+	v := m.handles[h]
+	m.mutex.RUnlock()
+	return v
+}
+
+func (m *exportHandleMap) Forget(h uint64, count int) (forgotten bool, obj *handled) {
+	m.mutex.Lock()
+	obj = m.handles[h]
+	obj.count -= count
+	if obj.count < 0 {
+		panic("underflow")
+	} else if obj.count == 0 {
+		delete(m.handles, h)
+		forgotten = true
+		obj.handle = 0
+	}
+	m.mutex.Unlock()
+	return forgotten, obj
+}
+
+func (m *exportHandleMap) Has(h uint64) bool {
+	m.mutex.RLock()
+	_, ok := m.handles[h]
+	m.mutex.RUnlock()
+	return ok
+}
@@ -136,3 +136,33 @@ func TestHandleMapCheckFail(t *testing.T) {
 	hm.Decode(h | (uint64(1) << 63))
 	t.Error("Borked decode did not panic")
 }
+
+func TestExportHandleMapCollision(t *testing.T) {
+	hm := newExportHandleMap(func(obj *handled, inUse func(uint64) bool) uint64 {
+		id := uint64(5)
+		for inUse(id) {
+			id++
+		}
+		return id
+	})
+	a, b := new(handled), new(handled)
+	ha := hm.Register(a)
+	hb := hm.Register(b)
+	if ha != 5 || hb != 6 {
+		t.Fatalf("got handles %d and %d, want 5 and 6", ha, hb)
+	}
+	if hm.Decode(ha) != a || hm.Decode(hb) != b {
+		t.Fatal("address mismatch")
+	}
+	if h := hm.Register(b); h != hb {
+		t.Errorf("double register should reuse handle: got %d want %d", h, hb)
+	}
+}
+
+func TestExportHandleMapTaken(t *testing.T) {
+	defer markSeen(t, "in use")
+	hm := newExportHandleMap(func(obj *handled, inUse func(uint64) bool) uint64 { return 5 })
+	hm.Register(new(handled))
+	hm.Register(new(handled))
+	t.Error("Register of a taken handle did not panic")
+}
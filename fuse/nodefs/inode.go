@@ -192,6 +192,26 @@ func (n *Inode) canUnmount() bool {
 	return ok
 }
 
+// Must be called with treeLock held.
+func (n *Inode) hasSubmounts() bool {
+	for _, v := range n.children {
+		if v.mountPoint != nil || v.hasSubmounts() {
+			return true
+		}
+	}
+	return false
+}
+
+// fsInodeCount returns the number of inodes in the tree below n,
+// including n, that belong to the same mount.
+func (n *Inode) fsInodeCount() int {
+	count := 1
+	for _, v := range n.FsChildren() {
+		count += v.fsInodeCount()
+	}
+	return count
+}
+
 func (n *Inode) getMountDirEntries() (out []fuse.DirEntry) {
 	n.mount.treeLock.RLock()
 	for k, v := range n.children {
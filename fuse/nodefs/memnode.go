@@ -71,7 +71,15 @@ type memNode struct {
 	id int
 
 	link string
+
+	// Protects the fields below once the node is visible.
+	mu   sync.Mutex
 	info fuse.Attr
+
+	// tmpFile is set for an O_TMPFILE node until it is linked in.
+	// Its backing file is removed when the last file is released.
+	tmpFile   bool
+	openFiles int
 }
 
 func (n *memNode) newNode(isdir bool) *memNode {
@@ -128,6 +136,11 @@ func (n *memNode) Rename(oldName string, newParent Node, newName string, context
 }
 
 func (n *memNode) Link(name string, existing Node, context *fuse.Context) (newNode Node, code fuse.Status) {
+	if m, ok := existing.(*memNode); ok {
+		m.mu.Lock()
+		m.tmpFile = false
+		m.mu.Unlock()
+	}
 	n.Inode().AddChild(name, existing.Inode())
 	return existing, code
 }
@@ -144,6 +157,18 @@ func (n *memNode) Create(name string, flags uint32, mode uint32, context *fuse.C
 	return ch.newFile(f), ch, fuse.OK
 }
 
+func (n *memNode) TmpFile(flags uint32, mode uint32, context *fuse.Context) (file File, child Node, code fuse.Status) {
+	ch := n.newNode(false)
+	ch.info.Mode = mode | fuse.S_IFREG
+	ch.tmpFile = true
+
+	f, err := os.Create(ch.filename())
+	if err != nil {
+		return nil, nil, fuse.ToStatus(err)
+	}
+	return ch.newFile(f), ch, fuse.OK
+}
+
 type memNodeFile struct {
 	File
 	node *memNode
@@ -157,6 +182,40 @@ func (n *memNodeFile) InnerFile() File {
 	return n.File
 }
 
+// Write keeps the size current, so GetAttr is right for files that
+// are linked in while still open, as with O_TMPFILE.
+func (n *memNodeFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	written, code := n.File.Write(data, off)
+	n.node.mu.Lock()
+	if end := uint64(off) + uint64(written); end > n.node.info.Size {
+		n.node.info.Size = end
+	}
+	n.node.mu.Unlock()
+	return written, code
+}
+
+// Release removes the backing file of an O_TMPFILE node that was
+// never linked in.
+func (n *memNodeFile) Release() {
+	n.File.Release()
+	n.node.mu.Lock()
+	n.node.openFiles--
+	remove := n.node.tmpFile && n.node.openFiles == 0
+	n.node.mu.Unlock()
+	if remove {
+		os.Remove(n.node.filename())
+	}
+}
+
+// Lseek reports the holes of the backing file, which come from
+// Fallocate with FALLOC_FL_PUNCH_HOLE, or from writing past the end.
+func (n *memNodeFile) Lseek(off int64, whence int) (int64, fuse.Status) {
+	if lf, ok := n.File.(LseekFile); ok {
+		return lf.Lseek(off, whence)
+	}
+	return 0, fuse.ENOSYS
+}
+
 func (n *memNodeFile) Flush() fuse.Status {
 	code := n.File.Flush()
 
@@ -166,12 +225,17 @@ func (n *memNodeFile) Flush() fuse.Status {
 
 	st := syscall.Stat_t{}
 	err := syscall.Stat(n.node.filename(), &st)
+	n.node.mu.Lock()
 	n.node.info.Size = uint64(st.Size)
 	n.node.info.Blocks = uint64(st.Blocks)
+	n.node.mu.Unlock()
 	return fuse.ToStatus(err)
 }
 
 func (n *memNode) newFile(f *os.File) File {
+	n.mu.Lock()
+	n.openFiles++
+	n.mu.Unlock()
 	return &memNodeFile{
 		File: NewLoopbackFile(f),
 		node: n,
@@ -188,10 +252,28 @@ func (n *memNode) Open(flags uint32, context *fuse.Context) (file File, code fus
 }
 
 func (n *memNode) GetAttr(fi *fuse.Attr, file File, context *fuse.Context) (code fuse.Status) {
+	n.mu.Lock()
 	*fi = n.info
+	n.mu.Unlock()
 	return fuse.OK
 }
 
+func (n *memNode) Fallocate(file File, off uint64, size uint64, mode uint32, context *fuse.Context) (code fuse.Status) {
+	if file == nil {
+		return fuse.EBADF
+	}
+	if code = file.Allocate(off, size, mode); !code.Ok() {
+		return code
+	}
+	st := syscall.Stat_t{}
+	err := syscall.Stat(n.filename(), &st)
+	n.mu.Lock()
+	n.info.Size = uint64(st.Size)
+	n.info.Blocks = uint64(st.Blocks)
+	n.mu.Unlock()
+	return fuse.ToStatus(err)
+}
+
 func (n *memNode) Truncate(file File, size uint64, context *fuse.Context) (code fuse.Status) {
 	if file != nil {
 		code = file.Truncate(size)
@@ -201,30 +283,38 @@ func (n *memNode) Truncate(file File, size uint64, context *fuse.Context) (code
 	}
 	if code.Ok() {
 		now := time.Now()
+		n.mu.Lock()
 		n.info.SetTimes(nil, nil, &now)
 		// TODO - should update mtime too?
 		n.info.Size = size
+		n.mu.Unlock()
 	}
 	return code
 }
 
 func (n *memNode) Utimens(file File, atime *time.Time, mtime *time.Time, context *fuse.Context) (code fuse.Status) {
 	c := time.Now()
+	n.mu.Lock()
 	n.info.SetTimes(atime, mtime, &c)
+	n.mu.Unlock()
 	return fuse.OK
 }
 
 func (n *memNode) Chmod(file File, perms uint32, context *fuse.Context) (code fuse.Status) {
-	n.info.Mode = (n.info.Mode ^ 07777) | perms
 	now := time.Now()
+	n.mu.Lock()
+	n.info.Mode = (n.info.Mode ^ 07777) | perms
 	n.info.SetTimes(nil, nil, &now)
+	n.mu.Unlock()
 	return fuse.OK
 }
 
 func (n *memNode) Chown(file File, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
+	now := time.Now()
+	n.mu.Lock()
 	n.info.Uid = uid
 	n.info.Gid = gid
-	now := time.Now()
 	n.info.SetTimes(nil, nil, &now)
+	n.mu.Unlock()
 	return fuse.OK
 }
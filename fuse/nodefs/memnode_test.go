@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"syscall"
 	"testing"
 	"time"
 
@@ -88,6 +89,33 @@ func TestMemNodeFs(t *testing.T) {
 	}
 }
 
+func TestMemNodeSeekHole(t *testing.T) {
+	wd, _, clean := setupMemNodeTest(t)
+	defer clean()
+
+	const blk = 64 * 1024
+	f, err := os.OpenFile(wd+"/test", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(make([]byte, 3*blk)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	// FALLOC_FL_PUNCH_HOLE | FALLOC_FL_KEEP_SIZE
+	if err := syscall.Fallocate(int(f.Fd()), 3, blk, blk); err != nil {
+		t.Fatalf("Fallocate failed: %v", err)
+	}
+
+	const seekData, seekHole = 3, 4
+	if off, err := syscall.Seek(int(f.Fd()), 0, seekHole); err != nil || off != blk {
+		t.Errorf("SEEK_HOLE: got %d, %v, want %d", off, err, blk)
+	}
+	if off, err := syscall.Seek(int(f.Fd()), blk, seekData); err != nil || off != 2*blk {
+		t.Errorf("SEEK_DATA: got %d, %v, want %d", off, err, 2*blk)
+	}
+}
+
 func TestMemNodeSetattr(t *testing.T) {
 	wd, _, clean := setupMemNodeTest(t)
 	defer clean()
@@ -57,6 +57,11 @@ const (
 	_OP_FALLOCATE    = int32(43) // protocol version 19.
 	_OP_READDIRPLUS  = int32(44) // protocol version 21.
 
+	_OP_RENAME2         = int32(45) // protocol version 23.
+	_OP_LSEEK           = int32(46) // protocol version 24.
+	_OP_COPY_FILE_RANGE = int32(47) // protocol version 28.
+	_OP_TMPFILE         = int32(51) // protocol version 37.
+
 	// The following entries don't have to be compatible across Go-FUSE versions.
 	_OP_NOTIFY_ENTRY  = int32(100)
 	_OP_NOTIFY_INODE  = int32(101)
@@ -82,7 +87,17 @@ func doInit(state *Server, req *request) {
 
 	state.reqMu.Lock()
 	state.kernelSettings = *input
-	state.kernelSettings.Flags = input.Flags & (raw.CAP_ASYNC_READ | raw.CAP_BIG_WRITES | raw.CAP_FILE_OPS | raw.CAP_AUTO_INVAL_DATA)
+	wantFlags := uint32(raw.CAP_ASYNC_READ | raw.CAP_BIG_WRITES | raw.CAP_FILE_OPS | raw.CAP_AUTO_INVAL_DATA)
+	if state.opts.AsyncDirectIO {
+		wantFlags |= raw.CAP_ASYNC_DIO
+	}
+	if state.opts.ExportSupport {
+		wantFlags |= raw.CAP_EXPORT_SUPPORT
+	}
+	state.kernelSettings.Flags = input.Flags & wantFlags
+	if state.opts.MaxReadAhead > 0 && uint32(state.opts.MaxReadAhead) < input.MaxReadAhead {
+		state.kernelSettings.MaxReadAhead = uint32(state.opts.MaxReadAhead)
+	}
 	if input.Minor >= 13 {
 		state.setSplice()
 	}
@@ -91,7 +106,7 @@ func doInit(state *Server, req *request) {
 	out := &raw.InitOut{
 		Major:               _FUSE_KERNEL_VERSION,
 		Minor:               _OUR_MINOR_VERSION,
-		MaxReadAhead:        input.MaxReadAhead,
+		MaxReadAhead:        state.kernelSettings.MaxReadAhead,
 		Flags:               state.kernelSettings.Flags,
 		MaxWrite:            uint32(state.opts.MaxWrite),
 		CongestionThreshold: uint16(state.opts.MaxBackground * 3 / 4),
@@ -120,6 +135,11 @@ func doCreate(state *Server, req *request) {
 	req.status = status
 }
 
+func doTmpFile(state *Server, req *request) {
+	out := (*raw.CreateOut)(req.outData)
+	req.status = state.fileSystem.TmpFile(out, &req.context, (*raw.CreateIn)(req.inData))
+}
+
 func doReadDir(state *Server, req *request) {
 	in := (*raw.ReadIn)(req.inData)
 	buf := state.allocOut(req, in.Size)
@@ -326,6 +346,20 @@ func doRename(state *Server, req *request) {
 	req.status = state.fileSystem.Rename(&req.context, (*raw.RenameIn)(req.inData), req.filenames[0], req.filenames[1])
 }
 
+func doLseek(state *Server, req *request) {
+	out := (*raw.LseekOut)(req.outData)
+	req.status = state.fileSystem.Lseek(&req.context, (*raw.LseekIn)(req.inData), out)
+}
+
+func doCopyFileRange(state *Server, req *request) {
+	out := (*raw.WriteOut)(req.outData)
+	out.Size, req.status = state.fileSystem.CopyFileRange(&req.context, (*raw.CopyFileRangeIn)(req.inData))
+}
+
+func doRename2(state *Server, req *request) {
+	req.status = state.fileSystem.Rename2(&req.context, (*raw.Rename2In)(req.inData), req.filenames[0], req.filenames[1])
+}
+
 func doStatFs(state *Server, req *request) {
 	stat := (*raw.StatfsOut)(req.outData)
 	req.status = state.fileSystem.StatFs(stat, &req.context)
@@ -417,6 +451,11 @@ func init() {
 		_OP_IOCTL:        unsafe.Sizeof(raw.IoctlIn{}),
 		_OP_POLL:         unsafe.Sizeof(raw.PollIn{}),
 		_OP_FALLOCATE:    unsafe.Sizeof(raw.FallocateIn{}),
+
+		_OP_RENAME2:         unsafe.Sizeof(raw.Rename2In{}),
+		_OP_TMPFILE:         unsafe.Sizeof(raw.CreateIn{}),
+		_OP_LSEEK:           unsafe.Sizeof(raw.LseekIn{}),
+		_OP_COPY_FILE_RANGE: unsafe.Sizeof(raw.CopyFileRangeIn{}),
 	} {
 		operationHandlers[op].InputSize = sz
 	}
@@ -443,6 +482,10 @@ func init() {
 		_OP_NOTIFY_ENTRY:  unsafe.Sizeof(raw.NotifyInvalEntryOut{}),
 		_OP_NOTIFY_INODE:  unsafe.Sizeof(raw.NotifyInvalInodeOut{}),
 		_OP_NOTIFY_DELETE: unsafe.Sizeof(raw.NotifyInvalDeleteOut{}),
+
+		_OP_COPY_FILE_RANGE: unsafe.Sizeof(raw.WriteOut{}),
+		_OP_LSEEK:           unsafe.Sizeof(raw.LseekOut{}),
+		_OP_TMPFILE:         unsafe.Sizeof(raw.CreateOut{}),
 	} {
 		operationHandlers[op].OutputSize = sz
 	}
@@ -492,6 +535,11 @@ func init() {
 		_OP_NOTIFY_DELETE: "NOTIFY_DELETE",
 		_OP_FALLOCATE:     "FALLOCATE",
 		_OP_READDIRPLUS:   "READDIRPLUS",
+
+		_OP_RENAME2:         "RENAME2",
+		_OP_TMPFILE:         "TMPFILE",
+		_OP_LSEEK:           "LSEEK",
+		_OP_COPY_FILE_RANGE: "COPY_FILE_RANGE",
 	} {
 		operationHandlers[op].Name = v
 	}
@@ -531,6 +579,11 @@ func init() {
 		_OP_IOCTL:        doIoctl,
 		_OP_DESTROY:      doDestroy,
 		_OP_FALLOCATE:    doFallocate,
+
+		_OP_RENAME2:         doRename2,
+		_OP_TMPFILE:         doTmpFile,
+		_OP_LSEEK:           doLseek,
+		_OP_COPY_FILE_RANGE: doCopyFileRange,
 	} {
 		operationHandlers[op].Func = v
 	}
@@ -550,6 +603,8 @@ func init() {
 		_OP_NOTIFY_INODE:  func(ptr unsafe.Pointer) interface{} { return (*raw.NotifyInvalInodeOut)(ptr) },
 		_OP_NOTIFY_DELETE: func(ptr unsafe.Pointer) interface{} { return (*raw.NotifyInvalDeleteOut)(ptr) },
 		_OP_STATFS:        func(ptr unsafe.Pointer) interface{} { return (*raw.StatfsOut)(ptr) },
+		_OP_TMPFILE:       func(ptr unsafe.Pointer) interface{} { return (*raw.CreateOut)(ptr) },
+		_OP_LSEEK:         func(ptr unsafe.Pointer) interface{} { return (*raw.LseekOut)(ptr) },
 	} {
 		operationHandlers[op].DecodeOut = f
 	}
@@ -576,6 +631,11 @@ func init() {
 		_OP_RELEASE:      func(ptr unsafe.Pointer) interface{} { return (*raw.ReleaseIn)(ptr) },
 		_OP_RELEASEDIR:   func(ptr unsafe.Pointer) interface{} { return (*raw.ReleaseIn)(ptr) },
 		_OP_FALLOCATE:    func(ptr unsafe.Pointer) interface{} { return (*raw.FallocateIn)(ptr) },
+
+		_OP_TMPFILE:         func(ptr unsafe.Pointer) interface{} { return (*raw.CreateIn)(ptr) },
+		_OP_LSEEK:           func(ptr unsafe.Pointer) interface{} { return (*raw.LseekIn)(ptr) },
+		_OP_COPY_FILE_RANGE: func(ptr unsafe.Pointer) interface{} { return (*raw.CopyFileRangeIn)(ptr) },
+		_OP_RENAME2:         func(ptr unsafe.Pointer) interface{} { return (*raw.Rename2In)(ptr) },
 	} {
 		operationHandlers[op].DecodeIn = f
 	}
@@ -593,6 +653,7 @@ func init() {
 		_OP_RMDIR:       1,
 		_OP_SYMLINK:     2,
 		_OP_UNLINK:      1,
+		_OP_RENAME2:     2,
 	} {
 		operationHandlers[op].FileNames = count
 	}
@@ -68,8 +68,73 @@ type FileSystem interface {
 	StatFs(name string) *nodefs.StatfsOut
 }
 
+// AttrTimeoutFileSystem may be implemented by a FileSystem that
+// decides on kernel cache timeouts per path.  If implemented,
+// GetAttrTimeout is called instead of GetAttr; returning nil
+// Timeouts uses the CachePolicy or the mount defaults.  A failing
+// lookup may return Timeouts to set the negative entry timeout.
+type AttrTimeoutFileSystem interface {
+	FileSystem
+
+	GetAttrTimeout(name string, context *fuse.Context) (*fuse.Attr, *nodefs.Timeouts, fuse.Status)
+}
+
+// DirStreamFileSystem may be implemented by a FileSystem with
+// directories too large to list with OpenDir.  If implemented,
+// OpenDirStream is called instead of OpenDir.
+type DirStreamFileSystem interface {
+	FileSystem
+
+	OpenDirStream(name string, context *fuse.Context) (nodefs.DirStream, fuse.Status)
+}
+
+// Rename2FileSystem may be implemented by a FileSystem that supports
+// the RENAME_* flags of renameat2(2).  Renames with flags fail with
+// EINVAL on file systems that do not implement it.
+type Rename2FileSystem interface {
+	FileSystem
+
+	Rename2(oldName string, newName string, flags uint32, context *fuse.Context) (code fuse.Status)
+}
+
+// TmpFileFileSystem may be implemented by a FileSystem that supports
+// open(2) with O_TMPFILE.  TmpFile creates an unnamed file in
+// directory dir, and LinkTmpFile gives a file returned from TmpFile
+// its first name.
+type TmpFileFileSystem interface {
+	FileSystem
+
+	TmpFile(dir string, flags uint32, mode uint32, context *fuse.Context) (file nodefs.File, code fuse.Status)
+	LinkTmpFile(file nodefs.File, newName string, context *fuse.Context) (code fuse.Status)
+}
+
 type PathNodeFsOptions struct {
 	// If ClientInodes is set, use Inode returned from GetAttr to
 	// find hard-linked files.
 	ClientInodes bool
+
+	// If CachePolicy is set, it is called with the path of a
+	// file or directory to decide how the kernel may cache it.
+	// It may return nil to use the mount defaults.
+	CachePolicy func(name string) *CachePolicy
+
+	// If set, node IDs handed out for nodefs.Options.ExportNodeIds
+	// are recorded in this file, so NFS file handles stay valid
+	// when the file system is mounted again.
+	NodeIdJournal string
+}
+
+// CachePolicy describes how the kernel should cache a single path.
+type CachePolicy struct {
+	// Open the file with FOPEN_DIRECT_IO, bypassing the page
+	// cache and readahead.
+	DirectIO bool
+
+	// Open the file with FOPEN_KEEP_CACHE, so cached data is not
+	// dropped on open.
+	KeepCache bool
+
+	// If set, these override the entry and attribute timeouts
+	// of the mount.
+	Timeouts *nodefs.Timeouts
 }
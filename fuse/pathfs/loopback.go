@@ -81,6 +81,7 @@ func (fs *loopbackFileSystem) OpenDir(name string, context *fuse.Context) (strea
 			}
 			if s := fuse.ToStatT(infos[i]); s != nil {
 				d.Mode = uint32(s.Mode)
+				d.Ino = uint64(s.Ino)
 			} else {
 				log.Printf("ReadDir entry %q for %q has no stat info", n, name)
 			}
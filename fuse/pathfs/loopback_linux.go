@@ -2,6 +2,7 @@ package pathfs
 
 import (
 	"fmt"
+	"os"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/fuse"
@@ -37,6 +38,11 @@ func (fs *loopbackFileSystem) RemoveXAttr(name string, attr string, context *fus
 	return fuse.ToStatus(err)
 }
 
+func (fs *loopbackFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	err := syscall.Setxattr(fs.GetPath(name), attr, data, flags)
+	return fuse.ToStatus(err)
+}
+
 func (fs *loopbackFileSystem) String() string {
 	return fmt.Sprintf("LoopbackFs(%s)", fs.Root)
 }
@@ -47,3 +53,35 @@ func (fs *loopbackFileSystem) GetXAttr(name string, attr string, context *fuse.C
 
 	return data, fuse.ToStatus(err)
 }
+
+func (fs *loopbackFileSystem) Rename2(oldPath string, newPath string, flags uint32, context *fuse.Context) (code fuse.Status) {
+	return fuse.ToStatus(Renameat2(fs.GetPath(oldPath), fs.GetPath(newPath), flags))
+}
+
+// loopbackTmpFile keeps the *os.File of an O_TMPFILE file, for
+// LinkTmpFile.
+type loopbackTmpFile struct {
+	nodefs.File
+	osFile *os.File
+}
+
+func (f *loopbackTmpFile) InnerFile() nodefs.File {
+	return f.File
+}
+
+func (fs *loopbackFileSystem) TmpFile(dir string, flags uint32, mode uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
+	flags = flags&^syscall.O_CREAT | _O_TMPFILE
+	f, err := os.OpenFile(fs.GetPath(dir), int(flags), os.FileMode(mode))
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	return &loopbackTmpFile{nodefs.NewLoopbackFile(f), f}, fuse.OK
+}
+
+func (fs *loopbackFileSystem) LinkTmpFile(file nodefs.File, newName string, context *fuse.Context) (code fuse.Status) {
+	f, ok := file.(*loopbackTmpFile)
+	if !ok {
+		return fuse.EINVAL
+	}
+	return fuse.ToStatus(linkFd(f.osFile.Fd(), fs.GetPath(newName)))
+}
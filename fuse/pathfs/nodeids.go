@@ -0,0 +1,352 @@
+package pathfs
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// nodeIdTable assigns persistent node IDs to paths, for exporting a
+// PathNodeFs over NFS.  A new ID is derived from a hash of the path,
+// and stays with the file when it is renamed.  If a journal file is
+// given, all assignments are appended to it, so they can be restored
+// when the file system is mounted again.  The journal is rewritten
+// with just the current assignments when it is loaded, and when it
+// has grown to several times their number, unless it could not be
+// read completely.
+type nodeIdTable struct {
+	mu    sync.Mutex
+	ids   map[string]uint64
+	paths map[uint64]string
+
+	// Generations are kept after a path is deleted, so a reused
+	// ID gets a new generation.
+	generations map[uint64]uint64
+
+	journal     *os.File
+	journalName string
+
+	// The number of lines in the journal.
+	records int
+
+	// Set if the journal has lines that could not be read.  It
+	// is then only appended to, so they are kept.
+	damaged bool
+}
+
+// Journals with fewer lines than this are not compacted while
+// mounted.
+const minCompactRecords = 1024
+
+func newNodeIdTable(journal string) *nodeIdTable {
+	t := &nodeIdTable{
+		ids:         map[string]uint64{},
+		paths:       map[uint64]string{},
+		generations: map[uint64]uint64{},
+	}
+	if journal == "" {
+		return t
+	}
+
+	f, err := os.OpenFile(journal, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("cannot open node ID journal: %v", err)
+		return t
+	}
+	t.journal = f
+	t.journalName = journal
+	if err := t.load(f); err != nil {
+		log.Printf("cannot read node ID journal %q: %v", journal, err)
+		t.damaged = true
+		return t
+	}
+	t.compact()
+	return t
+}
+
+// compact rewrites the journal with the current assignments.  Must
+// hold mu, unless called from newNodeIdTable.
+func (t *nodeIdTable) compact() {
+	tmp := t.journalName + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		log.Printf("cannot compact node ID journal: %v", err)
+		return
+	}
+	w := bufio.NewWriter(f)
+	for id, gen := range t.generations {
+		fmt.Fprintf(w, "%d %d %s\n", id, gen, strconv.Quote(t.paths[id]))
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp, t.journalName)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		log.Printf("cannot compact node ID journal: %v", err)
+		return
+	}
+
+	f, err = os.OpenFile(t.journalName, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("cannot reopen node ID journal: %v", err)
+		f = nil
+	}
+	t.journal.Close()
+	t.journal = f
+	t.records = len(t.generations)
+}
+
+// close closes the journal.
+func (t *nodeIdTable) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.journal != nil {
+		t.journal.Close()
+		t.journal = nil
+	}
+}
+
+// load replays a journal.  Each line holds an ID, its generation and
+// the quoted path; an empty path records a deletion.  Lines that
+// cannot be parsed are skipped, and the first error is returned.
+func (t *nodeIdTable) load(f *os.File) error {
+	var firstErr error
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		t.records++
+		if err := t.parse(scanner.Text()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if firstErr != nil {
+		// A line cut short by a crash must not swallow the
+		// next record.
+		if _, err := f.WriteString("\n"); err != nil {
+			return err
+		}
+	}
+	return firstErr
+}
+
+// parse replays one line of the journal.
+func (t *nodeIdTable) parse(line string) error {
+	if line == "" {
+		return nil
+	}
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) != 3 {
+		return fmt.Errorf("malformed line %q", line)
+	}
+	id, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return err
+	}
+	gen, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return err
+	}
+	path, err := strconv.Unquote(fields[2])
+	if err != nil {
+		return err
+	}
+	t.set(id, gen, path)
+	return nil
+}
+
+// set records the path for an ID.  Must hold mu.
+func (t *nodeIdTable) set(id uint64, gen uint64, path string) {
+	if old, ok := t.paths[id]; ok {
+		delete(t.ids, old)
+		delete(t.paths, id)
+	}
+	if path != "" {
+		if other, ok := t.ids[path]; ok {
+			delete(t.paths, other)
+		}
+		t.ids[path] = id
+		t.paths[id] = path
+	}
+	t.generations[id] = gen
+}
+
+// record sets the path for an ID and appends it to the journal.
+// Must hold mu.
+func (t *nodeIdTable) record(id uint64, gen uint64, path string) {
+	t.set(id, gen, path)
+	if t.journal == nil {
+		return
+	}
+	if _, err := fmt.Fprintf(t.journal, "%d %d %s\n", id, gen, strconv.Quote(path)); err != nil {
+		log.Printf("cannot write node ID journal: %v", err)
+	}
+	t.records++
+	if !t.damaged && t.records >= minCompactRecords && t.records > 4*len(t.generations) {
+		t.compact()
+	}
+}
+
+// nodeId returns the ID and generation for a path, assigning a new
+// one if necessary.  IDs for which inUse returns true are not handed
+// out.
+func (t *nodeIdTable) nodeId(path string, inUse func(uint64) bool) (id uint64, gen uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if id, ok := t.ids[path]; ok && !inUse(id) {
+		return id, t.generations[id]
+	}
+
+	id = t.freeId(path, inUse)
+	gen = t.generations[id] + 1
+	t.record(id, gen, path)
+	return id, gen
+}
+
+// unnamedId returns an ID for a node without a path.  It cannot be
+// resolved after a restart, so it is not recorded.
+func (t *nodeIdTable) unnamedId(inUse func(uint64) bool) (id uint64, gen uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	id = t.freeId("", inUse)
+	gen = t.generations[id] + 1
+	t.generations[id] = gen
+	return id, gen
+}
+
+// freeId returns the first ID from the hash of seed on that has no
+// path and is not in use.  The hash leaves the top bit clear for
+// nodefs.  Must hold mu.
+func (t *nodeIdTable) freeId(seed string, inUse func(uint64) bool) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(seed))
+	id := h.Sum64() >> 1
+	for {
+		if _, used := t.paths[id]; !used && !inUse(id) {
+			return id
+		}
+		id++
+	}
+}
+
+// path returns the path for an ID.
+func (t *nodeIdTable) path(id uint64) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.paths[id]
+	return p, ok
+}
+
+// rename moves the IDs of oldPath and everything below it to
+// newPath.  The ID of a file replaced by the rename is dropped.
+func (t *nodeIdTable) rename(oldPath string, newPath string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if oldPath == newPath {
+		return
+	}
+	t.removeLocked(newPath)
+	moved := map[uint64]string{}
+	for p, id := range t.ids {
+		if p == oldPath {
+			moved[id] = newPath
+		} else if strings.HasPrefix(p, oldPath+"/") {
+			moved[id] = newPath + p[len(oldPath):]
+		}
+	}
+	for id, p := range moved {
+		t.record(id, t.generations[id], p)
+	}
+}
+
+// exchange swaps the IDs of two paths and everything below them.
+func (t *nodeIdTable) exchange(a string, b string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if a == b {
+		return
+	}
+	moved := map[uint64]string{}
+	for p, id := range t.ids {
+		switch {
+		case p == a:
+			moved[id] = b
+		case p == b:
+			moved[id] = a
+		case strings.HasPrefix(p, a+"/"):
+			moved[id] = b + p[len(a):]
+		case strings.HasPrefix(p, b+"/"):
+			moved[id] = a + p[len(b):]
+		}
+	}
+	for id, p := range moved {
+		t.record(id, t.generations[id], p)
+	}
+}
+
+// remove drops the ID for a deleted path.
+func (t *nodeIdTable) remove(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.removeLocked(path)
+}
+
+func (t *nodeIdTable) removeLocked(path string) {
+	if id, ok := t.ids[path]; ok {
+		t.record(id, t.generations[id], "")
+	}
+}
+
+// NodeId implements nodefs.ExportFileSystem.  Node IDs are derived
+// from the path of the node, and recorded in the NodeIdJournal, if
+// one was given in the options.
+func (fs *PathNodeFs) NodeId(node nodefs.Node, inUse func(uint64) bool) (id uint64, generation uint64) {
+	n := node.(*pathInode)
+	if !n.attached() {
+		return fs.nodeIds.unnamedId(inUse)
+	}
+	return fs.nodeIds.nodeId(n.GetPath(), inUse)
+}
+
+// attached returns whether n can be reached from the root, rather
+// than being unnamed or deleted.
+func (n *pathInode) attached() bool {
+	n.pathFs.pathLock.RLock()
+	defer n.pathFs.pathLock.RUnlock()
+	p := n
+	for p.Parent != nil {
+		p = p.Parent
+	}
+	return p == n.pathFs.root
+}
+
+// ResolveNodeId implements nodefs.ExportFileSystem.
+func (fs *PathNodeFs) ResolveNodeId(id uint64, context *fuse.Context) nodefs.Node {
+	path, ok := fs.nodeIds.path(id)
+	if !ok {
+		return nil
+	}
+	n := fs.LookupNode(path)
+	if n == nil {
+		return nil
+	}
+	return n.Node()
+}
@@ -0,0 +1,106 @@
+package pathfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func notInUse(id uint64) bool {
+	return id <= 1
+}
+
+func TestNodeIdJournalCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-nodeids_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	journal := dir + "/journal"
+
+	tab := newNodeIdTable(journal)
+	id, _ := tab.nodeId("file", notInUse)
+	for i := 0; i < 2*minCompactRecords; i++ {
+		tab.rename("file", "other")
+		tab.rename("other", "file")
+	}
+	tab.close()
+
+	content, err := ioutil.ReadFile(journal)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if n := bytes.Count(content, []byte("\n")); n > minCompactRecords {
+		t.Errorf("journal has %d lines, want at most %d", n, minCompactRecords)
+	}
+
+	tab = newNodeIdTable(journal)
+	defer tab.close()
+	if got, _ := tab.nodeId("file", notInUse); got != id {
+		t.Errorf("got ID %d after reload, want %d", got, id)
+	}
+	content, err = ioutil.ReadFile(journal)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if n := bytes.Count(content, []byte("\n")); n != 1 {
+		t.Errorf("journal has %d lines after reload, want 1", n)
+	}
+}
+
+func TestNodeIdJournalDamaged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-nodeids_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	journal := dir + "/journal"
+	damaged := "10 1 \"a\"\nbogus\n11 1 \"b\"\n12 1 \"c"
+	ioutil.WriteFile(journal, []byte(damaged), 0644)
+
+	tab := newNodeIdTable(journal)
+	if id, _ := tab.nodeId("b", notInUse); id != 11 {
+		t.Errorf("got ID %d for a record after the damage, want 11", id)
+	}
+	tab.nodeId("d", notInUse)
+	tab.close()
+
+	content, err := ioutil.ReadFile(journal)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if !bytes.HasPrefix(content, []byte(damaged+"\n")) {
+		t.Errorf("damaged journal was rewritten: %q", content)
+	}
+	tab = newNodeIdTable(journal)
+	defer tab.close()
+	if _, ok := tab.ids["d"]; !ok {
+		t.Errorf("record appended after a cut line was lost: %q", content)
+	}
+}
+
+func TestNodeIdInUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-nodeids_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	journal := dir + "/journal"
+
+	tab := newNodeIdTable(journal)
+	first, _ := tab.nodeId("file", notInUse)
+	tab.remove("file")
+	taken := func(id uint64) bool { return id == first || notInUse(id) }
+	second, _ := tab.nodeId("file", taken)
+	if second == first {
+		t.Fatalf("got ID %d, which is in use", second)
+	}
+	tab.close()
+
+	tab = newNodeIdTable(journal)
+	defer tab.close()
+	if got, _ := tab.nodeId("file", notInUse); got != second {
+		t.Errorf("got ID %d after reload, want %d", got, second)
+	}
+}
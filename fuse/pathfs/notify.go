@@ -0,0 +1,121 @@
+package pathfs
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// DeleteNotify tells the kernel that name was removed from dir.
+// Unlike EntryNotify, this also takes the entry out of the working
+// directories of processes that are inside it.
+func (fs *PathNodeFs) DeleteNotify(dir string, name string) fuse.Status {
+	parent, rest := fs.connector.Node(fs.root.Inode(), dir)
+	if parent == nil || len(rest) > 0 {
+		return fuse.ENOENT
+	}
+	child := parent.GetChild(name)
+	if child == nil {
+		return fs.connector.EntryNotify(parent, name)
+	}
+	return fs.connector.DeleteNotify(parent, child, name)
+}
+
+func splitPath(path string) (dir, base string) {
+	dir, base = filepath.Split(strings.Trim(filepath.Clean(path), "/"))
+	return strings.TrimRight(dir, "/"), base
+}
+
+// NotifyKind says what an Invalidation invalidates, and which
+// PathNodeFs method NotifyAll calls for it.
+type NotifyKind int
+
+const (
+	// Invalidate attributes: FileNotify with a negative offset.
+	NotifyAttr = NotifyKind(iota)
+
+	// Invalidate attributes and a range of data: FileNotify.
+	NotifyData
+
+	// Invalidate the directory entry: EntryNotify.
+	NotifyEntry
+
+	// Signal the directory entry was deleted: DeleteNotify.
+	NotifyDelete
+)
+
+// Invalidation is a single request for NotifyAll.
+type Invalidation struct {
+	Kind NotifyKind
+	Path string
+
+	// Data range for NotifyData; see FileNotify.
+	Off    int64
+	Length int64
+}
+
+// NotifyAll sends the invalidations to the kernel one after the
+// other; the protocol has no batched notification.  It is meant for
+// applying a change feed of a backing store.  Duplicate requests are
+// sent once, and entry requests for paths below an entry that is
+// invalidated or deleted in the same call are dropped, since the
+// kernel discards the entire subtree.  It returns the first error
+// encountered; ENOENT, meaning the kernel had nothing cached, is not
+// an error.
+func (fs *PathNodeFs) NotifyAll(invalidations []Invalidation) fuse.Status {
+	// Entries that go away in this batch.
+	gone := map[string]bool{}
+	var todo []Invalidation
+	seen := map[Invalidation]bool{}
+	for _, inv := range invalidations {
+		inv.Path = strings.Trim(filepath.Clean(inv.Path), "/")
+		if inv.Path == "." {
+			inv.Path = ""
+		}
+		if seen[inv] {
+			continue
+		}
+		seen[inv] = true
+		if inv.Kind == NotifyEntry || inv.Kind == NotifyDelete {
+			gone[inv.Path] = true
+		}
+		todo = append(todo, inv)
+	}
+
+	covered := func(path string) bool {
+		for p := path; p != ""; {
+			p, _ = splitPath(p)
+			if gone[p] && p != "" {
+				return true
+			}
+		}
+		return false
+	}
+
+	code := fuse.OK
+	for _, inv := range todo {
+		if (inv.Kind == NotifyEntry || inv.Kind == NotifyDelete) && covered(inv.Path) {
+			continue
+		}
+
+		var c fuse.Status
+		dir, base := splitPath(inv.Path)
+		switch inv.Kind {
+		case NotifyAttr:
+			c = fs.FileNotify(inv.Path, -1, 0)
+		case NotifyData:
+			c = fs.FileNotify(inv.Path, inv.Off, inv.Length)
+		case NotifyEntry:
+			c = fs.EntryNotify(dir, base)
+		case NotifyDelete:
+			c = fs.DeleteNotify(dir, base)
+		default:
+			c = fuse.EINVAL
+		}
+		if !c.Ok() && c != fuse.ENOENT && code.Ok() {
+			code = c
+		}
+	}
+	return code
+}
@@ -6,10 +6,12 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/raw"
 )
 
 var _ = log.Println
@@ -43,6 +45,9 @@ type PathNodeFs struct {
 	clientInodeMap map[uint64][]*clientInodePath
 
 	options *PathNodeFsOptions
+
+	// Persistent node IDs, for nodefs.Options.ExportNodeIds.
+	nodeIds *nodeIdTable
 }
 
 func (fs *PathNodeFs) SetDebug(dbg bool) {
@@ -93,7 +98,24 @@ func (fs *PathNodeFs) Unmount(path string) fuse.Status {
 	return fs.connector.Unmount(node)
 }
 
+// UnmountDetach lazily unmounts the file system mounted on path.  See
+// nodefs.FileSystemConnector.UnmountDetach.
+func (fs *PathNodeFs) UnmountDetach(path string) fuse.Status {
+	node := fs.Node(path)
+	if node == nil {
+		return fuse.ENOENT
+	}
+	return fs.connector.UnmountDetach(node)
+}
+
+// Mounts lists the submounts of the connector.  Paths are relative
+// to the FUSE mount point.
+func (fs *PathNodeFs) Mounts() []nodefs.MountInfo {
+	return fs.connector.Mounts()
+}
+
 func (fs *PathNodeFs) OnUnmount() {
+	fs.nodeIds.close()
 }
 
 func (fs *PathNodeFs) String() string {
@@ -132,6 +154,10 @@ func (fs *PathNodeFs) LastNode(name string) (*nodefs.Inode, []string) {
 	return fs.connector.Node(fs.Root().Inode(), name)
 }
 
+// FileNotify invalidates the cached attributes of path, and the
+// cached data in [off, off+length).  A length of 0 means up to the end
+// of the file, and a negative off leaves the data alone.  It returns
+// ENOENT if the kernel does not know path.
 func (fs *PathNodeFs) FileNotify(path string, off int64, length int64) fuse.Status {
 	node, r := fs.connector.Node(fs.root.Inode(), path)
 	if len(r) > 0 {
@@ -140,6 +166,8 @@ func (fs *PathNodeFs) FileNotify(path string, off int64, length int64) fuse.Stat
 	return fs.connector.FileNotify(node, off, length)
 }
 
+// EntryNotify invalidates the directory entry name in dir, and the
+// entries below it.
 func (fs *PathNodeFs) EntryNotify(dir string, name string) fuse.Status {
 	node, rest := fs.connector.Node(fs.root.Inode(), dir)
 	if len(rest) > 0 {
@@ -178,6 +206,7 @@ func NewPathNodeFs(fs FileSystem, opts *PathNodeFsOptions) *PathNodeFs {
 		root:           root,
 		clientInodeMap: map[uint64][]*clientInodePath{},
 		options:        opts,
+		nodeIds:        newNodeIdTable(opts.NodeIdJournal),
 	}
 	root.pathFs = pfs
 	return pfs
@@ -202,6 +231,10 @@ type pathInode struct {
 	// real filesystem.
 	clientInode uint64
 	inode       *nodefs.Inode
+
+	// For a file from TmpFile that has no name yet, the file as
+	// returned by the FileSystem.
+	tmpFile nodefs.File
 }
 
 // Drop all known client inodes. Must have the treeLock.
@@ -414,6 +447,17 @@ func (n *pathInode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status
 	return n.fs.OpenDir(n.GetPath(), context)
 }
 
+func (n *pathInode) OpenDirStream(context *fuse.Context) (nodefs.DirStream, fuse.Status) {
+	if sfs, ok := n.fs.(DirStreamFileSystem); ok {
+		return sfs.OpenDirStream(n.GetPath(), context)
+	}
+	entries, code := n.fs.OpenDir(n.GetPath(), context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return nodefs.NewDirStream(entries), fuse.OK
+}
+
 func (n *pathInode) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) (newNode nodefs.Node, code fuse.Status) {
 	fullPath := filepath.Join(n.GetPath(), name)
 	code = n.fs.Mknod(fullPath, mode, dev, context)
@@ -437,17 +481,21 @@ func (n *pathInode) Mkdir(name string, mode uint32, context *fuse.Context) (newN
 }
 
 func (n *pathInode) Unlink(name string, context *fuse.Context) (code fuse.Status) {
-	code = n.fs.Unlink(filepath.Join(n.GetPath(), name), context)
+	fullPath := filepath.Join(n.GetPath(), name)
+	code = n.fs.Unlink(fullPath, context)
 	if code.Ok() {
 		n.rmChild(name)
+		n.pathFs.nodeIds.remove(fullPath)
 	}
 	return code
 }
 
 func (n *pathInode) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
-	code = n.fs.Rmdir(filepath.Join(n.GetPath(), name), context)
+	fullPath := filepath.Join(n.GetPath(), name)
+	code = n.fs.Rmdir(fullPath, context)
 	if code.Ok() {
 		n.rmChild(name)
+		n.pathFs.nodeIds.remove(fullPath)
 	}
 	return code
 }
@@ -472,17 +520,50 @@ func (n *pathInode) Rename(oldName string, newParent nodefs.Node, newName string
 		ch := n.rmChild(oldName)
 		p.rmChild(newName)
 		p.addChild(newName, ch)
+		n.pathFs.nodeIds.rename(oldPath, newPath)
 	}
 	return code
 }
 
+func (n *pathInode) Rename2(oldName string, newParent nodefs.Node, newName string, flags uint32, context *fuse.Context) (code fuse.Status) {
+	rfs, ok := n.fs.(Rename2FileSystem)
+	if !ok {
+		return fuse.EINVAL
+	}
+	p := newParent.(*pathInode)
+	oldPath := filepath.Join(n.GetPath(), oldName)
+	newPath := filepath.Join(p.GetPath(), newName)
+	code = rfs.Rename2(oldPath, newPath, flags, context)
+	if !code.Ok() {
+		return code
+	}
+
+	ch := n.rmChild(oldName)
+	other := p.rmChild(newName)
+	if ch != nil {
+		p.addChild(newName, ch)
+	}
+	if flags&raw.RENAME_EXCHANGE != 0 {
+		if other != nil {
+			n.addChild(oldName, other)
+		}
+		n.pathFs.nodeIds.exchange(oldPath, newPath)
+	} else {
+		n.pathFs.nodeIds.rename(oldPath, newPath)
+	}
+	return fuse.OK
+}
+
 func (n *pathInode) Link(name string, existingFsnode nodefs.Node, context *fuse.Context) (newNode nodefs.Node, code fuse.Status) {
+	existing := existingFsnode.(*pathInode)
+	if existing.tmpFile != nil {
+		return n.linkTmpFile(name, existing, context)
+	}
 	if !n.pathFs.options.ClientInodes {
 		return nil, fuse.ENOSYS
 	}
 
 	newPath := filepath.Join(n.GetPath(), name)
-	existing := existingFsnode.(*pathInode)
 	oldPath := existing.GetPath()
 	code = n.fs.Link(oldPath, newPath, context)
 
@@ -512,10 +593,41 @@ func (n *pathInode) Create(name string, flags uint32, mode uint32, context *fuse
 		pNode := n.createChild(false)
 		newNode = pNode
 		n.addChild(name, pNode)
+		file = n.pathFs.wrapFile(file, fullPath)
 	}
 	return
 }
 
+func (n *pathInode) TmpFile(flags uint32, mode uint32, context *fuse.Context) (file nodefs.File, newNode nodefs.Node, code fuse.Status) {
+	tfs, ok := n.fs.(TmpFileFileSystem)
+	if !ok {
+		return nil, nil, fuse.Status(syscall.EOPNOTSUPP)
+	}
+	dir := n.GetPath()
+	file, code = tfs.TmpFile(dir, flags, mode, context)
+	if !code.Ok() {
+		return nil, nil, code
+	}
+	pNode := n.createChild(false)
+	pNode.tmpFile = file
+	return n.pathFs.wrapFile(file, pNode.GetPath()), pNode, fuse.OK
+}
+
+// linkTmpFile gives the unnamed file in existing its first name.
+func (n *pathInode) linkTmpFile(name string, existing *pathInode, context *fuse.Context) (newNode nodefs.Node, code fuse.Status) {
+	tfs, ok := n.fs.(TmpFileFileSystem)
+	if !ok {
+		return nil, fuse.ENOSYS
+	}
+	code = tfs.LinkTmpFile(existing.tmpFile, filepath.Join(n.GetPath(), name), context)
+	if !code.Ok() {
+		return nil, code
+	}
+	existing.tmpFile = nil
+	n.addChild(name, existing)
+	return existing, fuse.OK
+}
+
 func (n *pathInode) createChild(isDir bool) *pathInode {
 	i := new(pathInode)
 	i.fs = n.fs
@@ -526,25 +638,83 @@ func (n *pathInode) createChild(isDir bool) *pathInode {
 }
 
 func (n *pathInode) Open(flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
-	file, code = n.fs.Open(n.GetPath(), flags, context)
-	if n.pathFs.debug {
-		file = &nodefs.WithFlags{
-			File:        file,
-			Description: n.GetPath(),
-		}
+	path := n.GetPath()
+	file, code = n.fs.Open(path, flags, context)
+	if code.Ok() {
+		file = n.pathFs.wrapFile(file, path)
 	}
 	return
 }
 
+// wrapFile applies the debug description and the cache policy for
+// the given path to a freshly opened file.
+func (fs *PathNodeFs) wrapFile(file nodefs.File, path string) nodefs.File {
+	var fuseFlags uint32
+	if p := fs.cachePolicy(path); p != nil {
+		if p.DirectIO {
+			fuseFlags |= raw.FOPEN_DIRECT_IO
+		}
+		if p.KeepCache {
+			fuseFlags |= raw.FOPEN_KEEP_CACHE
+		}
+	}
+	if fuseFlags == 0 && !fs.debug {
+		return file
+	}
+
+	w := &nodefs.WithFlags{
+		File:      file,
+		FuseFlags: fuseFlags,
+	}
+	if fs.debug {
+		w.Description = path
+	}
+	return w
+}
+
+func (fs *PathNodeFs) cachePolicy(path string) *CachePolicy {
+	if fs.options.CachePolicy == nil {
+		return nil
+	}
+	return fs.options.CachePolicy(path)
+}
+
+// Timeouts implements nodefs.TimeoutNode using the CachePolicy
+// from the options.
+func (n *pathInode) Timeouts() *nodefs.Timeouts {
+	if n.pathFs.options.CachePolicy == nil {
+		return nil
+	}
+	if p := n.pathFs.cachePolicy(n.GetPath()); p != nil {
+		return p.Timeouts
+	}
+	return nil
+}
+
+// getAttr calls GetAttrTimeout if the file system implements
+// AttrTimeoutFileSystem, and GetAttr otherwise.
+func (n *pathInode) getAttr(name string, context *fuse.Context) (*fuse.Attr, *nodefs.Timeouts, fuse.Status) {
+	if tfs, ok := n.fs.(AttrTimeoutFileSystem); ok {
+		return tfs.GetAttrTimeout(name, context)
+	}
+	fi, code := n.fs.GetAttr(name, context)
+	return fi, nil, code
+}
+
 func (n *pathInode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (node nodefs.Node, code fuse.Status) {
+	node, _, code = n.LookupTimeout(out, name, context)
+	return node, code
+}
+
+func (n *pathInode) LookupTimeout(out *fuse.Attr, name string, context *fuse.Context) (node nodefs.Node, timeouts *nodefs.Timeouts, code fuse.Status) {
 	fullPath := filepath.Join(n.GetPath(), name)
-	fi, code := n.fs.GetAttr(fullPath, context)
+	fi, timeouts, code := n.getAttr(fullPath, context)
 	if code.Ok() {
 		node = n.findChild(fi, name, fullPath)
 		*out = *fi
 	}
 
-	return node, code
+	return node, timeouts, code
 }
 
 func (n *pathInode) findChild(fi *fuse.Attr, name string, fullPath string) (out *pathInode) {
@@ -571,18 +741,28 @@ func (n *pathInode) findChild(fi *fuse.Attr, name string, fullPath string) (out
 }
 
 func (n *pathInode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) (code fuse.Status) {
+	_, code = n.GetAttrTimeout(out, file, context)
+	return code
+}
+
+func (n *pathInode) GetAttrTimeout(out *fuse.Attr, file nodefs.File, context *fuse.Context) (timeouts *nodefs.Timeouts, code fuse.Status) {
 	var fi *fuse.Attr
 	if file == nil {
 		// called on a deleted files.
 		file = n.Inode().AnyFile()
 	}
+	if file == nil {
+		file = n.tmpFile
+	}
 
-	if file != nil {
+	if cf, ok := file.(nodefs.ContextFile); ok {
+		code = cf.GetAttrContext(out, context)
+	} else if file != nil {
 		code = file.GetAttr(out)
 	}
 
 	if file == nil || code == fuse.ENOSYS || code == fuse.EBADF {
-		fi, code = n.fs.GetAttr(n.GetPath(), context)
+		fi, timeouts, code = n.getAttr(n.GetPath(), context)
 	}
 
 	if fi != nil {
@@ -596,14 +776,17 @@ func (n *pathInode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Cont
 	if fi != nil {
 		*out = *fi
 	}
-	return code
+	return timeouts, code
 }
 
 func (n *pathInode) Chmod(file nodefs.File, perms uint32, context *fuse.Context) (code fuse.Status) {
 	files := n.Inode().Files(fuse.O_ANYWRITE)
 	for _, f := range files {
-		// TODO - pass context
-		code = f.Chmod(perms)
+		if cf, ok := f.File.(nodefs.ContextFile); ok {
+			code = cf.ChmodContext(perms, context)
+		} else {
+			code = f.Chmod(perms)
+		}
 		if code.Ok() {
 			return
 		}
@@ -618,8 +801,11 @@ func (n *pathInode) Chmod(file nodefs.File, perms uint32, context *fuse.Context)
 func (n *pathInode) Chown(file nodefs.File, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
 	files := n.Inode().Files(fuse.O_ANYWRITE)
 	for _, f := range files {
-		// TODO - pass context
-		code = f.Chown(uid, gid)
+		if cf, ok := f.File.(nodefs.ContextFile); ok {
+			code = cf.ChownContext(uid, gid, context)
+		} else {
+			code = f.Chown(uid, gid)
+		}
 		if code.Ok() {
 			return code
 		}
@@ -634,8 +820,11 @@ func (n *pathInode) Chown(file nodefs.File, uid uint32, gid uint32, context *fus
 func (n *pathInode) Truncate(file nodefs.File, size uint64, context *fuse.Context) (code fuse.Status) {
 	files := n.Inode().Files(fuse.O_ANYWRITE)
 	for _, f := range files {
-		// TODO - pass context
-		code = f.Truncate(size)
+		if cf, ok := f.File.(nodefs.ContextFile); ok {
+			code = cf.TruncateContext(size, context)
+		} else {
+			code = f.Truncate(size)
+		}
 		if code.Ok() {
 			return code
 		}
@@ -649,8 +838,11 @@ func (n *pathInode) Truncate(file nodefs.File, size uint64, context *fuse.Contex
 func (n *pathInode) Utimens(file nodefs.File, atime *time.Time, mtime *time.Time, context *fuse.Context) (code fuse.Status) {
 	files := n.Inode().Files(fuse.O_ANYWRITE)
 	for _, f := range files {
-		// TODO - pass context
-		code = f.Utimens(atime, mtime)
+		if cf, ok := f.File.(nodefs.ContextFile); ok {
+			code = cf.UtimensContext(atime, mtime, context)
+		} else {
+			code = f.Utimens(atime, mtime)
+		}
 		if code.Ok() {
 			return code
 		}
@@ -662,7 +854,12 @@ func (n *pathInode) Utimens(file nodefs.File, atime *time.Time, mtime *time.Time
 }
 
 func (n *pathInode) Fallocate(file nodefs.File, off uint64, size uint64, mode uint32, context *fuse.Context) (code fuse.Status) {
-	if file != nil {
+	if cf, ok := file.(nodefs.ContextFile); ok {
+		code = cf.AllocateContext(off, size, mode, context)
+		if code.Ok() {
+			return code
+		}
+	} else if file != nil {
 		code = file.Allocate(off, size, mode)
 		if code.Ok() {
 			return code
@@ -671,8 +868,11 @@ func (n *pathInode) Fallocate(file nodefs.File, off uint64, size uint64, mode ui
 
 	files := n.Inode().Files(fuse.O_ANYWRITE)
 	for _, f := range files {
-		// TODO - pass context
-		code = f.Allocate(off, size, mode)
+		if cf, ok := f.File.(nodefs.ContextFile); ok {
+			code = cf.AllocateContext(off, size, mode, context)
+		} else {
+			code = f.Allocate(off, size, mode)
+		}
 		if code.Ok() {
 			return code
 		}
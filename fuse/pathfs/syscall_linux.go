@@ -2,7 +2,27 @@ package pathfs
 
 import (
 	"bytes"
+	"fmt"
+	"runtime"
 	"syscall"
+	"unsafe"
+)
+
+// renameat2 is not in package syscall; these are its numbers for
+// the architectures we build on.
+var sysRenameat2 = map[string]uintptr{
+	"386":   353,
+	"amd64": 316,
+	"arm":   382,
+	"arm64": 276,
+}
+
+const (
+	_AT_FDCWD          = -100
+	_AT_SYMLINK_FOLLOW = 0x400
+
+	// O_TMPFILE, including O_DIRECTORY.
+	_O_TMPFILE = 0x410000
 )
 
 func getXAttr(path string, attr string, dest []byte) (value []byte, err error) {
@@ -30,6 +50,9 @@ func listXAttr(path string) (attributes []string, err error) {
 		dest = make([]byte, sz)
 		sz, err = syscall.Listxattr(path, dest)
 	}
+	if err != nil || sz == 0 {
+		return nil, err
+	}
 
 	// -1 to drop the final empty slice.
 	dest = dest[:sz-1]
@@ -40,3 +63,52 @@ func listXAttr(path string) (attributes []string, err error) {
 	}
 	return attributes, err
 }
+
+// Renameat2 renames oldPath to newPath with the RENAME_* flags of
+// renameat2(2).  It returns ENOSYS on architectures missing from
+// sysRenameat2.  Tests use it to exercise Rename2 through a mount.
+func Renameat2(oldPath string, newPath string, flags uint32) error {
+	nr, ok := sysRenameat2[runtime.GOARCH]
+	if !ok {
+		return syscall.ENOSYS
+	}
+	oldp, err := syscall.BytePtrFromString(oldPath)
+	if err != nil {
+		return err
+	}
+	newp, err := syscall.BytePtrFromString(newPath)
+	if err != nil {
+		return err
+	}
+	fd := _AT_FDCWD
+	_, _, errNo := syscall.Syscall6(nr,
+		uintptr(fd), uintptr(unsafe.Pointer(oldp)),
+		uintptr(fd), uintptr(unsafe.Pointer(newp)),
+		uintptr(flags), 0)
+	if errNo != 0 {
+		return errNo
+	}
+	return nil
+}
+
+// linkFd gives the file open at fd a new name, as in linkat(2) on
+// /proc/self/fd, which does not need CAP_DAC_READ_SEARCH.
+func linkFd(fd uintptr, newPath string) error {
+	oldp, err := syscall.BytePtrFromString(fmt.Sprintf("/proc/self/fd/%d", fd))
+	if err != nil {
+		return err
+	}
+	newp, err := syscall.BytePtrFromString(newPath)
+	if err != nil {
+		return err
+	}
+	dirfd := _AT_FDCWD
+	_, _, errNo := syscall.Syscall6(syscall.SYS_LINKAT,
+		uintptr(dirfd), uintptr(unsafe.Pointer(oldp)),
+		uintptr(dirfd), uintptr(unsafe.Pointer(newp)),
+		_AT_SYMLINK_FOLLOW, 0)
+	if errNo != 0 {
+		return errNo
+	}
+	return nil
+}
@@ -2,8 +2,11 @@ package fuse
 
 const outputHeaderSize = 160
 
+// _OUR_MINOR_VERSION is 23 for RENAME2.  The kernel sends LSEEK,
+// COPY_FILE_RANGE and TMPFILE whatever minor version is negotiated,
+// and the protocol changes of later versions have not been audited.
 const (
 	_FUSE_KERNEL_VERSION   = 7
 	_MINIMUM_MINOR_VERSION = 13
-	_OUR_MINOR_VERSION     = 20
+	_OUR_MINOR_VERSION     = 23
 )
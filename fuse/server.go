@@ -45,6 +45,12 @@ type Server struct {
 	outstandingReadBufs int
 	kernelSettings      raw.InitIn
 
+	// Serializes notifications with closing the device.  It is
+	// separate from reqMu: the kernel may block a notification
+	// until a pending request is answered, which needs reqMu to
+	// be read.
+	writeMu sync.Mutex
+
 	canSplice bool
 	loops     sync.WaitGroup
 }
@@ -305,9 +311,11 @@ func (ms *Server) Serve() {
 	ms.loop(false)
 	ms.loops.Wait()
 
+	ms.writeMu.Lock()
 	ms.reqMu.Lock()
 	syscall.Close(ms.mountFd)
 	ms.reqMu.Unlock()
+	ms.writeMu.Unlock()
 }
 
 func (ms *Server) loop(exitIdle bool) {
@@ -406,9 +414,9 @@ func (ms *Server) writeInodeNotify(entry *raw.NotifyInvalInodeOut) Status {
 	req.outData = unsafe.Pointer(entry)
 
 	// Protect against concurrent close.
-	ms.reqMu.Lock()
+	ms.writeMu.Lock()
 	result := ms.write(&req)
-	ms.reqMu.Unlock()
+	ms.writeMu.Unlock()
 
 	if ms.debug {
 		log.Println("Response: INODE_NOTIFY", result)
@@ -443,9 +451,9 @@ func (ms *Server) writeDeleteNotify(parent uint64, child uint64, name string) St
 	req.flatData = nameBytes
 
 	// Protect against concurrent close.
-	ms.reqMu.Lock()
+	ms.writeMu.Lock()
 	result := ms.write(&req)
-	ms.reqMu.Unlock()
+	ms.writeMu.Unlock()
 
 	if ms.debug {
 		log.Printf("Response: DELETE_NOTIFY: %v", result)
@@ -475,9 +483,9 @@ func (ms *Server) writeEntryNotify(parent uint64, name string) Status {
 	req.flatData = nameBytes
 
 	// Protect against concurrent close.
-	ms.reqMu.Lock()
+	ms.writeMu.Lock()
 	result := ms.write(&req)
-	ms.reqMu.Unlock()
+	ms.writeMu.Unlock()
 
 	if ms.debug {
 		log.Printf("Response: ENTRY_NOTIFY: %v", result)
@@ -7,6 +7,7 @@ import (
 	"os"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
@@ -214,3 +215,132 @@ func TestGetAttrRace(t *testing.T) {
 		t.Error(statErr)
 	}
 }
+
+func TestCachePolicyDirectIO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-cache_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(dir+"/mnt", 0755)
+	os.Mkdir(dir+"/orig", 0755)
+
+	fs := pathfs.NewLoopbackFileSystem(dir + "/orig")
+	pfs := pathfs.NewPathNodeFs(fs, &pathfs.PathNodeFsOptions{
+		CachePolicy: func(name string) *pathfs.CachePolicy {
+			if name == "direct.txt" {
+				return &pathfs.CachePolicy{DirectIO: true}
+			}
+			return nil
+		},
+	})
+	state, _, err := nodefs.MountFileSystem(dir+"/mnt", pfs, nil)
+	if err != nil {
+		t.Fatalf("MountNodeFileSystem failed: %v", err)
+	}
+	state.SetDebug(fuse.VerboseTest())
+	go state.Serve()
+	defer state.Unmount()
+
+	if err := ioutil.WriteFile(dir+"/orig/direct.txt", []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	f, err := os.Open(dir + "/mnt/direct.txt")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+
+	b := make([]byte, 5)
+	if _, err := f.ReadAt(b, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if string(b) != "hello" {
+		t.Fatalf("got %q, want %q", b, "hello")
+	}
+
+	if err := ioutil.WriteFile(dir+"/orig/direct.txt", []byte("world"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if _, err := f.ReadAt(b, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if string(b) != "world" {
+		t.Errorf("page cache used for direct I/O file: got %q, want %q", b, "world")
+	}
+}
+
+type timeoutFs struct {
+	pathfs.FileSystem
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (fs *timeoutFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	a, _, code := fs.GetAttrTimeout(name, context)
+	return a, code
+}
+
+func (fs *timeoutFs) GetAttrTimeout(name string, context *fuse.Context) (*fuse.Attr, *nodefs.Timeouts, fuse.Status) {
+	fs.mu.Lock()
+	fs.calls[name]++
+	fs.mu.Unlock()
+
+	forever := &nodefs.Timeouts{Entry: time.Hour, Attr: time.Hour, Negative: time.Hour}
+	switch name {
+	case "":
+		return &fuse.Attr{Mode: fuse.S_IFDIR | 0755}, nil, fuse.OK
+	case "static":
+		return &fuse.Attr{Mode: fuse.S_IFREG | 0644}, forever, fuse.OK
+	case "live":
+		return &fuse.Attr{Mode: fuse.S_IFREG | 0644}, nil, fuse.OK
+	case "missing":
+		return nil, forever, fuse.ENOENT
+	}
+	return nil, nil, fuse.ENOENT
+}
+
+func (fs *timeoutFs) count(name string) int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.calls[name]
+}
+
+func TestPerNodeTimeouts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-cache_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := &timeoutFs{
+		FileSystem: pathfs.NewDefaultFileSystem(),
+		calls:      map[string]int{},
+	}
+	nfs := pathfs.NewPathNodeFs(fs, nil)
+	state, _, err := nodefs.MountFileSystem(dir, nfs, &nodefs.Options{})
+	if err != nil {
+		t.Fatalf("MountFileSystem failed: %v", err)
+	}
+	state.SetDebug(fuse.VerboseTest())
+	go state.Serve()
+	defer state.Unmount()
+
+	for i := 0; i < 3; i++ {
+		os.Lstat(dir + "/static")
+		os.Lstat(dir + "/live")
+		os.Lstat(dir + "/missing")
+	}
+
+	if c := fs.count("static"); c != 1 {
+		t.Errorf("static: got %d GetAttr calls, want 1", c)
+	}
+	if c := fs.count("live"); c < 3 {
+		t.Errorf("live: got %d GetAttr calls, want at least 3", c)
+	}
+	if c := fs.count("missing"); c != 1 {
+		t.Errorf("missing: got %d GetAttr calls, want 1", c)
+	}
+}
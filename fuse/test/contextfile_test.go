@@ -0,0 +1,106 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// auditFile records the caller of each write.
+type auditFile struct {
+	nodefs.ContextFile
+
+	mu      sync.Mutex
+	writers []fuse.Owner
+	pids    []uint32
+}
+
+func (f *auditFile) String() string {
+	return "auditFile"
+}
+
+func (f *auditFile) WriteContext(data []byte, off int64, context *fuse.Context) (uint32, fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writers = append(f.writers, fuse.Owner(context.Owner))
+	f.pids = append(f.pids, context.Pid)
+	return uint32(len(data)), fuse.OK
+}
+
+func (f *auditFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	return 0, fuse.EIO
+}
+
+func (f *auditFile) FlushContext(context *fuse.Context) fuse.Status {
+	return fuse.OK
+}
+
+type auditFs struct {
+	pathfs.FileSystem
+	file *auditFile
+}
+
+func (fs *auditFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	switch name {
+	case "":
+		return &fuse.Attr{Mode: fuse.S_IFDIR | 0755}, fuse.OK
+	case "file":
+		return &fuse.Attr{Mode: fuse.S_IFREG | 0644}, fuse.OK
+	}
+	return nil, fuse.ENOENT
+}
+
+func (fs *auditFs) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if name != "file" {
+		return nil, fuse.ENOENT
+	}
+	return fs.file, fuse.OK
+}
+
+func (fs *auditFs) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	return fuse.OK
+}
+
+func TestContextFileWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-contextfile_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := &auditFs{
+		FileSystem: pathfs.NewDefaultFileSystem(),
+		file:       &auditFile{ContextFile: nodefs.NewDefaultContextFile()},
+	}
+	nfs := pathfs.NewPathNodeFs(fs, nil)
+	state, _, err := nodefs.MountFileSystem(dir, nfs, nil)
+	if err != nil {
+		t.Fatalf("MountFileSystem failed: %v", err)
+	}
+	state.SetDebug(fuse.VerboseTest())
+	go state.Serve()
+	defer state.Unmount()
+
+	if err := ioutil.WriteFile(dir+"/file", []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	f := fs.file
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.writers) == 0 {
+		t.Fatalf("WriteContext was not called")
+	}
+	want := fuse.Owner{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	if f.writers[0] != want {
+		t.Errorf("got writer %v, want %v", f.writers[0], want)
+	}
+	if f.pids[0] == 0 {
+		t.Errorf("got zero pid for writer")
+	}
+}
@@ -0,0 +1,75 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+const _SYS_COPY_FILE_RANGE = 326
+
+func copyFileRange(src *os.File, offIn int64, dst *os.File, offOut int64, size int) (int, error) {
+	n, _, errNo := syscall.Syscall6(_SYS_COPY_FILE_RANGE,
+		src.Fd(), uintptr(unsafe.Pointer(&offIn)),
+		dst.Fd(), uintptr(unsafe.Pointer(&offOut)),
+		uintptr(size), 0)
+	if errNo != 0 {
+		return 0, errNo
+	}
+	return int(n), nil
+}
+
+func TestCopyFileRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-copyfilerange_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	orig := dir + "/orig"
+	mnt := dir + "/mnt"
+	os.Mkdir(orig, 0755)
+	os.Mkdir(mnt, 0755)
+	ioutil.WriteFile(orig+"/src", []byte("0123456789"), 0644)
+	ioutil.WriteFile(orig+"/dst", []byte("abcdefghij"), 0644)
+
+	pfs := pathfs.NewPathNodeFs(pathfs.NewLoopbackFileSystem(orig), nil)
+	state, _, err := nodefs.MountFileSystem(mnt, pfs, nil)
+	if err != nil {
+		t.Fatalf("MountFileSystem failed: %v", err)
+	}
+	state.SetDebug(fuse.VerboseTest())
+	go state.Serve()
+	defer state.Unmount()
+
+	src, err := os.Open(mnt + "/src")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(mnt+"/dst", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer dst.Close()
+
+	n, err := copyFileRange(src, 2, dst, 4, 5)
+	if err != nil {
+		t.Fatalf("copy_file_range failed: %v", err)
+	}
+	if n != 5 {
+		t.Errorf("copied %d bytes, want 5", n)
+	}
+	want := "abcd23456j"
+	if c, err := ioutil.ReadFile(mnt + "/dst"); err != nil || string(c) != want {
+		t.Errorf("got %q, %v, want %q", c, err, want)
+	}
+	if c, err := ioutil.ReadFile(orig + "/dst"); err != nil || string(c) != want {
+		t.Errorf("backing file: got %q, %v, want %q", c, err, want)
+	}
+}
@@ -0,0 +1,73 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+func TestDirEntryInodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-direntry_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(dir+"/mnt", 0755)
+	os.Mkdir(dir+"/orig", 0755)
+	os.Mkdir(dir+"/orig/subdir", 0755)
+	if err := ioutil.WriteFile(dir+"/orig/file", []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	pfs := pathfs.NewPathNodeFs(pathfs.NewLoopbackFileSystem(dir+"/orig"), nil)
+	opts := nodefs.NewOptions()
+	opts.ReportInodes = true
+	state, _, err := nodefs.MountFileSystem(dir+"/mnt", pfs, opts)
+	if err != nil {
+		t.Fatalf("MountFileSystem failed: %v", err)
+	}
+	state.SetDebug(fuse.VerboseTest())
+	go state.Serve()
+	defer state.Unmount()
+
+	fd, err := syscall.Open(dir+"/mnt", syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer syscall.Close(fd)
+	buf := make([]byte, 4096)
+	n, err := syscall.Getdents(fd, buf)
+	if err != nil {
+		t.Fatalf("Getdents failed: %v", err)
+	}
+
+	for buf := buf[:n]; len(buf) > 0; {
+		d := (*syscall.Dirent)(unsafe.Pointer(&buf[0]))
+		names, _ := direntNames(buf[:d.Reclen])
+		buf = buf[d.Reclen:]
+		if names[0] == "." || names[0] == ".." {
+			continue
+		}
+
+		var st syscall.Stat_t
+		if err := syscall.Lstat(dir+"/mnt/"+names[0], &st); err != nil {
+			t.Fatalf("Lstat failed: %v", err)
+		}
+		if d.Ino != st.Ino {
+			t.Errorf("%s: d_ino %d does not match st_ino %d", names[0], d.Ino, st.Ino)
+		}
+		wantType := uint8(syscall.DT_REG)
+		if st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			wantType = syscall.DT_DIR
+		}
+		if d.Type != wantType {
+			t.Errorf("%s: d_type %d, want %d", names[0], d.Type, wantType)
+		}
+	}
+}
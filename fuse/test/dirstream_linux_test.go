@@ -0,0 +1,177 @@
+package test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// countStream generates entries without holding them in memory.
+type countStream struct {
+	n   int
+	pos int
+}
+
+func (s *countStream) HasNext() bool {
+	return s.pos < s.n
+}
+
+func (s *countStream) Next() (fuse.DirEntry, uint64, fuse.Status) {
+	e := fuse.DirEntry{Name: fmt.Sprintf("file%d", s.pos), Mode: fuse.S_IFREG}
+	s.pos++
+	// Use sparse cookies to check that they are passed through.
+	return e, uint64(s.pos) * 10, fuse.OK
+}
+
+func (s *countStream) Seek(cookie uint64) fuse.Status {
+	if cookie%10 != 0 {
+		return fuse.EINVAL
+	}
+	s.pos = int(cookie / 10)
+	return fuse.OK
+}
+
+func (s *countStream) Close() {
+}
+
+type streamFs struct {
+	pathfs.FileSystem
+	n int
+}
+
+func (fs *streamFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if name == "" {
+		return &fuse.Attr{Mode: fuse.S_IFDIR | 0755}, fuse.OK
+	}
+	return nil, fuse.ENOENT
+}
+
+func (fs *streamFs) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	return nil, fuse.EIO
+}
+
+func (fs *streamFs) OpenDirStream(name string, context *fuse.Context) (nodefs.DirStream, fuse.Status) {
+	return &countStream{n: fs.n}, fuse.OK
+}
+
+func TestDirStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-dirstream_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := &streamFs{FileSystem: pathfs.NewDefaultFileSystem(), n: 5000}
+	nfs := pathfs.NewPathNodeFs(fs, nil)
+	state, _, err := nodefs.MountFileSystem(dir, nfs, nil)
+	if err != nil {
+		t.Fatalf("MountFileSystem failed: %v", err)
+	}
+	go state.Serve()
+	defer state.Unmount()
+
+	f, err := os.Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+
+	for i := 0; i < 2; i++ {
+		names, err := f.Readdirnames(-1)
+		if err != nil {
+			t.Fatalf("Readdirnames failed: %v", err)
+		}
+		if len(names) != fs.n {
+			t.Fatalf("got %d entries, want %d", len(names), fs.n)
+		}
+		seen := map[string]bool{}
+		for _, n := range names {
+			seen[n] = true
+		}
+		for j := 0; j < fs.n; j++ {
+			if name := fmt.Sprintf("file%d", j); !seen[name] {
+				t.Fatalf("missing entry %q", name)
+			}
+		}
+
+		if _, err := f.Seek(0, 0); err != nil {
+			t.Fatalf("Seek failed: %v", err)
+		}
+	}
+}
+
+// direntNames parses getdents64 output into names and offsets.
+func direntNames(buf []byte) (names []string, offs []int64) {
+	for len(buf) > 0 {
+		d := (*syscall.Dirent)(unsafe.Pointer(&buf[0]))
+		name := d.Name[:]
+		n := 0
+		for n < len(name) && name[n] != 0 {
+			n++
+		}
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(name[i])
+		}
+		names = append(names, string(b))
+		offs = append(offs, d.Off)
+		buf = buf[d.Reclen:]
+	}
+	return names, offs
+}
+
+func TestDirStreamSeek(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-dirstream_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := &streamFs{FileSystem: pathfs.NewDefaultFileSystem(), n: 100}
+	nfs := pathfs.NewPathNodeFs(fs, nil)
+	state, _, err := nodefs.MountFileSystem(dir, nfs, nil)
+	if err != nil {
+		t.Fatalf("MountFileSystem failed: %v", err)
+	}
+	go state.Serve()
+	defer state.Unmount()
+
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	buf := make([]byte, 4096)
+	n, err := syscall.Getdents(fd, buf)
+	if err != nil {
+		t.Fatalf("Getdents failed: %v", err)
+	}
+	names, offs := direntNames(buf[:n])
+	if len(names) < 10 {
+		t.Fatalf("got %d entries, want at least 10", len(names))
+	}
+	if offs[4] != 50 {
+		t.Errorf("got offset %d for %q, want cookie 50", offs[4], names[4])
+	}
+
+	// Seeking to a cookie continues after the entry it came with.
+	if _, err := syscall.Seek(fd, offs[4], 0); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	n, err = syscall.Getdents(fd, buf)
+	if err != nil {
+		t.Fatalf("Getdents failed: %v", err)
+	}
+	again, _ := direntNames(buf[:n])
+	if len(again) == 0 || again[0] != names[5] {
+		t.Errorf("after seek got %v, want %q first", again, names[5])
+	}
+}
@@ -0,0 +1,138 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+func mountExport(t *testing.T, dir string) *fuse.Server {
+	fs := pathfs.NewLoopbackFileSystem(dir + "/orig")
+	pfs := pathfs.NewPathNodeFs(fs, &pathfs.PathNodeFsOptions{
+		NodeIdJournal: dir + "/journal",
+	})
+	opts := nodefs.NewOptions()
+	opts.ExportNodeIds = true
+	conn := nodefs.NewFileSystemConnector(pfs, opts)
+	state, err := fuse.NewServer(conn.RawFS(), dir+"/mnt", &fuse.MountOptions{
+		ExportSupport: true,
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	state.SetDebug(fuse.VerboseTest())
+	go state.Serve()
+	return state
+}
+
+func statIno(t *testing.T, name string) uint64 {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(name, &st); err != nil {
+		t.Fatalf("Lstat failed: %v", err)
+	}
+	return st.Ino
+}
+
+func TestExportNodeIdsPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-export_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(dir+"/mnt", 0755)
+	os.Mkdir(dir+"/orig", 0755)
+	if err := ioutil.WriteFile(dir+"/orig/file", []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	state := mountExport(t, dir)
+	before := statIno(t, dir+"/mnt/file")
+	handle, err := nameToHandle(dir + "/mnt/file")
+	if err != nil {
+		t.Fatalf("name_to_handle_at failed: %v", err)
+	}
+	if err := os.Rename(dir+"/mnt/file", dir+"/mnt/renamed"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if got := statIno(t, dir+"/mnt/renamed"); got != before {
+		t.Errorf("inode changed on rename: got %d, want %d", got, before)
+	}
+	if err := state.Unmount(); err != nil {
+		t.Fatalf("Unmount failed: %v", err)
+	}
+
+	state = mountExport(t, dir)
+	defer state.Unmount()
+	// Opening the handle from the previous mount makes the kernel
+	// look up "." on a node ID it has not seen in this mount.
+	mnt, err := os.Open(dir + "/mnt")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer mnt.Close()
+	fd, err := openByHandle(mnt, handle)
+	if err == syscall.EPERM {
+		t.Skip("open_by_handle_at needs CAP_DAC_READ_SEARCH")
+	}
+	if err != nil {
+		t.Fatalf("open_by_handle_at failed: %v", err)
+	}
+	f := os.NewFile(uintptr(fd), "handle")
+	defer f.Close()
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if string(content) != "hello" {
+		t.Errorf("got %q, want %q", content, "hello")
+	}
+	if got := statIno(t, dir+"/mnt/renamed"); got != before {
+		t.Errorf("inode changed on remount: got %d, want %d", got, before)
+	}
+}
+
+// fileHandle mirrors struct file_handle with room for the FUSE
+// handle, which holds a node ID and a generation.
+type fileHandle struct {
+	bytes uint32
+	typ   int32
+	data  [32]byte
+}
+
+func nameToHandle(name string) (*fileHandle, error) {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	h := &fileHandle{bytes: 32}
+	var mountId int32
+	_, _, errno := syscall.Syscall6(_SYS_NAME_TO_HANDLE_AT, _AT_FDCWD,
+		uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(h)), uintptr(unsafe.Pointer(&mountId)), 0, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	return h, nil
+}
+
+func openByHandle(mount *os.File, h *fileHandle) (int, error) {
+	fd, _, errno := syscall.Syscall(_SYS_OPEN_BY_HANDLE_AT, mount.Fd(),
+		uintptr(unsafe.Pointer(h)), uintptr(syscall.O_RDONLY))
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// Not in package syscall.
+const (
+	_AT_FDCWD = ^uintptr(99)
+
+	_SYS_NAME_TO_HANDLE_AT = 303
+	_SYS_OPEN_BY_HANDLE_AT = 304
+)
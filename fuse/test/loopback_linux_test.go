@@ -68,3 +68,39 @@ func TestFallocate(t *testing.T) {
 			fi.Size())
 	}
 }
+
+func TestSeekDataHole(t *testing.T) {
+	ts := NewTestCase(t)
+	defer ts.Cleanup()
+
+	const blk = 64 * 1024
+	f, err := os.OpenFile(ts.origFile, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	f.Truncate(3 * blk)
+	f.WriteAt(make([]byte, blk), blk)
+	f.Close()
+
+	orig, err := os.Open(ts.origFile)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer orig.Close()
+	mounted, err := os.Open(ts.mountFile)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer mounted.Close()
+
+	for _, c := range []struct {
+		off    int64
+		whence int
+	}{{0, 3}, {0, 4}, {blk, 4}, {2 * blk, 3}} {
+		want, wantErr := syscall.Seek(int(orig.Fd()), c.off, c.whence)
+		got, err := syscall.Seek(int(mounted.Fd()), c.off, c.whence)
+		if got != want || err != wantErr {
+			t.Errorf("lseek(%d, %d): got %d, %v, want %d, %v", c.off, c.whence, got, err, want, wantErr)
+		}
+	}
+}
@@ -162,3 +162,98 @@ func TestDeletedUnmount(t *testing.T) {
 		t.Error("should succeed", code)
 	}
 }
+
+type unmountNotifyFs struct {
+	*pathfs.PathNodeFs
+	unmounted chan struct{}
+}
+
+func (fs *unmountNotifyFs) OnUnmount() {
+	close(fs.unmounted)
+}
+
+func TestUnmountDetach(t *testing.T) {
+	ts := NewTestCase(t)
+	defer ts.Cleanup()
+
+	err := ioutil.WriteFile(ts.orig+"/hello.txt", []byte("blabla"), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	fs := &unmountNotifyFs{
+		PathNodeFs: pathfs.NewPathNodeFs(pathfs.NewLoopbackFileSystem(ts.orig), nil),
+		unmounted:  make(chan struct{}),
+	}
+	code := ts.connector.Mount(ts.rootNode(), "mnt", fs, nil)
+	if !code.Ok() {
+		t.Fatal("mount should succeed")
+	}
+
+	submnt := ts.mnt + "/mnt"
+	f, err := os.Open(filepath.Join(submnt, "hello.txt"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+
+	mounts := ts.pathFs.Mounts()
+	if len(mounts) != 1 {
+		t.Fatalf("got mounts %v, want 1", mounts)
+	}
+	if m := mounts[0]; m.Path != "mnt" || m.FileSystem != fs || m.OpenFiles != 1 || m.Inodes != 2 || m.Detached {
+		t.Errorf("got mount %+v", m)
+	}
+
+	code = ts.pathFs.UnmountDetach("mnt")
+	if !code.Ok() {
+		t.Fatalf("UnmountDetach failed: %v", code)
+	}
+	if _, err := os.Lstat(submnt); !os.IsNotExist(err) {
+		t.Errorf("mount point should be gone, got %v", err)
+	}
+	if code := ts.pathFs.Unmount("mnt"); code != fuse.ENOENT {
+		t.Errorf("Unmount after detach: got %v, want ENOENT", code)
+	}
+
+	mounts = ts.pathFs.Mounts()
+	if len(mounts) != 1 || !mounts[0].Detached || mounts[0].Path != "mnt" {
+		t.Errorf("got mounts %+v, want one detached mount", mounts)
+	}
+
+	buf := make([]byte, 10)
+	n, err := f.Read(buf)
+	if err != nil || string(buf[:n]) != "blabla" {
+		t.Errorf("Read on detached mount: got %q, %v", buf[:n], err)
+	}
+	select {
+	case <-fs.unmounted:
+		t.Fatal("OnUnmount called with open files")
+	default:
+	}
+
+	// Listing mounts while the detached mount finishes.
+	done := make(chan struct{})
+	listed := make(chan struct{})
+	go func() {
+		defer close(listed)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				ts.pathFs.Mounts()
+			}
+		}
+	}()
+	f.Close()
+	select {
+	case <-fs.unmounted:
+	case <-time.After(time.Second):
+		t.Fatal("OnUnmount not called after last release")
+	}
+	close(done)
+	<-listed
+	if mounts := ts.pathFs.Mounts(); len(mounts) != 0 {
+		t.Errorf("got mounts %+v, want none", mounts)
+	}
+}
@@ -153,3 +153,129 @@ func TestEntryNotify(t *testing.T) {
 		t.Fatalf("Lstat failed: %v", err)
 	}
 }
+
+func TestNotifyAll(t *testing.T) {
+	test := NewNotifyTest(t)
+	defer test.Clean()
+
+	dir := test.dir
+	test.fs.size = 42
+	test.fs.exist = false
+	test.state.ThreadSanitizerSync()
+
+	if fi, err := os.Lstat(dir + "/file"); err != nil || fi.Size() != 42 {
+		t.Fatalf("Lstat: %v, %v", fi, err)
+	}
+	if fi, _ := os.Lstat(dir + "/dir/file"); fi != nil {
+		t.Fatalf("File should not exist, %#v", fi)
+	}
+
+	test.fs.size = 666
+	test.fs.exist = true
+	test.state.ThreadSanitizerSync()
+
+	code := test.pathfs.NotifyAll([]pathfs.Invalidation{
+		{Kind: pathfs.NotifyAttr, Path: "file"},
+		{Kind: pathfs.NotifyAttr, Path: "file"},
+		{Kind: pathfs.NotifyEntry, Path: "dir/file"},
+		{Kind: pathfs.NotifyDelete, Path: "unknown/file"},
+		{Kind: pathfs.NotifyData, Path: "unknown", Off: 0, Length: 10},
+	})
+	if !code.Ok() {
+		t.Errorf("NotifyAll: %v", code)
+	}
+
+	if fi, err := os.Lstat(dir + "/file"); err != nil || fi.Size() != 666 {
+		t.Errorf("attributes not invalidated: %v, %v", fi, err)
+	}
+	if _, err := os.Lstat(dir + "/dir/file"); err != nil {
+		t.Errorf("entry not invalidated: %v", err)
+	}
+}
+
+// blockingFile holds up reads until release is closed.
+type blockingFile struct {
+	nodefs.File
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (f *blockingFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	select {
+	case f.reading <- struct{}{}:
+	default:
+	}
+	<-f.release
+	return &fuse.ReadResultData{Data: dest[:1]}, fuse.OK
+}
+
+type blockingReadFs struct {
+	*NotifyFs
+	file *blockingFile
+}
+
+func (fs *blockingReadFs) Open(name string, f uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	return fs.file, fuse.OK
+}
+
+// The kernel holds an inode notification until the reads of the
+// inode are answered.  Meanwhile, other requests must be served.
+func TestInodeNotifyDuringRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-notify_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fs := &blockingReadFs{
+		NotifyFs: &NotifyFs{FileSystem: pathfs.NewDefaultFileSystem(), size: 1},
+		file: &blockingFile{
+			File:    nodefs.NewDefaultFile(),
+			reading: make(chan struct{}, 1),
+			release: make(chan struct{}),
+		},
+	}
+	pfs := pathfs.NewPathNodeFs(fs, nil)
+	state, _, err := nodefs.MountFileSystem(dir, pfs, nil)
+	if err != nil {
+		t.Fatalf("MountFileSystem failed: %v", err)
+	}
+	state.SetDebug(fuse.VerboseTest())
+	go state.Serve()
+	defer state.Unmount()
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := ioutil.ReadFile(dir + "/file")
+		read <- err
+	}()
+	<-fs.file.reading
+
+	notified := make(chan fuse.Status, 1)
+	go func() {
+		notified <- pfs.FileNotify("file", 0, 0)
+	}()
+	// Let the notification reach the kernel.
+	time.Sleep(10 * time.Millisecond)
+
+	looked := make(chan error, 1)
+	go func() {
+		_, err := os.Lstat(dir + "/dir")
+		looked <- err
+	}()
+	select {
+	case err := <-looked:
+		if err != nil {
+			t.Errorf("Lstat failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Lstat blocked behind the notification")
+	}
+
+	close(fs.file.release)
+	if err := <-read; err != nil {
+		t.Errorf("ReadFile failed: %v", err)
+	}
+	if code := <-notified; !code.Ok() {
+		t.Errorf("FileNotify: %v", code)
+	}
+}
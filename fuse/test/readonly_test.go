@@ -0,0 +1,89 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+func TestReadOnlyOption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-readonly_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	orig := dir + "/orig"
+	mnt := dir + "/mnt"
+	os.Mkdir(orig, 0755)
+	os.Mkdir(mnt, 0755)
+	ioutil.WriteFile(orig+"/file", []byte("hello"), 0644)
+
+	opts := nodefs.NewOptions()
+	opts.ReadOnly = true
+	pfs := pathfs.NewPathNodeFs(pathfs.NewLoopbackFileSystem(orig), nil)
+
+	// Mount without "ro", so the kernel passes on the mutations.
+	conn := nodefs.NewFileSystemConnector(pfs, opts)
+	state, err := fuse.NewServer(conn.RawFS(), mnt, nil)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	state.SetDebug(fuse.VerboseTest())
+	go state.Serve()
+	defer state.Unmount()
+
+	if c, err := ioutil.ReadFile(mnt + "/file"); err != nil || string(c) != "hello" {
+		t.Errorf("ReadFile: got %q, %v", c, err)
+	}
+	for name, op := range map[string]func() error{
+		"open": func() error {
+			_, err := os.OpenFile(mnt+"/file", os.O_WRONLY, 0)
+			return err
+		},
+		"create": func() error { return ioutil.WriteFile(mnt+"/new", nil, 0644) },
+		"mkdir":  func() error { return os.Mkdir(mnt+"/dir", 0755) },
+		"chmod":  func() error { return os.Chmod(mnt+"/file", 0600) },
+		"unlink": func() error { return os.Remove(mnt + "/file") },
+		"rename": func() error { return os.Rename(mnt+"/file", mnt+"/other") },
+	} {
+		if err := op(); fuse.ToStatus(err) != fuse.EROFS {
+			t.Errorf("%s: got %v, want EROFS", name, err)
+		}
+	}
+	if _, err := os.Lstat(orig + "/file"); err != nil {
+		t.Errorf("backing file changed: %v", err)
+	}
+}
+
+func TestReadOnlyStatFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-readonly_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := nodefs.NewOptions()
+	opts.ReadOnly = true
+	pfs := pathfs.NewPathNodeFs(pathfs.NewLoopbackFileSystem(os.TempDir()), nil)
+	state, _, err := nodefs.MountFileSystem(dir, pfs, opts)
+	if err != nil {
+		t.Fatalf("MountFileSystem failed: %v", err)
+	}
+	state.SetDebug(fuse.VerboseTest())
+	go state.Serve()
+	defer state.Unmount()
+
+	var s syscall.Statfs_t
+	if err := syscall.Statfs(dir, &s); err != nil {
+		t.Fatalf("Statfs failed: %v", err)
+	}
+	const _ST_RDONLY = 1
+	if s.Flags&_ST_RDONLY == 0 {
+		t.Errorf("got statfs flags %x, want ST_RDONLY", s.Flags)
+	}
+}
@@ -0,0 +1,61 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/hanwen/go-fuse/raw"
+)
+
+func TestRename2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-rename2_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	orig := dir + "/orig"
+	mnt := dir + "/mnt"
+	os.Mkdir(orig, 0755)
+	os.Mkdir(mnt, 0755)
+
+	pfs := pathfs.NewPathNodeFs(pathfs.NewLoopbackFileSystem(orig), nil)
+	state, _, err := nodefs.MountFileSystem(mnt, pfs, nil)
+	if err != nil {
+		t.Fatalf("MountFileSystem failed: %v", err)
+	}
+	state.SetDebug(fuse.VerboseTest())
+	go state.Serve()
+	defer state.Unmount()
+
+	ioutil.WriteFile(mnt+"/a", []byte("a"), 0644)
+	ioutil.WriteFile(mnt+"/b", []byte("b"), 0644)
+
+	err = pathfs.Renameat2(mnt+"/a", mnt+"/b", raw.RENAME_NOREPLACE)
+	if err == syscall.EINVAL || err == syscall.ENOSYS {
+		t.Skipf("renameat2 not supported: %v", err)
+	}
+	if err != syscall.EEXIST {
+		t.Errorf("RENAME_NOREPLACE onto existing file: got %v, want EEXIST", err)
+	}
+
+	if err := pathfs.Renameat2(mnt+"/a", mnt+"/b", raw.RENAME_EXCHANGE); err != nil {
+		t.Fatalf("RENAME_EXCHANGE failed: %v", err)
+	}
+	for name, want := range map[string]string{"a": "b", "b": "a"} {
+		if c, err := ioutil.ReadFile(mnt + "/" + name); err != nil || string(c) != want {
+			t.Errorf("after exchange %s: got %q, %v, want %q", name, c, err, want)
+		}
+	}
+
+	if err := pathfs.Renameat2(mnt+"/a", mnt+"/c", raw.RENAME_NOREPLACE); err != nil {
+		t.Fatalf("RENAME_NOREPLACE failed: %v", err)
+	}
+	if _, err := os.Lstat(orig + "/c"); err != nil {
+		t.Errorf("Lstat after rename: %v", err)
+	}
+}
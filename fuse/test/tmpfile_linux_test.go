@@ -0,0 +1,107 @@
+package test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+const (
+	_O_TMPFILE         = 0x410000
+	_AT_SYMLINK_FOLLOW = 0x400
+)
+
+// publishTmpFile writes content to an O_TMPFILE file in dir, and
+// links it in as name.
+func publishTmpFile(t *testing.T, dir string, name string, content string) {
+	fd, err := syscall.Open(dir, _O_TMPFILE|syscall.O_RDWR, 0644)
+	if err == syscall.EOPNOTSUPP || err == syscall.EISDIR {
+		t.Skipf("O_TMPFILE not supported: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("Open(O_TMPFILE) failed: %v", err)
+	}
+	f := os.NewFile(uintptr(fd), "tmpfile")
+	defer f.Close()
+	if _, err := f.Write([]byte(content)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	oldp, _ := syscall.BytePtrFromString(fmt.Sprintf("/proc/self/fd/%d", fd))
+	newp, _ := syscall.BytePtrFromString(dir + "/" + name)
+	dirfd := -100
+	_, _, errNo := syscall.Syscall6(syscall.SYS_LINKAT,
+		uintptr(dirfd), uintptr(unsafe.Pointer(oldp)),
+		uintptr(dirfd), uintptr(unsafe.Pointer(newp)),
+		_AT_SYMLINK_FOLLOW, 0)
+	if errNo != 0 {
+		t.Fatalf("linkat failed: %v", errNo)
+	}
+}
+
+func testTmpFile(t *testing.T, fs nodefs.FileSystem, mnt string) {
+	state, _, err := nodefs.MountFileSystem(mnt, fs, nil)
+	if err != nil {
+		t.Fatalf("MountFileSystem failed: %v", err)
+	}
+	state.SetDebug(fuse.VerboseTest())
+	go state.Serve()
+	defer state.Unmount()
+
+	publishTmpFile(t, mnt, "published", "hello")
+
+	// A file that is never linked in leaves nothing behind.
+	fd, err := syscall.Open(mnt, _O_TMPFILE|syscall.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("Open(O_TMPFILE) failed: %v", err)
+	}
+	syscall.Write(fd, []byte("scratch"))
+	syscall.Close(fd)
+
+	if c, err := ioutil.ReadFile(mnt + "/published"); err != nil || string(c) != "hello" {
+		t.Errorf("ReadFile: got %q, %v, want %q", c, err, "hello")
+	}
+	names, err := ioutil.ReadDir(mnt)
+	if err != nil || len(names) != 1 {
+		t.Errorf("ReadDir: got %v, %v, want only the published file", names, err)
+	}
+}
+
+func TestTmpFileLoopback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-tmpfile_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(dir+"/orig", 0755)
+	os.Mkdir(dir+"/mnt", 0755)
+
+	testTmpFile(t, pathfs.NewPathNodeFs(pathfs.NewLoopbackFileSystem(dir+"/orig"), nil), dir+"/mnt")
+	if c, err := ioutil.ReadFile(dir + "/orig/published"); err != nil || string(c) != "hello" {
+		t.Errorf("ReadFile on backing dir: got %q, %v", c, err)
+	}
+}
+
+func TestTmpFileMemNodeFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-fuse-tmpfile_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(dir+"/mnt", 0755)
+
+	os.Mkdir(dir+"/backing", 0755)
+
+	testTmpFile(t, nodefs.NewMemNodeFs(dir+"/backing/"), dir+"/mnt")
+	backing, err := ioutil.ReadDir(dir + "/backing")
+	if err != nil || len(backing) != 1 {
+		t.Errorf("backing store: got %v, %v, want only the published file", backing, err)
+	}
+}
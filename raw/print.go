@@ -12,6 +12,7 @@ var releaseFlagNames map[int64]string
 var OpenFlagNames map[int64]string
 var FuseOpenFlagNames map[int64]string
 var accessFlagName map[int64]string
+var renameFlagNames map[int64]string
 var writeFlagNames map[int64]string
 var readFlagNames map[int64]string
 
@@ -39,6 +40,7 @@ func init() {
 		CAP_AUTO_INVAL_DATA:  "AUTO_INVAL_DATA",
 		CAP_READDIRPLUS:      "READDIRPLUS",
 		CAP_READDIRPLUS_AUTO: "READDIRPLUS_AUTO",
+		CAP_ASYNC_DIO:        "ASYNC_DIO",
 	}
 	releaseFlagNames = map[int64]string{
 		RELEASE_FLUSH: "FLUSH",
@@ -68,6 +70,11 @@ func init() {
 		W_OK: "w",
 		R_OK: "r",
 	}
+	renameFlagNames = map[int64]string{
+		RENAME_NOREPLACE: "NOREPLACE",
+		RENAME_EXCHANGE:  "EXCHANGE",
+		RENAME_WHITEOUT:  "WHITEOUT",
+	}
 
 }
 
@@ -221,6 +228,24 @@ func (o *NotifyInvalDeleteOut) String() string {
 	return fmt.Sprintf("{parent %d ch %d sz %d}", o.Parent, o.Child, o.NameLen)
 }
 
+func (in *Rename2In) String() string {
+	return fmt.Sprintf("{dir %d %s}", in.Newdir,
+		FlagString(renameFlagNames, int64(in.Flags), ""))
+}
+
+func (in *LseekIn) String() string {
+	return fmt.Sprintf("{Fh %d off %d whence %d}", in.Fh, in.Offset, in.Whence)
+}
+
+func (o *LseekOut) String() string {
+	return fmt.Sprintf("{off %d}", o.Offset)
+}
+
+func (in *CopyFileRangeIn) String() string {
+	return fmt.Sprintf("{Fh %d off %d => i%d Fh %d off %d sz %d}",
+		in.FhIn, in.OffIn, in.NodeIdOut, in.FhOut, in.OffOut, in.Len)
+}
+
 func (f *FallocateIn) String() string {
 	return fmt.Sprintf("{Fh %d off %d sz %d mod 0%o}",
 		f.Fh, f.Offset, f.Length, f.Mode)
@@ -26,6 +26,19 @@ type RenameIn struct {
 	Newdir uint64
 }
 
+const (
+	// Rename2In.Flags
+	RENAME_NOREPLACE = (1 << 0)
+	RENAME_EXCHANGE  = (1 << 1)
+	RENAME_WHITEOUT  = (1 << 2)
+)
+
+type Rename2In struct {
+	Newdir  uint64
+	Flags   uint32
+	Padding uint32
+}
+
 type LinkIn struct {
 	Oldnodeid uint64
 }
@@ -117,6 +130,7 @@ const (
 	CAP_AUTO_INVAL_DATA  = (1 << 12)
 	CAP_READDIRPLUS      = (1 << 13)
 	CAP_READDIRPLUS_AUTO = (1 << 14)
+	CAP_ASYNC_DIO        = (1 << 15)
 )
 
 type InitIn struct {
@@ -212,6 +226,33 @@ type WriteOut struct {
 	Padding uint32
 }
 
+const (
+	// LseekIn.Whence, in addition to the os.SEEK_* values.
+	SEEK_DATA = 3
+	SEEK_HOLE = 4
+)
+
+type LseekIn struct {
+	Fh      uint64
+	Offset  uint64
+	Whence  uint32
+	Padding uint32
+}
+
+type LseekOut struct {
+	Offset uint64
+}
+
+type CopyFileRangeIn struct {
+	FhIn      uint64
+	OffIn     uint64
+	NodeIdOut uint64
+	FhOut     uint64
+	OffOut    uint64
+	Len       uint64
+	Flags     uint64
+}
+
 type SetXAttrIn struct {
 	Size  uint32
 	Flags uint32
@@ -64,3 +64,66 @@ func CopyFds(dst *os.File, src *os.File) (err error) {
 	}
 	return err
 }
+
+// CopyRange copies up to n bytes from src at srcOff to dst at
+// dstOff, through a splice pair if one is available.  It returns the
+// number of bytes copied, which is less than n if src ends first.
+// Argument ordering follows io.Copy.
+func CopyRange(dst *os.File, dstOff int64, src *os.File, srcOff int64, n int64) (total int64, err error) {
+	p, _ := splicePool.get()
+	if p == nil {
+		return copyRangeBuffered(dst, dstOff, src, srcOff, n)
+	}
+	p.Grow(256 * 1024)
+	for total < n {
+		sz := p.size
+		if rem := n - total; rem < int64(sz) {
+			sz = int(rem)
+		}
+		m, err := p.LoadFromAt(src.Fd(), sz, srcOff+total)
+		if err != nil {
+			splicePool.done(p)
+			return total, err
+		}
+		if m == 0 {
+			break
+		}
+		for m > 0 {
+			w, err := p.WriteToAt(dst.Fd(), m, dstOff+total)
+			total += int64(w)
+			m -= w
+			if err != nil {
+				// The pipe may still hold data.
+				splicePool.drop(p)
+				return total, err
+			}
+		}
+	}
+	splicePool.done(p)
+	return total, nil
+}
+
+func copyRangeBuffered(dst *os.File, dstOff int64, src *os.File, srcOff int64, n int64) (total int64, err error) {
+	buf := make([]byte, 64*1024)
+	for total < n {
+		sz := len(buf)
+		if rem := n - total; rem < int64(sz) {
+			sz = int(rem)
+		}
+		m, err := src.ReadAt(buf[:sz], srcOff+total)
+		if m > 0 {
+			w, err := dst.WriteAt(buf[:m], dstOff+total)
+			total += int64(w)
+			if err != nil {
+				return total, err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
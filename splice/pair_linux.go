@@ -31,3 +31,11 @@ func (p *Pair) WriteTo(fd uintptr, n int) (int, error) {
 	}
 	return int(m), err
 }
+
+func (p *Pair) WriteToAt(fd uintptr, n int, off int64) (int, error) {
+	m, err := syscall.Splice(int(p.r.Fd()), nil, int(fd), &off, int(n), 0)
+	if err != nil {
+		err = os.NewSyscallError("Splice write", err)
+	}
+	return int(m), err
+}
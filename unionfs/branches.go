@@ -0,0 +1,364 @@
+package unionfs
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// BranchController changes the read-only branches of a union while
+// it is mounted.  The file system returned by NewUnionFs implements
+// it.  Indices are those of the branch list, as passed to
+// NewUnionFs; the writable branches stay in place.
+//
+// A change waits for running file system calls to complete, drops
+// the caches of the union, and tells the kernel to forget the entries
+// and attributes it cached.  Files that are open keep reading the
+// branch they were opened on.
+//
+// Lazy and metadata-only copy-ups refer to their read-only branch by
+// name, which is its description as listed in the control file, so
+// the branches must be described the same way across mounts.
+// Removing a branch waits for the lazy copy-ups from it to complete,
+// and fails while the writable branches still need its data, for
+// interrupted copy-ups or placeholders.
+type BranchController interface {
+	// Branches returns all branches, in order.
+	Branches() []pathfs.FileSystem
+
+	// InsertBranch inserts fs as a read-only branch at index i.
+	// i may be the number of branches, to add a bottom branch.
+	InsertBranch(i int, fs pathfs.FileSystem) error
+
+	// RemoveBranch removes the read-only branch at index i.
+	RemoveBranch(i int) error
+
+	// ReorderBranches orders the read-only branches as listed in
+	// order, which holds their current indices, top first.
+	ReorderBranches(order []int) error
+}
+
+func (fs *unionFS) Branches() []pathfs.FileSystem {
+	fs.branchLock.RLock()
+	defer fs.branchLock.RUnlock()
+	return append([]pathfs.FileSystem{}, fs.fileSystems...)
+}
+
+// firstReadonly returns the index of the topmost read-only branch.
+func (fs *unionFS) firstReadonly() int {
+	i := 0
+	for i < len(fs.modes) && fs.modes[i] != BranchRO {
+		i++
+	}
+	return i
+}
+
+func (fs *unionFS) InsertBranch(i int, b pathfs.FileSystem) error {
+	return fs.changeBranches(func(ro []pathfs.FileSystem, first int) ([]pathfs.FileSystem, error) {
+		if i < first || i > first+len(ro) {
+			return nil, fmt.Errorf("cannot insert a read-only branch at %d", i)
+		}
+		i -= first
+		return append(ro[:i:i], append([]pathfs.FileSystem{b}, ro[i:]...)...), nil
+	})
+}
+
+func (fs *unionFS) RemoveBranch(i int) error {
+	return fs.changeBranches(func(ro []pathfs.FileSystem, first int) ([]pathfs.FileSystem, error) {
+		if i < first || i >= first+len(ro) {
+			return nil, fmt.Errorf("no read-only branch %d", i)
+		}
+		i -= first
+		return append(ro[:i:i], ro[i+1:]...), nil
+	})
+}
+
+func (fs *unionFS) ReorderBranches(order []int) error {
+	return fs.changeBranches(func(ro []pathfs.FileSystem, first int) ([]pathfs.FileSystem, error) {
+		if len(order) != len(ro) {
+			return nil, fmt.Errorf("got %d branches, want %d", len(order), len(ro))
+		}
+		seen := map[int]bool{}
+		var r []pathfs.FileSystem
+		for _, i := range order {
+			if i < first || i >= first+len(ro) || seen[i] {
+				return nil, fmt.Errorf("bad branch order %v", order)
+			}
+			seen[i] = true
+			r = append(r, ro[i-first])
+		}
+		return r, nil
+	})
+}
+
+// branchName returns the name under which copy-ups refer to branch i.
+func (fs *unionFS) branchName(i int) string {
+	return fs.fileSystems[i].String()
+}
+
+// readOnlyBranch returns the index of the read-only branch with the
+// given name, or -1.
+func (fs *unionFS) readOnlyBranch(name string) int {
+	for i := fs.firstReadonly(); i < len(fs.fileSystems); i++ {
+		if fs.branchName(i) == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// isRetiring returns whether branch i is being removed.
+func (fs *unionFS) isRetiring(i int) bool {
+	fs.copyUpMutex.Lock()
+	defer fs.copyUpMutex.Unlock()
+	return fs.retiring[fs.branchName(i)]
+}
+
+// changeBranches replaces the read-only branches by what change
+// returns for the current ones, the first of which has index first.
+func (fs *unionFS) changeBranches(change func(ro []pathfs.FileSystem, first int) ([]pathfs.FileSystem, error)) error {
+	fs.branchChangeMutex.Lock()
+	defer fs.branchChangeMutex.Unlock()
+
+	fs.branchLock.RLock()
+	first := fs.firstReadonly()
+	old := fs.fileSystems[first:]
+	ro, err := change(old, first)
+	if err == nil {
+		err = fs.retire(old, ro)
+	}
+	fs.branchLock.RUnlock()
+	defer func() {
+		fs.copyUpMutex.Lock()
+		fs.retiring = nil
+		fs.copyUpMutex.Unlock()
+	}()
+	if err != nil {
+		return err
+	}
+
+	// Branch changes are serialized, so old and ro still apply.
+	fs.branchLock.Lock()
+	fses := append(fs.fileSystems[:first:first], ro...)
+	modes := append(fs.modes[:first:first], make([]BranchMode, len(ro))...)
+	for i := first; i < len(fses); i++ {
+		modes[i] = BranchRO
+	}
+	fs.fileSystems = fses
+	fs.modes = modes
+	fs.roDeletions = fs.newRoDeletions(fses)
+	fs.branchCache.DropAll(nil)
+	fs.deletionCache.DropCache()
+	fs.dropLinks()
+	log.Printf("Changed branches: %v", fs)
+	fs.branchLock.Unlock()
+
+	fs.invalidateKernel(append(append([]pathfs.FileSystem{}, old...), ro...))
+	return nil
+}
+
+// retire prepares the removal of the branches of old that are not
+// in ro, and fails if files in the writable branches still need them.
+// It must be called with branchLock held for reading.
+func (fs *unionFS) retire(old, ro []pathfs.FileSystem) error {
+	removed := map[string]bool{}
+	for _, b := range old {
+		removed[b.String()] = true
+	}
+	for _, b := range ro {
+		delete(removed, b.String())
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+
+	fs.copyUpMutex.Lock()
+	fs.retiring = removed
+	var todo []*copyUp
+	for _, cu := range fs.copyUps {
+		if removed[cu.source] {
+			todo = append(todo, cu)
+		}
+	}
+	fs.copyUpMutex.Unlock()
+
+	// The copy-ups finish without branchLock.  No new ones start
+	// from the removed branches, except when an interrupted one
+	// is resumed, which leaves its xattr for findReferences.
+	for _, cu := range todo {
+		<-cu.finished
+	}
+	for i := 0; i < fs.firstReadonly(); i++ {
+		if err := fs.findReferences(i, "", removed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findReferences returns an error for the first file below dir in
+// the writable branch w that needs data from the removed branches.
+// Files that are renamed meanwhile may be missed.
+func (fs *unionFS) findReferences(w int, dir string, removed map[string]bool) error {
+	stream, code := fs.fileSystems[w].OpenDir(dir, nil)
+	if !code.Ok() {
+		return fmt.Errorf("OpenDir(%q): %v", dir, code)
+	}
+	for _, e := range stream {
+		name := filepath.Join(dir, e.Name)
+		if dir == "" && e.Name == fs.options.DeletionDirName {
+			continue
+		}
+		switch {
+		case e.Mode&syscall.S_IFMT == syscall.S_IFDIR:
+			if err := fs.findReferences(w, name, removed); err != nil {
+				return err
+			}
+		case e.Mode&syscall.S_IFMT == syscall.S_IFREG:
+			var source string
+			if data, code := fs.fileSystems[w].GetXAttr(name, copyUpXAttr, nil); code.Ok() {
+				fmt.Sscanf(string(data), "%q", &source)
+			} else if data, code := fs.fileSystems[w].GetXAttr(name, metaCopyXAttr, nil); code.Ok() {
+				source, _, _ = decodeMetaCopy(data)
+			}
+			if removed[source] {
+				return fmt.Errorf("%s is used by %q", source, name)
+			}
+		}
+	}
+	return nil
+}
+
+// invalidateKernel makes the kernel look up everything again.  The
+// entries of changed are invalidated too, in case the kernel cached
+// their absence.
+func (fs *unionFS) invalidateKernel(changed []pathfs.FileSystem) {
+	if fs.nodeFs == nil {
+		return
+	}
+	fs.nodeFs.ForgetClientInodes()
+	fs.notifyTree("", fs.nodeFs.Root().Inode(), changed)
+}
+
+func (fs *unionFS) notifyTree(dir string, node *nodefs.Inode, changed []pathfs.FileSystem) {
+	names := map[string]bool{}
+	for _, b := range changed {
+		stream, _ := b.OpenDir(dir, nil)
+		for _, e := range stream {
+			names[e.Name] = true
+		}
+	}
+	children := node.Children()
+	for name := range children {
+		names[name] = true
+	}
+
+	for name := range names {
+		p := filepath.Join(dir, name)
+		if fs.isControlFile(p) {
+			// Invalidating it could wait for the write
+			// that got us here.  It is opened with direct
+			// I/O, so there is nothing to invalidate.
+			continue
+		}
+		if child := children[name]; child != nil {
+			if child.IsDir() {
+				fs.notifyTree(p, child, changed)
+			}
+			fs.nodeFs.FileNotify(p, 0, 0)
+		}
+		fs.nodeFs.EntryNotify(dir, name)
+	}
+	fs.nodeFs.FileNotify(dir, 0, 0)
+}
+
+func (fs *unionFS) isControlFile(name string) bool {
+	return name != "" && name == fs.options.BranchControlFile
+}
+
+// branchListing returns the contents of the control file: a line
+// with index, mode and name for each branch.  It must be called with
+// branchLock held.
+func (fs *unionFS) branchListing() string {
+	var b bytes.Buffer
+	for i := range fs.fileSystems {
+		fmt.Fprintln(&b, fs.branchLine(i))
+	}
+	return b.String()
+}
+
+func (fs *unionFS) branchLine(i int) string {
+	return fmt.Sprintf("%d %v %s", i, fs.modes[i], fs.fileSystems[i].String())
+}
+
+// branchCommand runs a line written to the control file:
+//
+//	add INDEX DIRECTORY
+//	remove INDEX
+//	order INDEX...
+func (fs *unionFS) branchCommand(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	cmd, rest := fields[0], fields[1:]
+	var dir string
+	if cmd == "add" && len(rest) == 2 {
+		dir, rest = rest[1], rest[:1]
+	}
+	args := make([]int, len(rest))
+	for i, f := range rest {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return err
+		}
+		args[i] = n
+	}
+
+	switch {
+	case cmd == "add" && dir != "":
+		b, err := NewRootFileSystem(dir)
+		if err != nil {
+			return err
+		}
+		return fs.InsertBranch(args[0], b)
+	case cmd == "remove" && len(args) == 1:
+		return fs.RemoveBranch(args[0])
+	case cmd == "order":
+		return fs.ReorderBranches(args)
+	}
+	return fmt.Errorf("bad command %q", line)
+}
+
+// controlFile reads as the branch listing, and runs the commands
+// written to it, one per line.
+type controlFile struct {
+	nodefs.File
+	ufs *unionFS
+}
+
+func (f *controlFile) String() string {
+	return fmt.Sprintf("controlFile(%s)", f.ufs.options.BranchControlFile)
+}
+
+func (f *controlFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	for _, line := range strings.Split(string(data), "\n") {
+		if err := f.ufs.branchCommand(line); err != nil {
+			log.Printf("branch command %q: %v", line, err)
+			return 0, fuse.EINVAL
+		}
+	}
+	return uint32(len(data)), fuse.OK
+}
+
+func (f *controlFile) Truncate(size uint64) fuse.Status {
+	return fuse.OK
+}
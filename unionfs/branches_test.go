@@ -0,0 +1,140 @@
+package unionfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+func TestUnionFsBranchControl(t *testing.T) {
+	opts := testOpts
+	opts.BranchControlFile = ".branches"
+	wd, clean := setupUfsWithOptions(t, opts)
+	defer clean()
+
+	if err := os.Mkdir(wd+"/extra", 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	WriteFile(t, wd+"/ro/file", "ro")
+	WriteFile(t, wd+"/ro/ro-only", "ro")
+	WriteFile(t, wd+"/extra/file", "extra")
+	WriteFile(t, wd+"/extra/extra-only", "extra")
+
+	control := wd + "/mnt/.branches"
+	if got := readFromFile(t, control); strings.Count(got, "\n") != 2 {
+		t.Fatalf("got listing %q, want 2 branches", got)
+	}
+	checkExists(t, wd+"/mnt/extra-only", false)
+
+	command := func(c string) error {
+		return ioutil.WriteFile(control, []byte(c+"\n"), 0644)
+	}
+	if err := command("add 1 " + wd + "/extra"); err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	if got := readFromFile(t, wd+"/mnt/file"); got != "extra" {
+		t.Errorf("after add: got %q, want %q", got, "extra")
+	}
+	checkExists(t, wd+"/mnt/extra-only", true)
+	if got := readFromFile(t, control); !strings.Contains(got, "1 RO LoopbackFs("+wd+"/extra)") {
+		t.Errorf("got listing %q", got)
+	}
+
+	if err := command("order 2 1"); err != nil {
+		t.Fatalf("order failed: %v", err)
+	}
+	if got := readFromFile(t, wd+"/mnt/file"); got != "ro" {
+		t.Errorf("after order: got %q, want %q", got, "ro")
+	}
+
+	if err := command("remove 1"); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	if got := readFromFile(t, wd+"/mnt/file"); got != "extra" {
+		t.Errorf("after remove: got %q, want %q", got, "extra")
+	}
+	checkExists(t, wd+"/mnt/ro-only", false)
+
+	for _, c := range []string{"remove 0", "order 1 1", "add 1 " + wd + "/nonexistent", "bogus"} {
+		if err := command(c); err == nil {
+			t.Errorf("%q succeeded", c)
+		}
+	}
+}
+
+func TestUnionFsBranchControlConcurrentLink(t *testing.T) {
+	opts := testOpts
+	opts.BranchControlFile = ".branches"
+	wd, clean := setupUfsWithOptions(t, opts)
+	defer clean()
+
+	const n = 50
+	for i := 0; i < n; i++ {
+		WriteFile(t, fmt.Sprintf("%s/ro/file%d", wd, i), "ro")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			ioutil.WriteFile(wd+"/mnt/.branches", []byte("order 1\n"), 0644)
+		}
+	}()
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("%s/mnt/file%d", wd, i)
+		if err := os.Link(name, name+"-link"); err != nil {
+			t.Errorf("Link failed: %v", err)
+		}
+	}
+	<-done
+}
+
+func TestUnionFsRemoveBranchInUse(t *testing.T) {
+	wd, err := ioutil.TempDir("", "unionfs")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(wd)
+	var fses []pathfs.FileSystem
+	for _, d := range []string{"rw", "ro1", "ro2", "extra"} {
+		os.Mkdir(wd+"/"+d, 0755)
+		WriteFile(t, wd+"/"+d+"/file", d)
+		fses = append(fses, pathfs.NewLoopbackFileSystem(wd+"/"+d))
+	}
+	WriteFile(t, wd+"/rw/meta", "")
+	WriteFile(t, wd+"/rw/lazy", "")
+	if err := syscall.Setxattr(wd+"/rw/meta", metaCopyXAttr, encodeMetaCopy(fses[2].String(), "file"), 0); err != nil {
+		t.Skipf("no user xattrs on %s: %v", wd, err)
+	}
+	state := fmt.Sprintf("%q 4096 2 0 %q\n\x00", fses[3].String(), "file")
+	if err := syscall.Setxattr(wd+"/rw/lazy", copyUpXAttr, []byte(state), 0); err != nil {
+		t.Fatalf("Setxattr failed: %v", err)
+	}
+
+	ufs := NewUnionFs(fses[:3], testOpts).(*unionFS)
+	if err := ufs.InsertBranch(1, fses[3]); err != nil {
+		t.Fatalf("InsertBranch failed: %v", err)
+	}
+	// Branches are recorded by name, not by index.
+	if b, _, _, _ := ufs.metaCopySource("meta", 0); b != 3 {
+		t.Errorf("got data in branch %d, want 3", b)
+	}
+
+	for _, i := range []int{1, 3} {
+		if err := ufs.RemoveBranch(i); err == nil {
+			t.Errorf("RemoveBranch(%d) succeeded while in use", i)
+		}
+	}
+	if err := ufs.RemoveBranch(2); err != nil {
+		t.Errorf("RemoveBranch(2) failed: %v", err)
+	}
+	os.Remove(wd + "/rw/lazy")
+	if err := ufs.RemoveBranch(1); err != nil {
+		t.Errorf("RemoveBranch(1) failed: %v", err)
+	}
+}
@@ -0,0 +1,646 @@
+package unionfs
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// ChangeKind says how an entry of a changeset differs from the
+// read-only branches.
+type ChangeKind int
+
+const (
+	ChangeAdded = ChangeKind(iota)
+	ChangeModified
+	ChangeDeleted
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeAdded:
+		return "A"
+	case ChangeModified:
+		return "M"
+	case ChangeDeleted:
+		return "D"
+	}
+	return fmt.Sprintf("ChangeKind(%d)", int(k))
+}
+
+// Change is an entry that differs between the union and its
+// read-only branches.
+type Change struct {
+	Kind ChangeKind
+	Path string
+
+	// The attributes in the union, and for symlinks, the target.
+	// Unset for deletions.
+	Attr *fuse.Attr
+	Link string
+
+	// For directories: whether the entries of the read-only
+	// branches are hidden.
+	Opaque bool
+
+	// The writable branch the entry comes from.
+	Branch int
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%v %s", c.Kind, c.Path)
+}
+
+type changesByPath []Change
+
+func (c changesByPath) Len() int           { return len(c) }
+func (c changesByPath) Less(i, j int) bool { return c[i].Path < c[j].Path }
+func (c changesByPath) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// Changeset lists what the writable branches of a union change
+// relative to its read-only branches.
+type Changeset struct {
+	// Sorted by path, so directories come before their contents.
+	Changes []Change
+
+	fs *unionFS
+}
+
+// Diff computes the changeset of the union of branches, with the
+// same options as NewUnionFs.  The branches should not be modified
+// meanwhile.  Files that are still being copied up lazily, or that
+// only had their metadata copied, are supported.
+func Diff(branches []pathfs.FileSystem, options UnionFsOptions) (*Changeset, error) {
+	modes, err := branchModes(options.BranchModes, len(branches))
+	if err != nil {
+		return nil, err
+	}
+	d := &differ{fs: newReadOnlyUnion(branches, options, modes)}
+	for d.nw < len(modes) && modes[d.nw] != BranchRO {
+		d.nw++
+	}
+	d.lower = newLowerFs(branches[d.nw:], options)
+
+	if err := d.walk("", false); err != nil {
+		return nil, err
+	}
+	if err := d.markers(); err != nil {
+		return nil, err
+	}
+	sort.Sort(changesByPath(d.changes))
+
+	// Deletions below a deleted directory are implied.
+	cs := &Changeset{fs: d.fs}
+	var deleted []string
+	for _, c := range d.changes {
+		covered := false
+		for _, p := range deleted {
+			if strings.HasPrefix(c.Path, p+"/") {
+				covered = true
+			}
+		}
+		if covered {
+			continue
+		}
+		if c.Kind == ChangeDeleted {
+			deleted = append(deleted, c.Path)
+		}
+		cs.Changes = append(cs.Changes, c)
+	}
+	return cs, nil
+}
+
+// newLowerFs returns a union of the read-only branches only, for
+// looking up what they contain.
+func newLowerFs(branches []pathfs.FileSystem, options UnionFsOptions) *unionFS {
+	modes := make([]BranchMode, len(branches))
+	for i := range branches {
+		modes[i] = BranchRO
+	}
+	return newReadOnlyUnion(branches, options, modes)
+}
+
+// newReadOnlyUnion returns a union of branches with the given modes
+// that is only read from, so it has no deletion store or copy-ups.
+func newReadOnlyUnion(branches []pathfs.FileSystem, options UnionFsOptions, modes []BranchMode) *unionFS {
+	fs := &unionFS{
+		fileSystems: branches,
+		options:     &options,
+		modes:       modes,
+	}
+	fs.dropLinks()
+	fs.roDeletions = fs.newRoDeletions(branches)
+	fs.branchCache = NewTimedCache(
+		func(n string) (interface{}, bool) { return fs.getBranchAttrNoCache(n), true }, 0)
+	return fs
+}
+
+type differ struct {
+	fs    *unionFS
+	lower *unionFS
+
+	// Number of writable branches.
+	nw int
+
+	changes []Change
+}
+
+// lowerAttr returns the attributes of name in the read-only branches,
+// and its target if it is a symlink.
+func (d *differ) lowerAttr(name string) (*fuse.Attr, string) {
+	r := d.lower.getBranch(name)
+	if !r.code.Ok() {
+		return nil, ""
+	}
+	var link string
+	if r.attr.IsSymlink() {
+		link, _ = d.lower.fileSystems[r.branch].Readlink(name, nil)
+	}
+	return r.attr, link
+}
+
+// walk adds the changes below the directory dir.  If lowerHidden is
+// set, the read-only branches do not contribute to dir.
+func (d *differ) walk(dir string, lowerHidden bool) error {
+	seen := map[string]bool{}
+	for i := 0; i < d.nw; i++ {
+		b := d.fs.fileSystems[i]
+		a, code := b.GetAttr(dir, nil)
+		if code == fuse.ENOENT {
+			continue
+		}
+		if !code.Ok() {
+			return fmt.Errorf("GetAttr(%q): %v", dir, code)
+		}
+		if !a.IsDir() {
+			break
+		}
+		stream, code := b.OpenDir(dir, nil)
+		if !code.Ok() {
+			return fmt.Errorf("OpenDir(%q): %v", dir, code)
+		}
+		for _, e := range stream {
+			if seen[e.Name] || (dir == "" && e.Name == d.fs.options.DeletionDirName) {
+				continue
+			}
+			seen[e.Name] = true
+			if err := d.entry(filepath.Join(dir, e.Name), i, lowerHidden); err != nil {
+				return err
+			}
+		}
+		if d.fs.isOpaque(i, dir) {
+			break
+		}
+	}
+	return nil
+}
+
+// entry adds the change for name, found first in writable branch i.
+func (d *differ) entry(name string, i int, lowerHidden bool) error {
+	b := d.fs.fileSystems[i]
+	a, code := b.GetAttr(name, nil)
+	if !code.Ok() {
+		return fmt.Errorf("GetAttr(%q): %v", name, code)
+	}
+	var lower *fuse.Attr
+	var lowerLink string
+	if !lowerHidden {
+		lower, lowerLink = d.lowerAttr(name)
+	}
+
+	if d.fs.isWhiteout(i, a) {
+		if lower != nil {
+			d.changes = append(d.changes, Change{Kind: ChangeDeleted, Path: name, Branch: i})
+		}
+		return nil
+	}
+
+	c := Change{Path: name, Attr: a, Branch: i}
+	if a.IsSymlink() {
+		if c.Link, code = b.Readlink(name, nil); !code.Ok() {
+			return fmt.Errorf("Readlink(%q): %v", name, code)
+		}
+	}
+	if a.IsRegular() {
+		d.fs.setMetaCopyAttr(name, i, a)
+	}
+	if a.IsDir() {
+		c.Opaque = d.fs.isOpaque(i, name)
+	}
+
+	changed := true
+	switch {
+	case lower == nil:
+		c.Kind = ChangeAdded
+	case attrChanged(a, lower) || c.Link != lowerLink || c.Opaque:
+		c.Kind = ChangeModified
+	default:
+		changed = false
+	}
+	if changed {
+		d.changes = append(d.changes, c)
+	}
+
+	if a.IsDir() {
+		return d.walk(name, lower == nil || !lower.IsDir() || c.Opaque)
+	}
+	return nil
+}
+
+// attrChanged returns whether a differs from the read-only entry b.
+// The contents of directories are compared separately.
+func attrChanged(a *fuse.Attr, b *fuse.Attr) bool {
+	if a.Mode != b.Mode || a.Uid != b.Uid || a.Gid != b.Gid {
+		return true
+	}
+	switch {
+	case a.IsDir():
+		return false
+	case a.IsRegular():
+		return a.Size != b.Size || a.Mtime != b.Mtime || a.Mtimensec != b.Mtimensec
+	}
+	return a.Rdev != b.Rdev
+}
+
+// markers adds the deletions recorded in the deletion store.
+func (d *differ) markers() error {
+	if d.fs.overlayWhiteouts() || d.fs.options.DeletionDirName == "" {
+		return nil
+	}
+	writable := d.fs.fileSystems[0]
+	stream, code := writable.OpenDir(d.fs.options.DeletionDirName, nil)
+	if code == fuse.ENOENT {
+		return nil
+	}
+	if !code.Ok() {
+		return fmt.Errorf("OpenDir(%q): %v", d.fs.options.DeletionDirName, code)
+	}
+	for _, e := range stream {
+		name, err := readMarker(writable, filepath.Join(d.fs.options.DeletionDirName, e.Name))
+		if err != nil {
+			return err
+		}
+		if len(d.fs.branchesWith(name)) > 0 {
+			// Recreated, and found by walk.
+			continue
+		}
+		if a, _ := d.lowerAttr(name); a != nil {
+			d.changes = append(d.changes, Change{Kind: ChangeDeleted, Path: name})
+		}
+	}
+	return nil
+}
+
+// WriteTar writes the changeset as an image layer tarball, as read by
+// NewLayerFileSystem: deletions are AUFS whiteouts (.wh.NAME), and
+// opaque directories contain a .wh..wh..opq marker.  Regular files
+// that are hard linked to each other are stored as links.
+func (cs *Changeset) WriteTar(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	links := map[[2]uint64]string{}
+	for _, c := range cs.Changes {
+		if err := cs.writeChange(tw, c, links); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func (cs *Changeset) writeChange(tw *tar.Writer, c Change, links map[[2]uint64]string) error {
+	if c.Kind == ChangeDeleted {
+		dir, base := filepath.Split(c.Path)
+		return tw.WriteHeader(&tar.Header{
+			Name:     dir + aufsWhiteoutPrefix + base,
+			Typeflag: tar.TypeReg,
+		})
+	}
+
+	a := c.Attr
+	hdr := &tar.Header{
+		Name:    c.Path,
+		Mode:    int64(a.Mode & 07777),
+		Uid:     int(a.Uid),
+		Gid:     int(a.Gid),
+		ModTime: a.ModTime(),
+		Format:  tar.FormatPAX,
+	}
+	switch a.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case syscall.S_IFLNK:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = c.Link
+	case syscall.S_IFCHR, syscall.S_IFBLK, syscall.S_IFIFO:
+		hdr.Typeflag = tar.TypeFifo
+		if a.IsChar() {
+			hdr.Typeflag = tar.TypeChar
+		} else if a.IsBlock() {
+			hdr.Typeflag = tar.TypeBlock
+		}
+		hdr.Devmajor = devMajor(a.Rdev)
+		hdr.Devminor = devMinor(a.Rdev)
+	case syscall.S_IFREG:
+		key := [2]uint64{uint64(c.Branch), a.Ino}
+		if first, ok := links[key]; ok && a.Nlink > 1 {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			return tw.WriteHeader(hdr)
+		}
+		links[key] = c.Path
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = int64(a.Size)
+	default:
+		return fmt.Errorf("%s: unsupported file type %o", c.Path, a.Mode&syscall.S_IFMT)
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if hdr.Typeflag == tar.TypeReg {
+		return cs.fs.writeData(tw, c.Path, c.Branch, hdr.Size)
+	}
+	if c.Opaque {
+		return tw.WriteHeader(&tar.Header{
+			Name:     filepath.Join(c.Path, aufsOpaqueMarker),
+			Typeflag: tar.TypeReg,
+		})
+	}
+	return nil
+}
+
+// writeData writes size bytes of the regular file name in writable
+// branch w, reading the data that was not copied up yet from the
+// read-only branches.
+func (fs *unionFS) writeData(out io.Writer, name string, w int, size int64) error {
+	src, origin := fs.fileSystems[w], name
+	b, o, _, code := fs.metaCopySource(name, w)
+	if !code.Ok() {
+		return fmt.Errorf("%s: placeholder data: %v", name, code)
+	}
+	if b >= 0 {
+		src, origin = fs.fileSystems[b], o
+	}
+	f, code := src.Open(origin, uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		return fmt.Errorf("Open(%q): %v", origin, code)
+	}
+	defer f.Release()
+
+	read := f.Read
+	if data, code := fs.fileSystems[w].GetXAttr(name, copyUpXAttr, nil); code.Ok() {
+		cu := &copyUp{ufs: fs, name: name, target: w}
+		if err := decodeCopyUp(data, cu); err != nil {
+			return fmt.Errorf("%s: bad copy-up state %q: %v", name, data, err)
+		}
+		cu.src, code = fs.fileSystems[cu.branch].Open(cu.origin, uint32(os.O_RDONLY), nil)
+		if !code.Ok() {
+			return fmt.Errorf("Open(%q): %v", cu.origin, code)
+		}
+		defer cu.src.Release()
+		read = func(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+			return cu.read(f, dest, off)
+		}
+	}
+
+	buf := make([]byte, 128<<10)
+	for off := int64(0); off < size; {
+		n := int64(len(buf))
+		if n > size-off {
+			n = size - off
+		}
+		res, code := read(buf[:n], off)
+		if !code.Ok() {
+			return fmt.Errorf("Read(%q): %v", name, code)
+		}
+		data, code := res.Bytes(buf[:n])
+		if code.Ok() && len(data) == 0 {
+			code = fuse.EIO
+		}
+		if !code.Ok() {
+			res.Done()
+			return fmt.Errorf("Read(%q) at %d: %v", name, off, code)
+		}
+		_, err := out.Write(data)
+		res.Done()
+		if err != nil {
+			return err
+		}
+		off += int64(len(data))
+	}
+	return nil
+}
+
+// ApplyChangeset applies an image layer tarball, such as one written
+// by Changeset.WriteTar, to the directory dir, which typically is the
+// lowest branch of the union.  Whiteouts remove entries, opaque
+// markers remove everything in their directory that the tarball does
+// not provide, and other entries replace what is in dir, except that
+// directories are merged.  Entries below a symlink in dir are
+// refused, as they could end up outside of dir.  Ownership is only
+// restored when running as root.
+func ApplyChangeset(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	written := map[string]bool{}
+	var opaque []string
+	var dirs []*tar.Header
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name, err := changesetPath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			continue
+		}
+		parent, base := filepath.Split(name)
+		// Earlier entries may have put symlinks in the way.
+		if err := checkSymlinks(dir, parent); err != nil {
+			return err
+		}
+		if base == aufsOpaqueMarker {
+			opaque = append(opaque, stripSlash(parent))
+			continue
+		}
+		if strings.HasPrefix(base, aufsWhiteoutPrefix) {
+			if err := os.RemoveAll(filepath.Join(dir, parent, base[len(aufsWhiteoutPrefix):])); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Join(dir, parent), 0755); err != nil {
+			return err
+		}
+		if err := applyEntry(tr, hdr, dir, name); err != nil {
+			return err
+		}
+		written[name] = true
+		if hdr.Typeflag == tar.TypeDir {
+			h := *hdr
+			h.Name = name
+			dirs = append(dirs, &h)
+		}
+	}
+
+	for _, d := range opaque {
+		if err := checkSymlinks(dir, d); err != nil {
+			return err
+		}
+		if err := removeUnwritten(dir, d, written); err != nil {
+			return err
+		}
+	}
+
+	// Creating entries changes the times of their directory, so
+	// these go last.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		target := filepath.Join(dir, dirs[i].Name)
+		if err := checkSymlinks(dir, dirs[i].Name); err != nil {
+			return err
+		}
+		if err := os.Chtimes(target, dirs[i].ModTime, dirs[i].ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSymlinks returns an error if name, or a directory leading to
+// it, is a symlink in dir.  Writing through it could change files
+// outside of dir.
+func checkSymlinks(dir string, name string) error {
+	p := dir
+	for _, c := range strings.Split(name, "/") {
+		if c == "" {
+			continue
+		}
+		p = filepath.Join(p, c)
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s: path goes through symlink %s", name, p)
+		}
+	}
+	return nil
+}
+
+// changesetPath returns the cleaned relative path of a tarball entry.
+func changesetPath(name string) (string, error) {
+	name = strings.Trim(filepath.Clean("/"+name), "/")
+	if strings.Contains("/"+name+"/", "/../") {
+		return "", fmt.Errorf("bad path %q", name)
+	}
+	return name, nil
+}
+
+// applyEntry creates the entry name below dir from hdr.
+func applyEntry(tr *tar.Reader, hdr *tar.Header, dir string, name string) error {
+	target := filepath.Join(dir, name)
+	if fi, err := os.Lstat(target); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(target, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		orig, err := changesetPath(hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		origDir, _ := filepath.Split(orig)
+		if err := checkSymlinks(dir, origDir); err != nil {
+			return err
+		}
+		return os.Link(filepath.Join(dir, orig), target)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		mode := tarDeviceType(hdr.Typeflag) | uint32(hdr.Mode&07777)
+		if err := syscall.Mknod(target, mode, int(mkdev(hdr.Devmajor, hdr.Devminor))); err != nil {
+			return &os.PathError{Op: "mknod", Path: target, Err: err}
+		}
+	default:
+		return fmt.Errorf("%s: unsupported entry type %q", hdr.Name, hdr.Typeflag)
+	}
+
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	if err := syscall.Chmod(target, uint32(hdr.Mode&07777)); err != nil {
+		return &os.PathError{Op: "chmod", Path: target, Err: err}
+	}
+	return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+}
+
+// removeUnwritten removes the entries below the directory name in
+// dir that are not in written.
+func removeUnwritten(dir string, name string, written map[string]bool) error {
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		p := filepath.Join(name, n)
+		if !written[p] {
+			if err := os.RemoveAll(filepath.Join(dir, p)); err != nil {
+				return err
+			}
+			continue
+		}
+		if fi, err := os.Lstat(filepath.Join(dir, p)); err == nil && fi.IsDir() {
+			if err := removeUnwritten(dir, p, written); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
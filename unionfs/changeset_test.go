@@ -0,0 +1,228 @@
+package unionfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+func diffUfs(t *testing.T, wd string, opts UnionFsOptions) *Changeset {
+	fses := []pathfs.FileSystem{
+		pathfs.NewLoopbackFileSystem(wd + "/rw"),
+		pathfs.NewLoopbackFileSystem(wd + "/ro"),
+	}
+	cs, err := Diff(fses, opts)
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+	return cs
+}
+
+func checkChanges(t *testing.T, cs *Changeset, want map[string]ChangeKind) {
+	got := map[string]ChangeKind{}
+	for _, c := range cs.Changes {
+		got[c.Path] = c.Kind
+	}
+	for p, k := range want {
+		if g, ok := got[p]; !ok || g != k || len(got) != len(want) {
+			t.Errorf("got changes %v, want %v", got, want)
+			return
+		}
+	}
+}
+
+// commit writes the changeset as a tarball, and applies it to the
+// read-only branch.
+func commit(t *testing.T, wd string, cs *Changeset) {
+	var buf bytes.Buffer
+	if err := cs.WriteTar(&buf); err != nil {
+		t.Fatalf("WriteTar failed: %v", err)
+	}
+	if err := ApplyChangeset(&buf, wd+"/ro"); err != nil {
+		t.Fatalf("ApplyChangeset failed: %v", err)
+	}
+}
+
+func TestUnionFsChangeset(t *testing.T) {
+	wd, clean := setupUfs(t)
+	defer clean()
+
+	if err := os.MkdirAll(wd+"/ro/dir", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	if err := os.MkdirAll(wd+"/ro/gone", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	for _, n := range []string{"keep", "mod", "del", "dir/a", "dir/b", "gone/x"} {
+		WriteFile(t, wd+"/ro/"+n, n)
+	}
+
+	WriteFile(t, wd+"/mnt/mod", "changed")
+	WriteFile(t, wd+"/mnt/new", "new")
+	for _, n := range []string{"del", "dir/a"} {
+		if err := os.Remove(wd + "/mnt/" + n); err != nil {
+			t.Fatalf("Remove failed: %v", err)
+		}
+	}
+	if err := os.RemoveAll(wd + "/mnt/gone"); err != nil {
+		t.Fatalf("RemoveAll failed: %v", err)
+	}
+	if err := os.Symlink("keep", wd+"/mnt/link"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	if err := os.Link(wd+"/mnt/new", wd+"/mnt/hardlink"); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+
+	cs := diffUfs(t, wd, testOpts)
+	checkChanges(t, cs, map[string]ChangeKind{
+		"mod":      ChangeModified,
+		"new":      ChangeAdded,
+		"hardlink": ChangeAdded,
+		"link":     ChangeAdded,
+		"del":      ChangeDeleted,
+		"dir/a":    ChangeDeleted,
+		"gone":     ChangeDeleted,
+	})
+
+	commit(t, wd, cs)
+	for n, want := range map[string]string{"keep": "keep", "mod": "changed", "new": "new", "dir/b": "dir/b"} {
+		if got := readFromFile(t, wd+"/ro/"+n); got != want {
+			t.Errorf("%s: got %q, want %q", n, got, want)
+		}
+	}
+	for _, n := range []string{"del", "dir/a", "gone"} {
+		checkExists(t, wd+"/ro/"+n, false)
+	}
+	if got, err := os.Readlink(wd + "/ro/link"); got != "keep" {
+		t.Errorf("Readlink: got %q, %v, want %q", got, err, "keep")
+	}
+	fi1, err1 := os.Lstat(wd + "/ro/new")
+	fi2, err2 := os.Lstat(wd + "/ro/hardlink")
+	if err1 != nil || err2 != nil || !os.SameFile(fi1, fi2) {
+		t.Errorf("new and hardlink are not linked: %v %v", err1, err2)
+	}
+}
+
+func TestUnionFsChangesetOpaque(t *testing.T) {
+	opts := testOpts
+	opts.Whiteouts = WhiteoutOverlay
+	wd, clean := setupUfsWithOptions(t, opts)
+	defer clean()
+
+	if err := os.MkdirAll(wd+"/ro/dir/sub", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	WriteFile(t, wd+"/ro/dir/a", "a")
+	WriteFile(t, wd+"/ro/file", "file")
+
+	if err := os.RemoveAll(wd + "/mnt/dir"); err != nil {
+		t.Fatalf("RemoveAll failed: %v", err)
+	}
+	if err := os.Remove(wd + "/mnt/file"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := os.Mkdir(wd+"/mnt/dir", 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	WriteFile(t, wd+"/mnt/dir/c", "c")
+
+	cs := diffUfs(t, wd, opts)
+	checkChanges(t, cs, map[string]ChangeKind{
+		"dir":   ChangeModified,
+		"dir/c": ChangeAdded,
+		"file":  ChangeDeleted,
+	})
+	if len(cs.Changes) == 0 || !cs.Changes[0].Opaque {
+		t.Errorf("dir is not opaque: %v", cs.Changes)
+	}
+
+	commit(t, wd, cs)
+	if got := dirNames(t, wd+"/ro/dir"); len(got) != 1 || !got["c"] {
+		t.Errorf("got entries %v, want [c]", got)
+	}
+	checkExists(t, wd+"/ro/file", false)
+}
+
+func TestUnionFsChangesetMetadataCopyUp(t *testing.T) {
+	wd, err := ioutil.TempDir("", "unionfs")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(wd)
+	for _, d := range []string{"rw", "ro1", "ro2", "out"} {
+		os.Mkdir(wd+"/"+d, 0755)
+	}
+	WriteFile(t, wd+"/ro2/file", "data")
+	WriteFile(t, wd+"/rw/file", "")
+	if err := os.Chmod(wd+"/rw/file", 0600); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	fses := []pathfs.FileSystem{
+		pathfs.NewLoopbackFileSystem(wd + "/rw"),
+		pathfs.NewLoopbackFileSystem(wd + "/ro1"),
+		pathfs.NewLoopbackFileSystem(wd + "/ro2"),
+	}
+	if err := syscall.Setxattr(wd+"/rw/file", metaCopyXAttr, encodeMetaCopy(fses[2].String(), "file"), 0); err != nil {
+		t.Skipf("Setxattr failed: %v", err)
+	}
+
+	opts := testOpts
+	opts.MetadataCopyUp = true
+	cs, err := Diff(fses, opts)
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+	checkChanges(t, cs, map[string]ChangeKind{"file": ChangeModified})
+
+	var buf bytes.Buffer
+	if err := cs.WriteTar(&buf); err != nil {
+		t.Fatalf("WriteTar failed: %v", err)
+	}
+	if err := ApplyChangeset(&buf, wd+"/out"); err != nil {
+		t.Fatalf("ApplyChangeset failed: %v", err)
+	}
+	if got := readFromFile(t, wd+"/out/file"); got != "data" {
+		t.Errorf("got %q, want %q", got, "data")
+	}
+}
+
+func TestUnionFsApplyChangesetSymlink(t *testing.T) {
+	wd, err := ioutil.TempDir("", "unionfs")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(wd)
+	os.Mkdir(wd+"/dir", 0755)
+	os.Mkdir(wd+"/outside", 0755)
+	WriteFile(t, wd+"/outside/victim", "victim")
+
+	for _, entries := range [][]tarEntry{
+		{{name: "a", link: wd + "/outside", flag: tar.TypeSymlink}, {name: "a/file", content: "evil"}},
+		{{name: "a", link: wd + "/outside", flag: tar.TypeSymlink}, {name: "a/.wh.victim"}},
+		{{name: "a", link: "../outside", flag: tar.TypeSymlink}, {name: "b", link: "a/victim", flag: tar.TypeLink}},
+	} {
+		writeLayer(t, wd+"/layer.tar", false, entries)
+		f, err := os.Open(wd + "/layer.tar")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		err = ApplyChangeset(f, wd+"/dir")
+		f.Close()
+		if err == nil {
+			t.Errorf("%v: ApplyChangeset succeeded", entries)
+		}
+		os.RemoveAll(wd + "/dir")
+		os.Mkdir(wd+"/dir", 0755)
+	}
+	checkExists(t, wd+"/outside/file", false)
+	checkExists(t, wd+"/dir/b", false)
+	if got := readFromFile(t, wd+"/outside/victim"); got != "victim" {
+		t.Errorf("victim: got %q, want %q", got, "victim")
+	}
+}
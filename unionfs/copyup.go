@@ -0,0 +1,545 @@
+package unionfs
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// copyUpXAttr holds the state of a lazy copy-up on the file in the
+// writable branch: the name of the source branch, the chunk size, the
+// size of the source data, whether the file was modified, the path of
+// the source, and a bitmap of the chunks that were copied.  It is
+// honoured whether or not LazyCopyUp is set.
+const copyUpXAttr = "user.unionfs.copyup"
+
+const defaultCopyUpChunkSize = 1 << 20
+
+// Persist the bitmap after this many chunks copied in the background.
+const copyUpPersistInterval = 64
+
+// copyUp tracks a file in the writable branch whose contents are
+// still being copied from a read-only branch.  Chunks that were not
+// copied yet are read from the source.  Before a write, the chunks it
+// touches are copied, and the bitmap is persisted, so the source
+// never overwrites newer data, even after a restart.
+type copyUp struct {
+	ufs       *unionFS
+	name      string
+	chunkSize int64
+
+	// The source branch, by name and by its index when the
+	// copy-up started.  See branchName.
+	source string
+	branch int
+
+	// The path of the source in its branch.  The file may have
+	// been renamed since the copy-up started.
+	origin string
+
+	// The writable branch that receives the data, and its file
+	// system.  The background copy runs without branchLock, so it
+	// must not index fileSystems.
+	target   int
+	writable pathfs.FileSystem
+
+	// Background copy, and the handles it uses.
+	src      nodefs.File
+	dst      nodefs.File
+	stop     chan struct{}
+	finished chan struct{}
+
+	// Protects the data below, and serializes access to the
+	// chunks.
+	mu sync.Mutex
+
+	// Source data beyond srcSize is no longer part of the file.
+	srcSize int64
+	copied  []byte
+	dirty   bool
+	done    bool
+
+	// Whether the file was written or truncated.  If not, the
+	// timestamps of the source are restored when the copy is done.
+	modified bool
+
+	// Set when the file is removed; there is nothing to persist.
+	cancelled bool
+
+	// References from the background copy and open files.
+	refs int
+}
+
+func (cu *copyUp) chunks() int64 {
+	return (cu.srcSize + cu.chunkSize - 1) / cu.chunkSize
+}
+
+func (cu *copyUp) isCopied(i int64) bool {
+	return i >= cu.chunks() || cu.copied[i/8]&(1<<uint(i%8)) != 0
+}
+
+func (cu *copyUp) markCopied(i int64) {
+	cu.copied[i/8] |= 1 << uint(i%8)
+	cu.dirty = true
+}
+
+func (cu *copyUp) encode() []byte {
+	var b bytes.Buffer
+	modified := 0
+	if cu.modified {
+		modified = 1
+	}
+	fmt.Fprintf(&b, "%q %d %d %d %q\n", cu.source, cu.chunkSize, cu.srcSize, modified, cu.origin)
+	b.Write(cu.copied)
+	return b.Bytes()
+}
+
+// decodeCopyUp reads the state of cu, and looks up its source branch
+// in cu.ufs.
+func decodeCopyUp(data []byte, cu *copyUp) error {
+	idx := bytes.IndexByte(data, '\n')
+	if idx < 0 {
+		return fmt.Errorf("missing header")
+	}
+	modified := 0
+	_, err := fmt.Sscanf(string(data[:idx]), "%q %d %d %d %q", &cu.source, &cu.chunkSize, &cu.srcSize, &modified, &cu.origin)
+	if err != nil {
+		return err
+	}
+	cu.modified = modified != 0
+	if cu.chunkSize <= 0 {
+		return fmt.Errorf("bad chunk size %d", cu.chunkSize)
+	}
+	cu.copied = make([]byte, (cu.chunks()+7)/8)
+	if copy(cu.copied, data[idx+1:]) != len(cu.copied) {
+		return fmt.Errorf("short bitmap")
+	}
+	cu.branch = cu.ufs.readOnlyBranch(cu.source)
+	if cu.branch < 0 {
+		return fmt.Errorf("no read-only branch %s", cu.source)
+	}
+	return nil
+}
+
+// persist must be called with mu held.
+func (cu *copyUp) persist() fuse.Status {
+	if !cu.dirty || cu.cancelled {
+		return fuse.OK
+	}
+	code := cu.writable.SetXAttr(cu.name, copyUpXAttr, cu.encode(), 0, nil)
+	if code.Ok() {
+		cu.dirty = false
+	}
+	return code
+}
+
+func readAt(f nodefs.File, dest []byte, off int64) (int, fuse.Status) {
+	res, code := f.Read(dest, off)
+	if !code.Ok() {
+		return 0, code
+	}
+	data, code := res.Bytes(dest)
+	n := copy(dest, data)
+	res.Done()
+	return n, code
+}
+
+// copyChunk must be called with mu held.
+func (cu *copyUp) copyChunk(i int64) fuse.Status {
+	off := i * cu.chunkSize
+	sz := cu.chunkSize
+	if off+sz > cu.srcSize {
+		sz = cu.srcSize - off
+	}
+	buf := make([]byte, sz)
+	n, code := readAt(cu.src, buf, off)
+	if !code.Ok() {
+		return code
+	}
+	if n > 0 {
+		if _, code := cu.dst.Write(buf[:n], off); !code.Ok() {
+			return code
+		}
+	}
+	cu.markCopied(i)
+	return fuse.OK
+}
+
+// read reads the file, taking the chunks that were not copied from
+// the source.
+func (cu *copyUp) read(f nodefs.File, dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	cu.mu.Lock()
+	defer cu.mu.Unlock()
+	if cu.done {
+		return f.Read(dest, off)
+	}
+
+	total := 0
+	for total < len(dest) {
+		pos := off + int64(total)
+		i := pos / cu.chunkSize
+		end := (i + 1) * cu.chunkSize
+		from := f
+		if !cu.isCopied(i) {
+			from = cu.src
+			if end > cu.srcSize {
+				end = cu.srcSize
+			}
+		}
+		want := int(end - pos)
+		if want > len(dest)-total {
+			want = len(dest) - total
+		}
+		n, code := readAt(from, dest[total:total+want], pos)
+		if !code.Ok() {
+			return nil, code
+		}
+		total += n
+		if n < want {
+			break
+		}
+	}
+	return &fuse.ReadResultData{Data: dest[:total]}, fuse.OK
+}
+
+// prepareWrite copies the chunks of the range [off, off+size) and
+// records them as copied.
+func (cu *copyUp) prepareWrite(off int64, size int64) fuse.Status {
+	if cu.done {
+		return fuse.OK
+	}
+	for i := off / cu.chunkSize; i*cu.chunkSize < off+size && i < cu.chunks(); i++ {
+		if !cu.isCopied(i) {
+			if code := cu.copyChunk(i); !code.Ok() {
+				return code
+			}
+		}
+	}
+	return cu.persist()
+}
+
+func (cu *copyUp) write(f nodefs.File, data []byte, off int64) (uint32, fuse.Status) {
+	cu.mu.Lock()
+	defer cu.mu.Unlock()
+	if !cu.done && !cu.modified {
+		cu.modified = true
+		cu.dirty = true
+	}
+	if code := cu.prepareWrite(off, int64(len(data))); !code.Ok() {
+		return 0, code
+	}
+	return f.Write(data, off)
+}
+
+// truncate cuts the source data off at size.  The caller truncates
+// the file itself.
+func (cu *copyUp) truncate(size uint64) fuse.Status {
+	cu.mu.Lock()
+	defer cu.mu.Unlock()
+	if cu.done || int64(size) >= cu.srcSize {
+		return fuse.OK
+	}
+	// The rest of the chunk at the cut must read as zeroes if the
+	// file grows again, so it cannot come from the source.
+	if code := cu.prepareWrite(int64(size), 1); !code.Ok() {
+		return code
+	}
+	cu.srcSize = int64(size)
+	cu.modified = true
+	cu.dirty = true
+	return cu.persist()
+}
+
+// run copies the remaining chunks in the background.
+func (cu *copyUp) run() {
+	defer cu.finish()
+	for i := int64(0); ; i++ {
+		select {
+		case <-cu.stop:
+			return
+		default:
+		}
+
+		cu.mu.Lock()
+		if i >= cu.chunks() {
+			break
+		}
+		var code fuse.Status
+		if !cu.isCopied(i) {
+			code = cu.copyChunk(i)
+		}
+		if code.Ok() && i%copyUpPersistInterval == copyUpPersistInterval-1 {
+			code = cu.persist()
+		}
+		cu.mu.Unlock()
+		if !code.Ok() {
+			log.Printf("copy-up of %q: %v; retrying on next open", cu.name, code)
+			return
+		}
+	}
+
+	// Still holding mu.
+	cu.done = true
+	writable := cu.writable
+	var a fuse.Attr
+	if !cu.modified && cu.src.GetAttr(&a).Ok() {
+		atime := a.AccessTime()
+		mtime := a.ModTime()
+		writable.Utimens(cu.name, &atime, &mtime, nil)
+	}
+	code := writable.RemoveXAttr(cu.name, copyUpXAttr, nil)
+	if !code.Ok() {
+		log.Printf("copy-up of %q: RemoveXAttr: %v", cu.name, code)
+	}
+	cu.mu.Unlock()
+}
+
+func (cu *copyUp) finish() {
+	cu.ufs.copyUpMutex.Lock()
+	if cu.ufs.copyUps[cu.name] == cu {
+		delete(cu.ufs.copyUps, cu.name)
+	}
+	cu.ufs.copyUpMutex.Unlock()
+	close(cu.finished)
+	cu.unref()
+}
+
+// unref drops a reference from the background copy or an open file.
+// The handles stay open while unfinished chunks may be read.
+func (cu *copyUp) unref() {
+	cu.mu.Lock()
+	cu.refs--
+	last := cu.refs == 0
+	cu.mu.Unlock()
+	if last {
+		cu.src.Release()
+		cu.dst.Flush()
+		cu.dst.Release()
+	}
+}
+
+// lazyPromote creates a sparse copy of the regular file name in the
+// writable branch dst, and starts copying its contents in the
+// background.
+func (fs *unionFS) lazyPromote(name string, srcResult branchResult, dst int, context *fuse.Context) fuse.Status {
+	writable := fs.fileSystems[dst]
+	f, code := writable.Create(name, uint32(os.O_WRONLY|os.O_CREATE|os.O_TRUNC), srcResult.attr.Mode&07777|0200, context)
+	if !code.Ok() {
+		return code
+	}
+	code = f.Truncate(srcResult.attr.Size)
+	f.Flush()
+	f.Release()
+	if !code.Ok() {
+		return code
+	}
+
+	chunkSize := fs.options.CopyUpChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultCopyUpChunkSize
+	}
+	cu := &copyUp{
+		ufs:       fs,
+		name:      name,
+		origin:    name,
+		source:    fs.branchName(srcResult.branch),
+		branch:    srcResult.branch,
+		target:    dst,
+		writable:  writable,
+		chunkSize: chunkSize,
+		srcSize:   int64(srcResult.attr.Size),
+		dirty:     true,
+	}
+	cu.copied = make([]byte, (cu.chunks()+7)/8)
+	if code := cu.persist(); !code.Ok() {
+		return code
+	}
+	_, code = fs.startCopyUp(cu)
+	return code
+}
+
+// startCopyUp opens the files for cu, and starts the background
+// copy.  It returns the copy-up that is in progress for the file.
+func (fs *unionFS) startCopyUp(cu *copyUp) (*copyUp, fuse.Status) {
+	var code fuse.Status
+	cu.src, code = fs.fileSystems[cu.branch].Open(cu.origin, uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		return nil, code
+	}
+	cu.dst, code = fs.fileSystems[cu.target].Open(cu.name, uint32(os.O_WRONLY), nil)
+	if !code.Ok() {
+		cu.src.Release()
+		return nil, code
+	}
+	cu.refs = 1
+	cu.stop = make(chan struct{})
+	cu.finished = make(chan struct{})
+
+	fs.copyUpMutex.Lock()
+	existing := fs.copyUps[cu.name]
+	if existing == nil {
+		fs.copyUps[cu.name] = cu
+	}
+	fs.copyUpMutex.Unlock()
+	if existing != nil {
+		cu.src.Release()
+		cu.dst.Release()
+		return existing, fuse.OK
+	}
+	go cu.run()
+	return cu, fuse.OK
+}
+
+// getCopyUp returns the unfinished copy-up for name in the given
+// writable branch, resuming it if it was interrupted by a restart.
+// A copy-up that cannot be resumed fails with EIO, as the file is
+// incomplete.
+func (fs *unionFS) getCopyUp(name string, branch int) (*copyUp, fuse.Status) {
+	fs.copyUpMutex.Lock()
+	cu := fs.copyUps[name]
+	fs.copyUpMutex.Unlock()
+	if cu != nil {
+		return cu, fuse.OK
+	}
+
+	data, code := fs.fileSystems[branch].GetXAttr(name, copyUpXAttr, nil)
+	if !code.Ok() {
+		return nil, fuse.OK
+	}
+	cu = &copyUp{ufs: fs, name: name, target: branch, writable: fs.fileSystems[branch]}
+	if err := decodeCopyUp(data, cu); err != nil {
+		log.Printf("copy-up of %q: bad state %q: %v", name, data, err)
+		return nil, fuse.EIO
+	}
+	cu, code = fs.startCopyUp(cu)
+	if !code.Ok() {
+		log.Printf("copy-up of %q: cannot resume: %v", name, code)
+		return nil, fuse.EIO
+	}
+	return cu, fuse.OK
+}
+
+// finishCopyUps waits for the copy-ups of name and everything below
+// it to complete, so they can be renamed safely.
+func (fs *unionFS) finishCopyUps(name string) {
+	fs.copyUpMutex.Lock()
+	var todo []*copyUp
+	for n, cu := range fs.copyUps {
+		if n == name || strings.HasPrefix(n, name+"/") || name == "" {
+			todo = append(todo, cu)
+		}
+	}
+	fs.copyUpMutex.Unlock()
+	for _, cu := range todo {
+		<-cu.finished
+	}
+}
+
+// cancelCopyUp stops copying name, which is about to be removed.
+// Files that are still open keep reading the source.
+func (fs *unionFS) cancelCopyUp(name string) {
+	fs.copyUpMutex.Lock()
+	cu := fs.copyUps[name]
+	delete(fs.copyUps, name)
+	fs.copyUpMutex.Unlock()
+	if cu != nil {
+		cu.mu.Lock()
+		cu.cancelled = true
+		cu.mu.Unlock()
+		close(cu.stop)
+		<-cu.finished
+	}
+}
+
+// openWritable opens name in a writable branch, taking an unfinished
+// copy-up into account.
+func (fs *unionFS) openWritable(name string, branch int, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&syscall.O_TRUNC != 0 {
+		if code := fs.truncateCopyUp(name, branch, 0); !code.Ok() {
+			return nil, code
+		}
+	}
+	f, code := fs.fileSystems[branch].Open(name, flags, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	for try := 0; try < 2; try++ {
+		cu, code := fs.getCopyUp(name, branch)
+		if !code.Ok() {
+			f.Release()
+			return nil, code
+		}
+		if cu == nil {
+			return f, fuse.OK
+		}
+		cu.mu.Lock()
+		done := cu.done
+		live := cu.refs > 0
+		if !done && live {
+			cu.refs++
+		}
+		cu.mu.Unlock()
+		if done {
+			return f, fuse.OK
+		}
+		if live {
+			return &copyUpFile{File: f, cu: cu}, fuse.OK
+		}
+		// Stopped on an error just now; resume it.
+	}
+	f.Release()
+	return nil, fuse.EIO
+}
+
+// truncateCopyUp prepares an unfinished copy-up of name for
+// truncating the file to size.
+func (fs *unionFS) truncateCopyUp(name string, branch int, size uint64) fuse.Status {
+	cu, code := fs.getCopyUp(name, branch)
+	if cu == nil {
+		return code
+	}
+	return cu.truncate(size)
+}
+
+// copyUpFile is a file in the writable branch that is being copied
+// up.
+type copyUpFile struct {
+	nodefs.File
+	cu *copyUp
+}
+
+func (f *copyUpFile) InnerFile() nodefs.File {
+	return f.File
+}
+
+func (f *copyUpFile) String() string {
+	return fmt.Sprintf("copyUpFile(%s)", f.File.String())
+}
+
+func (f *copyUpFile) Release() {
+	f.File.Release()
+	f.cu.unref()
+}
+
+func (f *copyUpFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	return f.cu.read(f.File, dest, off)
+}
+
+func (f *copyUpFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	return f.cu.write(f.File, data, off)
+}
+
+func (f *copyUpFile) Truncate(size uint64) fuse.Status {
+	if code := f.cu.truncate(size); !code.Ok() {
+		return code
+	}
+	return f.File.Truncate(size)
+}
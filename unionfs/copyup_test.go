@@ -0,0 +1,208 @@
+package unionfs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+const copyUpTestChunk = 4096
+
+func setupLazyUfs(t *testing.T) (wd string, clean func()) {
+	opts := testOpts
+	opts.LazyCopyUp = true
+	opts.CopyUpChunkSize = copyUpTestChunk
+	return setupUfsWithOptions(t, opts)
+}
+
+// waitCopyUp waits for the copy-up state to disappear from name.
+func waitCopyUp(t *testing.T, name string) {
+	buf := make([]byte, 1024)
+	for i := 0; i < 100; i++ {
+		if _, err := syscall.Getxattr(name, copyUpXAttr, buf); err == syscall.ENODATA {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("copy-up of %s did not finish", name)
+}
+
+// roBranchName returns the name of the read-only branch of the
+// union set up by setupUfsBranches in wd.
+func roBranchName(wd string) string {
+	return NewCachingFileSystem(pathfs.NewLoopbackFileSystem(wd+"/ro"), 0).String()
+}
+
+func testContent(size int) []byte {
+	var b bytes.Buffer
+	for i := 0; b.Len() < size; i++ {
+		fmt.Fprintf(&b, "%08d\n", i)
+	}
+	return b.Bytes()[:size]
+}
+
+func TestUnionFsLazyCopyUp(t *testing.T) {
+	wd, clean := setupLazyUfs(t)
+	defer clean()
+
+	content := testContent(100*copyUpTestChunk + 17)
+	if err := ioutil.WriteFile(wd+"/ro/file", content, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	f, err := os.OpenFile(wd+"/mnt/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte("hello"), 3*copyUpTestChunk-2); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	copy(content[3*copyUpTestChunk-2:], "hello")
+
+	got := make([]byte, len(content)+10)
+	n, err := f.ReadAt(got, 0)
+	if n != len(content) || !bytes.Equal(got[:n], content) {
+		t.Fatalf("ReadAt: got %d bytes (%v), want %d matching bytes", n, err, len(content))
+	}
+
+	waitCopyUp(t, wd+"/rw/file")
+	got, err = ioutil.ReadFile(wd + "/rw/file")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("writable branch has wrong content after copy-up")
+	}
+}
+
+func TestUnionFsLazyCopyUpTimes(t *testing.T) {
+	wd, clean := setupLazyUfs(t)
+	defer clean()
+
+	if err := ioutil.WriteFile(wd+"/ro/file", testContent(10*copyUpTestChunk), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	mtime := time.Unix(1e9, 0)
+	if err := os.Chtimes(wd+"/ro/file", mtime, mtime); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+	if err := os.Chmod(wd+"/mnt/file", 0600); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+
+	waitCopyUp(t, wd+"/rw/file")
+	fi, err := os.Stat(wd + "/rw/file")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Errorf("got mtime %v, want %v", fi.ModTime(), mtime)
+	}
+}
+
+func TestUnionFsLazyCopyUpTruncate(t *testing.T) {
+	wd, clean := setupLazyUfs(t)
+	defer clean()
+
+	content := testContent(10 * copyUpTestChunk)
+	if err := ioutil.WriteFile(wd+"/ro/file", content, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := os.Truncate(wd+"/mnt/file", copyUpTestChunk/2); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if err := os.Truncate(wd+"/mnt/file", 2*copyUpTestChunk); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	want := make([]byte, 2*copyUpTestChunk)
+	copy(want, content[:copyUpTestChunk/2])
+
+	got, err := ioutil.ReadFile(wd + "/mnt/file")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got wrong content after truncate")
+	}
+}
+
+func TestUnionFsLazyCopyUpResume(t *testing.T) {
+	wd, clean := setupLazyUfs(t)
+	defer clean()
+
+	content := testContent(8 * copyUpTestChunk)
+	if err := ioutil.WriteFile(wd+"/ro/file", content, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	// State as left by an interrupted copy-up: chunk 1 was copied
+	// and then overwritten; the others are holes.
+	rw := make([]byte, len(content))
+	copy(rw[copyUpTestChunk:], bytes.Repeat([]byte("w"), copyUpTestChunk))
+	if err := ioutil.WriteFile(wd+"/rw/file", rw, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	ro := roBranchName(wd)
+	state := []byte(fmt.Sprintf("%q %d %d 1 %q\n\x02", ro, copyUpTestChunk, len(content), "file"))
+	if err := syscall.Setxattr(wd+"/rw/file", copyUpXAttr, state, 0); err != nil {
+		t.Fatalf("Setxattr failed: %v", err)
+	}
+	copy(content[copyUpTestChunk:], rw[copyUpTestChunk:2*copyUpTestChunk])
+
+	got, err := ioutil.ReadFile(wd + "/mnt/file")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("got wrong content while resuming")
+	}
+
+	waitCopyUp(t, wd+"/rw/file")
+	got, err = ioutil.ReadFile(wd + "/rw/file")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("writable branch has wrong content after resume")
+	}
+}
+
+func TestUnionFsLazyCopyUpResumeRenamed(t *testing.T) {
+	// Without LazyCopyUp, interrupted copy-ups are still resumed.
+	wd, clean := setupUfs(t)
+	defer clean()
+
+	content := testContent(2 * copyUpTestChunk)
+	if err := ioutil.WriteFile(wd+"/ro/file", content, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	ro := roBranchName(wd)
+	for n, origin := range map[string]string{"renamed": "file", "gone": "missing"} {
+		if err := ioutil.WriteFile(wd+"/rw/"+n, make([]byte, len(content)), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		state := []byte(fmt.Sprintf("%q %d %d 0 %q\n\x00", ro, copyUpTestChunk, len(content), origin))
+		if err := syscall.Setxattr(wd+"/rw/"+n, copyUpXAttr, state, 0); err != nil {
+			t.Skipf("no user xattrs on %s: %v", wd, err)
+		}
+	}
+
+	got, err := ioutil.ReadFile(wd + "/mnt/renamed")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("got wrong content while resuming")
+	}
+	waitCopyUp(t, wd+"/rw/renamed")
+
+	if _, err := ioutil.ReadFile(wd + "/mnt/gone"); err == nil {
+		t.Errorf("reading a copy-up without source succeeded")
+	}
+}
@@ -1,26 +1,32 @@
 package unionfs
 
 import (
+	"fmt"
 	"os"
+	"strings"
+	"sync"
 
 	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/hanwen/go-fuse/zipfs"
 )
 
+// NewUnionFsFromRoots creates a union of the given roots, the first
+// of which is the writable branch.  A root is a directory, an
+// archive (.zip, .tar, .tar.gz, .tgz or .tar.bz2), or a URI
+// SCHEME://REST for a scheme registered with RegisterBranchFactory.
+// Archives are read-only, and are read like image layers, see
+// NewLayerFileSystem.  If roCaching is set, the read-only branches
+// are wrapped in a caching file system.
 func NewUnionFsFromRoots(roots []string, opts *UnionFsOptions, roCaching bool) (pathfs.FileSystem, error) {
+	if _, err := branchModes(opts.BranchModes, len(roots)); err != nil {
+		return nil, err
+	}
 	fses := make([]pathfs.FileSystem, 0)
 	for i, r := range roots {
-		var fs pathfs.FileSystem
-		fi, err := os.Stat(r)
+		fs, err := NewRootFileSystem(r)
 		if err != nil {
 			return nil, err
 		}
-		if fi.IsDir() {
-			fs = pathfs.NewLoopbackFileSystem(r)
-		}
-		if fs == nil {
-			return nil, err
-
-		}
 		if i > 0 && roCaching {
 			fs = NewCachingFileSystem(fs, 0)
 		}
@@ -28,5 +34,75 @@ func NewUnionFsFromRoots(roots []string, opts *UnionFsOptions, roCaching bool) (
 		fses = append(fses, fs)
 	}
 
-	return NewUnionFs(fses, *opts), nil
+	ufs := NewUnionFs(fses, *opts)
+	if ufs == nil {
+		return nil, fmt.Errorf("cannot create union of %v", roots)
+	}
+	return ufs, nil
+}
+
+// BranchFactory returns the file system for a root URI, given the
+// part after "SCHEME://".
+type BranchFactory func(rest string) (pathfs.FileSystem, error)
+
+var (
+	branchFactoriesMutex sync.Mutex
+	branchFactories      = map[string]BranchFactory{}
+)
+
+// RegisterBranchFactory makes roots of the form SCHEME://REST
+// available to NewUnionFsFromRoots and the branch control file.  The
+// "file" scheme is built in, and takes the same roots as plain
+// paths, unless it is registered explicitly.
+func RegisterBranchFactory(scheme string, factory BranchFactory) {
+	branchFactoriesMutex.Lock()
+	defer branchFactoriesMutex.Unlock()
+	branchFactories[scheme] = factory
+}
+
+// NewRootFileSystem returns the file system for a branch given by
+// its root, in any of the forms NewUnionFsFromRoots takes.
+func NewRootFileSystem(root string) (pathfs.FileSystem, error) {
+	if i := strings.Index(root, "://"); i > 0 && !strings.Contains(root[:i], "/") {
+		scheme, rest := root[:i], root[i+len("://"):]
+		branchFactoriesMutex.Lock()
+		factory := branchFactories[scheme]
+		branchFactoriesMutex.Unlock()
+		if factory != nil {
+			return factory(rest)
+		}
+		if scheme != "file" {
+			return nil, fmt.Errorf("%s: unknown scheme %q", root, scheme)
+		}
+		root = rest
+	}
+
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return pathfs.NewLoopbackFileSystem(root), nil
+	}
+	return newArchiveFileSystem(root)
+}
+
+// newArchiveFileSystem returns a read-only file system for an
+// archive, chosen by its extension.
+func newArchiveFileSystem(name string) (pathfs.FileSystem, error) {
+	var files map[string]zipfs.MemFile
+	var err error
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		files, err = zipfs.NewZipTree(name)
+	case strings.HasSuffix(name, ".tar"), strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"),
+		strings.HasSuffix(name, ".tar.bz2"):
+		return NewLayerFileSystem(name)
+	default:
+		return nil, fmt.Errorf("%s: not a directory or archive", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newLayerFs(name, files), nil
 }
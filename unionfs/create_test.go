@@ -0,0 +1,100 @@
+package unionfs
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+func writeZip(t *testing.T, name string, files map[string]string) {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	defer zw.Close()
+	for n, content := range files {
+		w, err := zw.Create(n)
+		if err != nil {
+			t.Fatalf("Create(%q) failed: %v", n, err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+}
+
+func readUnionFile(t *testing.T, fs pathfs.FileSystem, name string) string {
+	a, code := fs.GetAttr(name, nil)
+	if !code.Ok() {
+		t.Fatalf("GetAttr(%q): %v", name, code)
+	}
+	f, code := fs.Open(name, 0, nil)
+	if !code.Ok() {
+		t.Fatalf("Open(%q): %v", name, code)
+	}
+	defer f.Release()
+	buf := make([]byte, a.Size)
+	n, code := readAt(f, buf, 0)
+	if !code.Ok() {
+		t.Fatalf("Read(%q): %v", name, code)
+	}
+	return string(buf[:n])
+}
+
+func TestUnionFsFromArchiveRoots(t *testing.T) {
+	wd, err := ioutil.TempDir("", "unionfs")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(wd)
+	os.Mkdir(wd+"/rw", 0755)
+	os.Mkdir(wd+"/dir", 0755)
+	writeZip(t, wd+"/base.zip", map[string]string{"zip": "zip", "dir/file": "zip"})
+	writeLayer(t, wd+"/layer.tar.gz", true, []tarEntry{
+		{name: "tar", content: "tar"},
+		{name: "dir/file", content: "tar"},
+	})
+	WriteFile(t, wd+"/dir/local", "local")
+
+	RegisterBranchFactory("test", func(rest string) (pathfs.FileSystem, error) {
+		return pathfs.NewLoopbackFileSystem(wd + "/" + rest), nil
+	})
+	roots := []string{wd + "/rw", wd + "/layer.tar.gz", "test://dir", wd + "/base.zip"}
+	ufs, err := NewUnionFsFromRoots(roots, &testOpts, true)
+	if err != nil {
+		t.Fatalf("NewUnionFsFromRoots failed: %v", err)
+	}
+	for n, want := range map[string]string{"zip": "zip", "tar": "tar", "dir/file": "tar", "local": "local"} {
+		if got := readUnionFile(t, ufs, n); got != want {
+			t.Errorf("%s: got %q, want %q", n, got, want)
+		}
+	}
+
+	if code := ufs.Mkdir("new", 0755, nil); !code.Ok() {
+		t.Fatalf("Mkdir: %v", code)
+	}
+	checkExists(t, wd+"/rw/new", true)
+
+	for _, roots := range [][]string{
+		{wd + "/rw", "bogus://dir"},
+		{wd + "/base.zip", wd + "/dir"},
+	} {
+		if _, err := NewUnionFsFromRoots(roots, &testOpts, false); err == nil {
+			t.Errorf("NewUnionFsFromRoots(%v) succeeded", roots)
+		}
+	}
+	opts := testOpts
+	opts.BranchModes = []BranchMode{BranchRW}
+	if _, err := NewUnionFsFromRoots([]string{wd + "/rw", wd + "/dir"}, &opts, false); err == nil {
+		t.Errorf("NewUnionFsFromRoots with bad branch modes succeeded")
+	}
+	if _, code := ufs.GetAttr("nonexistent", nil); code != fuse.ENOENT {
+		t.Errorf("got %v, want ENOENT", code)
+	}
+}
@@ -0,0 +1,207 @@
+package unionfs
+
+import (
+	"fmt"
+	"log"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Files in read-only branches may have several names.  Promoting
+// one name copies the file, so the union remembers the names it sees
+// for each read-only inode, and links them to the copy.  A name that
+// is promoted after the copy-up is linked to the copy instead of
+// being copied again.  Lookups only record names; names that the
+// union had not seen when the file was promoted show the read-only
+// data until they are promoted themselves.
+//
+// The copy carries the read-only inode it was made from in
+// originXAttr, which is read when files of the writable branches are
+// looked up, so the union finds the copy again after a remount.
+//
+// PathNodeFsOptions.ClientInodes cannot do this: it is chosen by
+// whoever mounts the union, it only knows the names the kernel has
+// cached, and it goes by the inode numbers of the union, which change
+// when the file is promoted.
+
+// originXAttr is set on copies of hard-linked files.  The value has
+// the name of the read-only branch and the inode number the copy was
+// made from.
+const originXAttr = "user.unionfs.origin"
+
+// maxLinkedInodes bounds the number of read-only inodes whose names
+// or copies are remembered.  Forgetting a name means it is copied
+// separately when promoted; forgetting a copy means it is not used
+// until one of its names is looked up again.
+const maxLinkedInodes = 4096
+
+// linkKey identifies an inode of a read-only branch.
+type linkKey struct {
+	branch int
+	ino    uint64
+}
+
+// promotedLink is the copy of a read-only inode in a writable
+// branch.
+type promotedLink struct {
+	name   string
+	branch int
+	ino    uint64
+}
+
+func encodeOrigin(branch string, ino uint64) []byte {
+	return []byte(fmt.Sprintf("%q %d", branch, ino))
+}
+
+func decodeOrigin(data []byte) (branch string, ino uint64, err error) {
+	_, err = fmt.Sscanf(string(data), "%q %d", &branch, &ino)
+	return branch, ino, err
+}
+
+// recordLink records name as a link to the inode with attributes a
+// in the read-only branch.
+func (fs *unionFS) recordLink(name string, branch int, a *fuse.Attr) {
+	key := linkKey{branch, a.Ino}
+	fs.linkMutex.Lock()
+	defer fs.linkMutex.Unlock()
+	names := fs.links[key]
+	if names == nil {
+		if len(fs.links) >= maxLinkedInodes {
+			for k := range fs.links {
+				delete(fs.links, k)
+				break
+			}
+		}
+		names = map[string]bool{}
+		fs.links[key] = names
+	}
+	names[name] = true
+}
+
+// recordCopy remembers name, which has attributes a in the writable
+// branch, as the copy of the read-only inode in its originXAttr.
+func (fs *unionFS) recordCopy(name string, branch int, a *fuse.Attr) {
+	data, code := fs.fileSystems[branch].GetXAttr(name, originXAttr, nil)
+	if !code.Ok() {
+		return
+	}
+	src, ino, err := decodeOrigin(data)
+	if err != nil {
+		log.Printf("bad %s on %q: %v", originXAttr, name, err)
+		return
+	}
+	ro := fs.readOnlyBranch(src)
+	if ro < 0 {
+		return
+	}
+	fs.setPromotedLink(linkKey{ro, ino}, promotedLink{name, branch, a.Ino})
+}
+
+func (fs *unionFS) setPromotedLink(key linkKey, p promotedLink) {
+	fs.linkMutex.Lock()
+	defer fs.linkMutex.Unlock()
+	if _, ok := fs.promotedLinks[key]; !ok && len(fs.promotedLinks) >= maxLinkedInodes {
+		for k := range fs.promotedLinks {
+			delete(fs.promotedLinks, k)
+			break
+		}
+	}
+	fs.promotedLinks[key] = p
+}
+
+// linkToCopy links name to the copy of srcResult in branch dst, if
+// that inode was promoted before.
+func (fs *unionFS) linkToCopy(name string, srcResult branchResult, dst int) fuse.Status {
+	// srcResult has the inode number as reported by the union.
+	key := linkKey{srcResult.branch, branchInode(srcResult.attr.Ino, srcResult.branch)}
+	fs.linkMutex.Lock()
+	p, ok := fs.promotedLinks[key]
+	fs.linkMutex.Unlock()
+	if !ok || p.branch != dst || p.name == name {
+		return fuse.ENOENT
+	}
+
+	writable := fs.fileSystems[dst]
+	if a, code := writable.GetAttr(p.name, nil); !code.Ok() || a.Ino != p.ino {
+		// The copy was removed or replaced since.
+		fs.linkMutex.Lock()
+		if fs.promotedLinks[key] == p {
+			delete(fs.promotedLinks, key)
+		}
+		fs.linkMutex.Unlock()
+		return fuse.ENOENT
+	}
+	return fs.linkName(p, name)
+}
+
+// linkName links name to the copy p, whose parent directories exist.
+func (fs *unionFS) linkName(p promotedLink, name string) fuse.Status {
+	writable := fs.fileSystems[p.branch]
+	code := writable.Link(p.name, name, nil)
+	if code == fuse.Status(syscall.EEXIST) {
+		// A concurrent promotion may have made the link.
+		if a, acode := writable.GetAttr(name, nil); acode.Ok() && a.Ino == p.ino {
+			code = fuse.OK
+		}
+	}
+	if !code.Ok() {
+		log.Printf("cannot link %q to %q: %v", name, p.name, code)
+	}
+	return code
+}
+
+// promoteLinks links the other known names of srcResult, which was
+// just promoted to name in branch dst, to the copy.
+func (fs *unionFS) promoteLinks(name string, srcResult branchResult, dst int) {
+	writable := fs.fileSystems[dst]
+	a, code := writable.GetAttr(name, nil)
+	if !code.Ok() {
+		return
+	}
+
+	key := linkKey{srcResult.branch, branchInode(srcResult.attr.Ino, srcResult.branch)}
+	// Errors are not fatal: without the attribute, the copy is
+	// only found while the union remembers it.
+	writable.SetXAttr(name, originXAttr, encodeOrigin(fs.branchName(key.branch), key.ino), 0, nil)
+
+	p := promotedLink{name, dst, a.Ino}
+	fs.setPromotedLink(key, p)
+	var others []string
+	fs.linkMutex.Lock()
+	for n := range fs.links[key] {
+		if n != name {
+			others = append(others, n)
+		}
+	}
+	delete(fs.links, key)
+	fs.linkMutex.Unlock()
+
+	for _, n := range others {
+		// The name may have been deleted or replaced since.
+		r := fs.branchCache.GetFresh(n).(branchResult)
+		if r.branch != key.branch || branchInode(r.attr.Ino, r.branch) != key.ino {
+			continue
+		}
+		if code := fs.promoteDirsTo(n, dst); !code.Ok() {
+			log.Printf("cannot link %q to %q: %v", n, name, code)
+			continue
+		}
+		if !fs.linkName(p, n).Ok() {
+			continue
+		}
+		fs.branchCache.GetFresh(n)
+		if fs.nodeFs != nil {
+			go fs.nodeFs.FileNotify(n, 0, 0)
+		}
+	}
+}
+
+// dropLinks forgets the read-only inodes, whose keys are no longer
+// valid once the branches change.
+func (fs *unionFS) dropLinks() {
+	fs.linkMutex.Lock()
+	defer fs.linkMutex.Unlock()
+	fs.links = map[linkKey]map[string]bool{}
+	fs.promotedLinks = map[linkKey]promotedLink{}
+}
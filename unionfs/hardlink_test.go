@@ -0,0 +1,153 @@
+package unionfs
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+func checkLinked(t *testing.T, names []string, nlink uint64) {
+	var first os.FileInfo
+	for _, n := range names {
+		fi, err := os.Lstat(n)
+		if err != nil {
+			t.Errorf("Lstat failed: %v", err)
+			continue
+		}
+		if got := fi.Sys().(*syscall.Stat_t).Nlink; uint64(got) != nlink {
+			t.Errorf("%s: got nlink %d, want %d", n, got, nlink)
+		}
+		if first == nil {
+			first = fi
+		} else if !os.SameFile(first, fi) {
+			t.Errorf("%s is not linked to %s", n, names[0])
+		}
+	}
+}
+
+func TestUnionFsPromoteHardLinks(t *testing.T) {
+	for _, alias := range []string{"a", "b"} {
+		wd, clean := setupUfs(t)
+
+		WriteFile(t, wd+"/ro/a", "old")
+		os.Mkdir(wd+"/ro/sub", 0755)
+		for _, n := range []string{"b", "sub/c"} {
+			if err := os.Link(wd+"/ro/a", wd+"/ro/"+n); err != nil {
+				t.Fatalf("Link failed: %v", err)
+			}
+		}
+
+		// Only a and b are known when the file is promoted.
+		for _, n := range []string{"a", "b"} {
+			if _, err := os.Lstat(wd + "/mnt/" + n); err != nil {
+				t.Fatalf("Lstat failed: %v", err)
+			}
+		}
+		f, err := os.OpenFile(wd+"/mnt/"+alias, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatalf("OpenFile failed: %v", err)
+		}
+		if _, err := f.WriteAt([]byte("new"), 0); err != nil {
+			t.Fatalf("WriteAt failed: %v", err)
+		}
+		f.Close()
+
+		checkLinked(t, []string{wd + "/rw/a", wd + "/rw/b"}, 2)
+		for _, n := range []string{"a", "b"} {
+			if got := readFromFile(t, wd+"/mnt/"+n); got != "new" {
+				t.Errorf("write through %s: %s has %q, want %q", alias, n, got, "new")
+			}
+		}
+
+		// Lookups do not link sub/c.
+		if _, err := os.Lstat(wd + "/mnt/sub/c"); err != nil {
+			t.Fatalf("Lstat failed: %v", err)
+		}
+		checkExists(t, wd+"/rw/sub/c", false)
+		clean()
+	}
+}
+
+func TestUnionFsPromoteHardLinksExisting(t *testing.T) {
+	wd, _ := ioutil.TempDir("", "unionfs")
+	defer os.RemoveAll(wd)
+	os.Mkdir(wd+"/rw", 0755)
+	os.Mkdir(wd+"/ro", 0755)
+	WriteFile(t, wd+"/ro/a", "old")
+	WriteFile(t, wd+"/rw/a", "new")
+	for _, d := range []string{"ro", "rw"} {
+		if err := os.Link(wd+"/"+d+"/a", wd+"/"+d+"/b"); err != nil {
+			t.Fatalf("Link failed: %v", err)
+		}
+	}
+
+	fses := []pathfs.FileSystem{
+		pathfs.NewLoopbackFileSystem(wd + "/rw"),
+		pathfs.NewLoopbackFileSystem(wd + "/ro"),
+	}
+	ufs := NewUnionFs(fses, testOpts).(*unionFS)
+	ro, _ := fses[1].GetAttr("b", nil)
+	rw, _ := fses[0].GetAttr("a", nil)
+	ufs.promotedLinks[linkKey{1, ro.Ino}] = promotedLink{"a", 0, rw.Ino}
+
+	// A concurrent promotion of b made the link first.
+	setBranchInode(ro, 1)
+	if code := ufs.linkToCopy("b", branchResult{attr: ro, branch: 1}, 0); !code.Ok() {
+		t.Errorf("linkToCopy: %v", code)
+	}
+}
+
+// Test that the copy of a hard-linked file is found after a remount.
+func TestUnionFsPromoteHardLinksRemount(t *testing.T) {
+	wd, _ := ioutil.TempDir("", "unionfs")
+	defer os.RemoveAll(wd)
+	for _, d := range []string{"rw", "ro", "mnt"} {
+		os.Mkdir(wd+"/"+d, 0755)
+	}
+	if err := syscall.Setxattr(wd+"/rw", "user.test", []byte("y"), 0); err != nil {
+		t.Skip("no user xattrs:", err)
+	}
+	WriteFile(t, wd+"/ro/a", "old")
+	if err := os.Link(wd+"/ro/a", wd+"/ro/b"); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+
+	mount := func() *fuse.Server {
+		fses := []pathfs.FileSystem{
+			pathfs.NewLoopbackFileSystem(wd + "/rw"),
+			pathfs.NewLoopbackFileSystem(wd + "/ro"),
+		}
+		nfs := pathfs.NewPathNodeFs(NewUnionFs(fses, testOpts), nil)
+		state, _, err := nodefs.MountFileSystem(wd+"/mnt", nfs, nil)
+		if err != nil {
+			t.Fatalf("MountFileSystem failed: %v", err)
+		}
+		go state.Serve()
+		return state
+	}
+
+	state := mount()
+	WriteFile(t, wd+"/mnt/a", "new")
+	state.Unmount()
+	checkExists(t, wd+"/rw/b", false)
+
+	// The copy is found by looking up a, and b is linked to it
+	// when it is promoted.
+	state = mount()
+	defer state.Unmount()
+	if _, err := os.Lstat(wd + "/mnt/a"); err != nil {
+		t.Fatalf("Lstat failed: %v", err)
+	}
+	if err := os.Chmod(wd+"/mnt/b", 0600); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	checkLinked(t, []string{wd + "/rw/a", wd + "/rw/b"}, 2)
+	if got := readFromFile(t, wd+"/mnt/b"); got != "new" {
+		t.Errorf("b has %q, want %q", got, "new")
+	}
+}
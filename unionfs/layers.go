@@ -0,0 +1,342 @@
+package unionfs
+
+import (
+	"archive/tar"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/hanwen/go-fuse/zipfs"
+)
+
+const (
+	aufsWhiteoutPrefix = ".wh."
+	aufsOpaqueMarker   = ".wh..wh..opq"
+)
+
+// NewLayerUnionFs presents a stack of OCI or Docker image layers as
+// one tree.  The layers are tarballs, plain, gzipped or bzipped,
+// listed bottom layer first, as in an image manifest.  AUFS-style
+// whiteouts (.wh.NAME) and opaque markers (.wh..wh..opq) in the
+// layers hide the entries of the layers below, and hard links may
+// refer to files of the layers below.
+//
+// If writable is not empty, it is a directory that is used as the
+// writable top branch.  Otherwise, the result is read-only.  opts may
+// be nil, in which case overlayfs whiteouts are used in the writable
+// branch.
+func NewLayerUnionFs(layers []string, writable string, opts *UnionFsOptions) (pathfs.FileSystem, error) {
+	if opts == nil {
+		opts = &UnionFsOptions{Whiteouts: WhiteoutOverlay}
+	}
+
+	// Top layer first.
+	var lfses []*layerFs
+	for _, l := range layers {
+		fs, err := newLayerFileSystem(l)
+		if err != nil {
+			return nil, err
+		}
+		fs.resolveLinks(lfses)
+		lfses = append([]*layerFs{fs}, lfses...)
+	}
+
+	var fses []pathfs.FileSystem
+	if writable != "" {
+		fses = append(fses, pathfs.NewLoopbackFileSystem(writable))
+	}
+	for _, fs := range lfses {
+		fses = append(fses, fs)
+	}
+	if len(fses) == 0 {
+		return nil, fmt.Errorf("no layers")
+	}
+	if _, err := branchModes(opts.BranchModes, len(fses)); err != nil {
+		return nil, err
+	}
+
+	o := *opts
+	if writable == "" {
+		// The top layer takes the place of the writable branch.
+		// Its whiteouts only count in overlay mode.
+		o.Whiteouts = WhiteoutOverlay
+	}
+	ufs := NewUnionFs(fses, o)
+	if ufs == nil {
+		return nil, fmt.Errorf("cannot create union of %v", layers)
+	}
+	if writable == "" {
+		ufs = pathfs.NewReadonlyFileSystem(ufs)
+	}
+	return ufs, nil
+}
+
+// NewLayerFileSystem returns a read-only file system for a single
+// image layer tarball.  Whiteouts show up as overlayfs whiteouts,
+// and opaque directories carry the trusted.overlay.opaque and
+// user.overlay.opaque xattrs, so the layer can be used as a
+// read-only branch of a union with any WhiteoutFormat.  Hard links to
+// files of lower layers cannot be opened; use NewLayerUnionFs for
+// those.
+func NewLayerFileSystem(name string) (pathfs.FileSystem, error) {
+	return newLayerFileSystem(name)
+}
+
+func newLayerFileSystem(name string) (*layerFs, error) {
+	files, err := zipfs.ReadTarFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return newLayerFs(name, files), nil
+}
+
+type layerEntry struct {
+	attr fuse.Attr
+	file zipfs.MemFile
+	link string
+
+	// For hard links, the target, until it is found.
+	linkTarget string
+}
+
+// layerFs serves the contents of an image layer.
+type layerFs struct {
+	pathfs.FileSystem
+	name    string
+	entries map[string]*layerEntry
+
+	// Directory listings, and directories with an opaque marker.
+	dirs   map[string]map[string]uint32
+	opaque map[string]bool
+
+	// Attributes of the directories that have an entry in the
+	// tarball.  Others are reported as 0755 and owned by root.
+	dirAttrs map[string]*fuse.Attr
+}
+
+func newLayerFs(name string, files map[string]zipfs.MemFile) *layerFs {
+	fs := &layerFs{
+		FileSystem: pathfs.NewDefaultFileSystem(),
+		name:       name,
+		entries:    map[string]*layerEntry{},
+		dirs:       map[string]map[string]uint32{},
+		opaque:     map[string]bool{},
+		dirAttrs:   map[string]*fuse.Attr{},
+	}
+	fs.addDir("")
+
+	var hardlinks []string
+	for n, f := range files {
+		n = strings.Trim(filepath.Clean(n), "/")
+		if n == "." {
+			continue
+		}
+		dir, base := filepath.Split(n)
+		dir = stripSlash(dir)
+		fs.addDir(dir)
+
+		if base == aufsOpaqueMarker {
+			fs.opaque[dir] = true
+			continue
+		}
+
+		e := &layerEntry{file: f}
+		if strings.HasPrefix(base, aufsWhiteoutPrefix) {
+			n = filepath.Join(dir, base[len(aufsWhiteoutPrefix):])
+			if _, ok := fs.dirs[n]; ok {
+				// Replaced by a directory of this layer.
+				fs.opaque[n] = true
+				continue
+			}
+			e.file = nil
+			e.attr.Mode = syscall.S_IFCHR
+		} else {
+			f.Stat(&e.attr)
+			if tf, ok := f.(*zipfs.TarFile); ok {
+				switch tf.Typeflag {
+				case tar.TypeSymlink:
+					e.attr.Mode = e.attr.Mode&07777 | syscall.S_IFLNK
+					e.link = tf.Linkname
+				case tar.TypeLink:
+					e.file = nil
+					e.linkTarget = strings.Trim(filepath.Clean(tf.Linkname), "/")
+					hardlinks = append(hardlinks, n)
+				case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+					e.attr.Mode = e.attr.Mode&07777 | tarDeviceType(tf.Typeflag)
+					e.attr.Rdev = mkdev(tf.Devmajor, tf.Devminor)
+				case tar.TypeDir:
+					fs.addDir(n)
+					a := e.attr
+					a.Mode = a.Mode&07777 | syscall.S_IFDIR
+					a.Size = 0
+					fs.dirAttrs[n] = &a
+					continue
+				}
+			}
+		}
+		fs.entries[n] = e
+		fs.dirs[dir][filepath.Base(n)] = e.attr.Mode
+	}
+
+	// Number the entries in path order, so the inode numbers are
+	// the same every time the layer is read.
+	names := make([]string, 0, len(fs.entries))
+	for n := range fs.entries {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for i, n := range names {
+		fs.entries[n].attr.Ino = uint64(i + 1)
+	}
+
+	for _, n := range hardlinks {
+		e := fs.entries[n]
+		if e == nil {
+			continue
+		}
+		if t := fs.entries[e.linkTarget]; t != nil && t.file != nil && t.linkTarget == "" {
+			e.file = t.file
+			e.attr = t.attr
+			e.linkTarget = ""
+		}
+	}
+	return fs
+}
+
+// resolveLinks finds the targets of hard links that are not in this
+// layer in the layers below, given top first.
+func (fs *layerFs) resolveLinks(lower []*layerFs) {
+	for _, e := range fs.entries {
+		if e.linkTarget == "" {
+			continue
+		}
+		for _, l := range lower {
+			t := l.entries[e.linkTarget]
+			if t != nil && t.file != nil && t.attr.IsRegular() {
+				ino := e.attr.Ino
+				e.file = t.file
+				e.attr = t.attr
+				e.attr.Ino = ino
+				e.linkTarget = ""
+				break
+			}
+			dir, _ := filepath.Split(e.linkTarget)
+			if t != nil || l.opaque[stripSlash(dir)] {
+				// A whiteout, or not a file.
+				break
+			}
+		}
+	}
+}
+
+func tarDeviceType(flag byte) uint32 {
+	switch flag {
+	case tar.TypeChar:
+		return syscall.S_IFCHR
+	case tar.TypeBlock:
+		return syscall.S_IFBLK
+	}
+	return syscall.S_IFIFO
+}
+
+// mkdev encodes a device number like the Linux kernel does in 32
+// bits, which is how FUSE passes Attr.Rdev and mknod takes it.
+func mkdev(major, minor int64) uint32 {
+	return uint32(minor&0xff | (major&0xfff)<<8 | (minor&^0xff)<<12)
+}
+
+// devMajor and devMinor decode a device number made by mkdev.
+func devMajor(dev uint32) int64 {
+	return int64(dev>>8) & 0xfff
+}
+
+func devMinor(dev uint32) int64 {
+	return int64(dev&0xff | (dev>>12)&^0xff)
+}
+
+// addDir adds dir and its parents, unless they are known already.
+func (fs *layerFs) addDir(dir string) {
+	if _, ok := fs.dirs[dir]; ok {
+		return
+	}
+	fs.dirs[dir] = map[string]uint32{}
+	if dir == "" {
+		return
+	}
+	parent, base := filepath.Split(dir)
+	parent = stripSlash(parent)
+	fs.addDir(parent)
+	fs.dirs[parent][base] = fuse.S_IFDIR
+	if e := fs.entries[dir]; e != nil && e.attr.Mode&syscall.S_IFMT == syscall.S_IFCHR {
+		// A whiteout for the directory of a lower layer, and a
+		// new directory in this layer.
+		fs.opaque[dir] = true
+	}
+	delete(fs.entries, dir)
+}
+
+func (fs *layerFs) String() string {
+	return fmt.Sprintf("layerFs(%s)", fs.name)
+}
+
+func (fs *layerFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if _, ok := fs.dirs[name]; ok {
+		if a := fs.dirAttrs[name]; a != nil {
+			out := *a
+			return &out, fuse.OK
+		}
+		return &fuse.Attr{Mode: fuse.S_IFDIR | 0755}, fuse.OK
+	}
+	e := fs.entries[name]
+	if e == nil {
+		return nil, fuse.ENOENT
+	}
+	a := e.attr
+	return &a, fuse.OK
+}
+
+func (fs *layerFs) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	if _, ok := fs.dirs[name]; !ok && fs.entries[name] == nil {
+		return nil, fuse.ENOENT
+	}
+	if (attr == overlayOpaqueXAttr || attr == overlayUserOpaqueXAttr) && fs.opaque[name] {
+		return []byte("y"), fuse.OK
+	}
+	return nil, fuse.ENODATA
+}
+
+func (fs *layerFs) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	d, ok := fs.dirs[name]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	stream := make([]fuse.DirEntry, 0, len(d))
+	for n, mode := range d {
+		stream = append(stream, fuse.DirEntry{Name: n, Mode: mode})
+	}
+	return stream, fuse.OK
+}
+
+func (fs *layerFs) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EPERM
+	}
+	e := fs.entries[name]
+	if e == nil || e.file == nil || !e.attr.IsRegular() {
+		return nil, fuse.ENOENT
+	}
+	return nodefs.NewDataFile(e.file.Data()), fuse.OK
+}
+
+func (fs *layerFs) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	e := fs.entries[name]
+	if e == nil || !e.attr.IsSymlink() {
+		return "", fuse.ENOENT
+	}
+	return e.link, fuse.OK
+}
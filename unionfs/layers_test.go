@@ -0,0 +1,213 @@
+package unionfs
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+type tarEntry struct {
+	name    string
+	content string
+	link    string
+	flag    byte
+	mode    int64
+}
+
+func writeLayer(t *testing.T, name string, compress bool, entries []tarEntry) {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer f.Close()
+	var w io.Writer = f
+	if compress {
+		gz := gzip.NewWriter(f)
+		defer gz.Close()
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+	for _, e := range entries {
+		flag := e.flag
+		if flag == 0 {
+			flag = tar.TypeReg
+		}
+		mode := e.mode
+		if mode == 0 {
+			mode = 0644
+			if flag == tar.TypeDir {
+				mode = 0755
+			}
+		}
+		hdr := &tar.Header{
+			Name:     e.name,
+			Mode:     mode,
+			Size:     int64(len(e.content)),
+			Linkname: e.link,
+			Typeflag: flag,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader failed: %v", err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+}
+
+func setupLayers(t *testing.T, writable bool) (wd string, clean func()) {
+	wd, err := ioutil.TempDir("", "unionfs")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	os.Mkdir(wd+"/mnt", 0755)
+	os.Mkdir(wd+"/rw", 0755)
+
+	writeLayer(t, wd+"/layer1.tar", false, []tarEntry{
+		{name: "etc/", flag: tar.TypeDir},
+		{name: "etc/a", content: "a1"},
+		{name: "etc/b", content: "b1"},
+		{name: "dir/x", content: "x1"},
+		{name: "link", link: "etc/b", flag: tar.TypeSymlink},
+		{name: "hard", link: "etc/b", flag: tar.TypeLink},
+		{name: "tmp/", flag: tar.TypeDir, mode: 01777},
+		{name: "empty/", flag: tar.TypeDir},
+	})
+	writeLayer(t, wd+"/layer2.tar.gz", true, []tarEntry{
+		{name: "./etc/.wh.a"},
+		{name: "./etc/c", content: "c2"},
+		{name: "./dir/.wh..wh..opq"},
+		{name: "./dir/y", content: "y2"},
+		{name: "./lowerhard", link: "etc/b", flag: tar.TypeLink},
+	})
+
+	rw := ""
+	if writable {
+		rw = wd + "/rw"
+	}
+	ufs, err := NewLayerUnionFs([]string{wd + "/layer1.tar", wd + "/layer2.tar.gz"}, rw, nil)
+	if err != nil {
+		t.Fatalf("NewLayerUnionFs failed: %v", err)
+	}
+	state, _, err := nodefs.MountFileSystem(wd+"/mnt", pathfs.NewPathNodeFs(ufs, nil), nil)
+	if err != nil {
+		t.Fatalf("MountFileSystem failed: %v", err)
+	}
+	state.SetDebug(fuse.VerboseTest())
+	go state.Serve()
+	return wd, func() {
+		state.Unmount()
+		os.RemoveAll(wd)
+	}
+}
+
+func TestLayerUnionFs(t *testing.T) {
+	wd, clean := setupLayers(t, false)
+	defer clean()
+
+	checkMapEq(t, dirNames(t, wd+"/mnt/etc"), map[string]bool{"b": true, "c": true})
+	checkMapEq(t, dirNames(t, wd+"/mnt/dir"), map[string]bool{"y": true})
+	if c := readFromFile(t, wd+"/mnt/etc/c"); c != "c2" {
+		t.Errorf("etc/c: got %q", c)
+	}
+	for _, n := range []string{"hard", "lowerhard"} {
+		if c := readFromFile(t, wd+"/mnt/"+n); c != "b1" {
+			t.Errorf("%s: got %q", n, c)
+		}
+	}
+	if fi, err := os.Lstat(wd + "/mnt/tmp"); err != nil || fi.Mode() != os.ModeDir|os.ModeSticky|0777 {
+		t.Errorf("tmp: got %v, %v, want mode 1777", fi, err)
+	}
+	if fi, err := os.Lstat(wd + "/mnt/empty"); err != nil || !fi.IsDir() {
+		t.Errorf("empty directory: got %v, %v", fi, err)
+	}
+	if l, err := os.Readlink(wd + "/mnt/link"); err != nil || l != "etc/b" {
+		t.Errorf("Readlink: got %q, %v", l, err)
+	}
+	if _, err := os.Lstat(wd + "/mnt/etc/a"); !os.IsNotExist(err) {
+		t.Errorf("etc/a: got %v, want ENOENT", err)
+	}
+	if err := ioutil.WriteFile(wd+"/mnt/new", []byte("x"), 0644); err == nil {
+		t.Errorf("write to read-only layers should fail")
+	}
+}
+
+func TestLayerUnionFsWritable(t *testing.T) {
+	wd, clean := setupLayers(t, true)
+	defer clean()
+
+	if err := ioutil.WriteFile(wd+"/mnt/etc/new", []byte("new"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := os.Remove(wd + "/mnt/etc/b"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	checkMapEq(t, dirNames(t, wd+"/mnt/etc"), map[string]bool{"c": true, "new": true})
+	if !isWhiteoutFile(t, filepath.Join(wd, "rw/etc/b")) {
+		t.Errorf("no whiteout for etc/b")
+	}
+}
+
+func TestLayerUnionFsBadBranchModes(t *testing.T) {
+	wd, err := ioutil.TempDir("", "unionfs")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(wd)
+	writeLayer(t, wd+"/layer.tar", false, []tarEntry{{name: "file", content: "file"}})
+
+	opts := UnionFsOptions{BranchModes: []BranchMode{BranchRO}}
+	if ufs, err := NewLayerUnionFs([]string{wd + "/layer.tar"}, "", &opts); err == nil {
+		t.Errorf("NewLayerUnionFs succeeded: %v", ufs)
+	}
+}
+
+func TestLayerFileSystemInodes(t *testing.T) {
+	wd, err := ioutil.TempDir("", "unionfs")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(wd)
+	names := []string{"a", "b", "c/d", "e", "f"}
+	writeLayer(t, wd+"/layer.tar", false, []tarEntry{
+		{name: "f"}, {name: "c/d"}, {name: "a"}, {name: "e"}, {name: "b"},
+	})
+
+	fs, err := NewLayerFileSystem(wd + "/layer.tar")
+	if err != nil {
+		t.Fatalf("NewLayerFileSystem failed: %v", err)
+	}
+	for i, n := range names {
+		if a, code := fs.GetAttr(n, nil); !code.Ok() || a.Ino != uint64(i+1) {
+			t.Errorf("%s: got %v, %v, want inode %d", n, a, code, i+1)
+		}
+	}
+}
+
+func TestLayerDeviceNumbers(t *testing.T) {
+	for _, c := range []struct {
+		major, minor int64
+		dev          uint32
+	}{
+		{1, 3, 0x103},
+		{8, 300, 0x10082c},
+		{259, 65537, 0x10010301},
+	} {
+		dev := mkdev(c.major, c.minor)
+		if dev != c.dev {
+			t.Errorf("mkdev(%d, %d): got %#x, want %#x", c.major, c.minor, dev, c.dev)
+		}
+		if devMajor(dev) != c.major || devMinor(dev) != c.minor {
+			t.Errorf("%#x: got %d, %d, want %d, %d", dev, devMajor(dev), devMinor(dev), c.major, c.minor)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package unionfs
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// metaCopyXAttr marks an empty file in the writable branch as a
+// metadata-only copy of a file in the read-only branches, like the
+// trusted.overlay.metacopy xattr of overlayfs.  The value has the
+// name of the read-only branch with the data and the path of the data
+// in it, so the placeholder can be renamed without copying, and the
+// read-only branches reordered.  Placeholders are resolved whether or
+// not MetadataCopyUp is set.
+const metaCopyXAttr = "user.unionfs.metacopy"
+
+// promoteMetadata promotes name for changing its attributes, and
+// returns the writable branch it went to.  With MetadataCopyUp,
+// regular files get a placeholder that carries the attributes, while
+// the data stays in the read-only branch until it is opened for
+// writing.  Hard-linked files are copied fully, so their other names
+// can be linked to the copy, and so are files of branches that are
+// being removed.
+func (fs *unionFS) promoteMetadata(name string, srcResult branchResult, context *fuse.Context) (int, fuse.Status) {
+	if !fs.options.MetadataCopyUp || !srcResult.attr.IsRegular() || srcResult.attr.Size == 0 || srcResult.attr.Nlink > 1 || fs.isRetiring(srcResult.branch) {
+		return fs.Promote(name, srcResult, context)
+	}
+
+	dst, code := fs.createBranch(name)
+	if !code.Ok() {
+		return dst, code
+	}
+	code = fs.createPlaceholder(name, srcResult, dst, context)
+	if !code.Ok() {
+		log.Printf("metadata copy-up of %q failed, copying: %v", name, code)
+		return dst, fs.promoteTo(name, srcResult, dst, context)
+	}
+	r := srcResult
+	r.branch = dst
+	fs.branchCache.Set(name, r)
+	return dst, fuse.OK
+}
+
+func (fs *unionFS) createPlaceholder(name string, srcResult branchResult, dst int, context *fuse.Context) fuse.Status {
+	writable := fs.fileSystems[dst]
+	if code := fs.promoteDirsTo(name, dst); !code.Ok() {
+		return code
+	}
+
+	f, code := writable.Create(name, uint32(os.O_WRONLY|os.O_CREATE|os.O_EXCL), srcResult.attr.Mode&07777|0200, context)
+	if !code.Ok() {
+		return code
+	}
+	f.Release()
+
+	code = writable.SetXAttr(name, metaCopyXAttr, encodeMetaCopy(fs.branchName(srcResult.branch), name), 0, context)
+	if code.Ok() {
+		code = writable.Chmod(name, srcResult.attr.Mode&07777|0200, context)
+	}
+	if code.Ok() {
+		aTime := srcResult.attr.AccessTime()
+		mTime := srcResult.attr.ModTime()
+		code = writable.Utimens(name, &aTime, &mTime, context)
+	}
+	if !code.Ok() {
+		writable.Unlink(name, context)
+	}
+	return code
+}
+
+func encodeMetaCopy(source, origin string) []byte {
+	return []byte(fmt.Sprintf("%q %q", source, origin))
+}
+
+func decodeMetaCopy(data []byte) (source, origin string, err error) {
+	_, err = fmt.Sscanf(string(data), "%q %q", &source, &origin)
+	return source, origin, err
+}
+
+// metaCopySource returns the branch and path of the data for name in
+// the writable branch w.  It returns a negative branch if name is not
+// a placeholder, and EIO if it is one whose data is gone.
+func (fs *unionFS) metaCopySource(name string, w int) (branch int, origin string, attr *fuse.Attr, code fuse.Status) {
+	data, code := fs.fileSystems[w].GetXAttr(name, metaCopyXAttr, nil)
+	if !code.Ok() {
+		return -1, "", nil, fuse.OK
+	}
+	if a, code := fs.fileSystems[w].GetAttr(name, nil); !code.Ok() || !a.IsRegular() || a.Size != 0 {
+		return -1, "", nil, fuse.OK
+	}
+	source, origin, err := decodeMetaCopy(data)
+	if err != nil {
+		log.Printf("metadata copy-up of %q: bad value %q: %v", name, data, err)
+		return -1, "", nil, fuse.EIO
+	}
+	branch = fs.readOnlyBranch(source)
+	if branch < 0 {
+		log.Printf("metadata copy-up of %q: no read-only branch %s", name, source)
+		return -1, "", nil, fuse.EIO
+	}
+	a, code := fs.fileSystems[branch].GetAttr(origin, nil)
+	if !code.Ok() || !a.IsRegular() {
+		log.Printf("metadata copy-up of %q: data %q is gone from %s", name, origin, source)
+		return -1, "", nil, fuse.EIO
+	}
+	return branch, origin, a, fuse.OK
+}
+
+// setMetaCopyAttr fills in the size of a placeholder in writable
+// branch w from its data.
+func (fs *unionFS) setMetaCopyAttr(name string, w int, a *fuse.Attr) {
+	if !a.IsRegular() || a.Size != 0 {
+		return
+	}
+	if branch, _, src, _ := fs.metaCopySource(name, w); branch >= 0 {
+		a.Size = src.Size
+		a.Blocks = src.Blocks
+	}
+}
+
+// completeMetaCopy copies the data of a placeholder in writable
+// branch w, unless it is about to be truncated anyway.
+func (fs *unionFS) completeMetaCopy(name string, w int, copyData bool, context *fuse.Context) fuse.Status {
+	branch, origin, _, code := fs.metaCopySource(name, w)
+	if !code.Ok() && copyData {
+		return code
+	}
+	if branch < 0 && code.Ok() {
+		return fuse.OK
+	}
+
+	writable := fs.fileSystems[w]
+	meta, code := writable.GetAttr(name, context)
+	if !code.Ok() {
+		return code
+	}
+	if copyData {
+		// The file exists, so this keeps its owner and mode.
+		code = pathfs.CopyFile(fs.fileSystems[branch], writable, origin, name, context)
+	}
+	if code.Ok() {
+		aTime := meta.AccessTime()
+		mTime := meta.ModTime()
+		code = writable.Utimens(name, &aTime, &mTime, context)
+	}
+	if code.Ok() {
+		code = writable.RemoveXAttr(name, metaCopyXAttr, context)
+	}
+	if !code.Ok() {
+		return code
+	}
+	fs.branchCache.GetFresh(name)
+
+	for _, fileWrapper := range fs.nodeFs.AllFiles(name, 0) {
+		uf := findUnionFsFile(fileWrapper.File)
+		if _, ok := uf.File.(*metaCopyFile); !ok {
+			continue
+		}
+		f := uf.File
+		uf.File, code = fs.openWritable(name, w, fileWrapper.OpenFlags, context)
+		f.Release()
+		if !code.Ok() {
+			return code
+		}
+	}
+	return fuse.OK
+}
+
+// openPlaceholder opens a placeholder in the writable branch for
+// reading, with the data coming from the read-only branch.  For
+// writing, it copies the data first.  It returns a nil file if name
+// should be opened as usual.
+func (fs *unionFS) openPlaceholder(name string, w int, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&(fuse.O_ANYWRITE|syscall.O_TRUNC) != 0 {
+		code := fs.completeMetaCopy(name, w, flags&syscall.O_TRUNC == 0, context)
+		return nil, code
+	}
+
+	branch, origin, _, code := fs.metaCopySource(name, w)
+	if branch < 0 {
+		return nil, code
+	}
+	meta, code := fs.fileSystems[w].Open(name, flags, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	data, code := fs.fileSystems[branch].Open(origin, flags, context)
+	if !code.Ok() {
+		meta.Release()
+		return nil, code
+	}
+	return &metaCopyFile{File: data, meta: meta}, fuse.OK
+}
+
+// metaCopyFile reads the data of a placeholder from the read-only
+// branch, and the attributes from the placeholder.
+type metaCopyFile struct {
+	nodefs.File
+	meta nodefs.File
+}
+
+func (f *metaCopyFile) InnerFile() nodefs.File {
+	return f.File
+}
+
+func (f *metaCopyFile) String() string {
+	return fmt.Sprintf("metaCopyFile(%s)", f.File.String())
+}
+
+func (f *metaCopyFile) Release() {
+	f.File.Release()
+	f.meta.Release()
+}
+
+func (f *metaCopyFile) GetAttr(out *fuse.Attr) fuse.Status {
+	var data fuse.Attr
+	if code := f.File.GetAttr(&data); !code.Ok() {
+		return code
+	}
+	if code := f.meta.GetAttr(out); !code.Ok() {
+		return code
+	}
+	out.Size = data.Size
+	out.Blocks = data.Blocks
+	return fuse.OK
+}
+
+// findUnionFsFile returns the unionFsFile that f wraps.
+func findUnionFsFile(f nodefs.File) *unionFsFile {
+	for f != nil {
+		if uf, ok := f.(*unionFsFile); ok {
+			return uf
+		}
+		f = f.InnerFile()
+	}
+	panic("no unionFsFile found inside")
+}
@@ -0,0 +1,159 @@
+package unionfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+func setupMetaCopyUfs(t *testing.T) (wd string, clean func()) {
+	opts := testOpts
+	opts.MetadataCopyUp = true
+	return setupUfsWithOptions(t, opts)
+}
+
+func isPlaceholder(name string) bool {
+	buf := make([]byte, 1024)
+	_, err := syscall.Getxattr(name, metaCopyXAttr, buf)
+	return err == nil
+}
+
+func TestUnionFsMetadataCopyUp(t *testing.T) {
+	wd, clean := setupMetaCopyUfs(t)
+	defer clean()
+
+	content := "hello world"
+	WriteFile(t, wd+"/ro/file", content)
+	if err := os.Chmod(wd+"/mnt/file", 0604); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+
+	fi, err := os.Lstat(wd + "/rw/file")
+	if err != nil {
+		t.Fatalf("Lstat failed: %v", err)
+	}
+	if fi.Size() != 0 || !isPlaceholder(wd+"/rw/file") {
+		t.Fatalf("rw/file: got size %d, want empty placeholder", fi.Size())
+	}
+
+	fi, err = os.Lstat(wd + "/mnt/file")
+	if err != nil {
+		t.Fatalf("Lstat failed: %v", err)
+	}
+	if fi.Size() != int64(len(content)) || fi.Mode().Perm() != 0604 {
+		t.Errorf("got size %d mode %o, want %d %o", fi.Size(), fi.Mode().Perm(), len(content), 0604)
+	}
+	if got := readFromFile(t, wd+"/mnt/file"); got != content {
+		t.Errorf("got %q, want %q", got, content)
+	}
+
+	f, err := os.OpenFile(wd+"/mnt/file", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("!"), int64(len(content))); err != nil {
+		t.Errorf("WriteAt failed: %v", err)
+	}
+	f.Close()
+
+	if isPlaceholder(wd + "/rw/file") {
+		t.Errorf("rw/file is still a placeholder after writing")
+	}
+	if got := readFromFile(t, wd+"/rw/file"); got != content+"!" {
+		t.Errorf("got %q, want %q", got, content+"!")
+	}
+	fi, err = os.Lstat(wd + "/rw/file")
+	if err != nil {
+		t.Fatalf("Lstat failed: %v", err)
+	}
+	if fi.Mode().Perm() != 0604 {
+		t.Errorf("got mode %o, want %o", fi.Mode().Perm(), 0604)
+	}
+}
+
+func TestUnionFsMetadataCopyUpRename(t *testing.T) {
+	wd, clean := setupMetaCopyUfs(t)
+	defer clean()
+
+	content := "hello world"
+	WriteFile(t, wd+"/ro/file", content)
+	if err := os.Chmod(wd+"/mnt/file", 0604); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	if err := os.Rename(wd+"/mnt/file", wd+"/mnt/renamed"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if !isPlaceholder(wd + "/rw/renamed") {
+		t.Errorf("rw/renamed is not a placeholder")
+	}
+	if got := readFromFile(t, wd+"/mnt/renamed"); got != content {
+		t.Errorf("got %q, want %q", got, content)
+	}
+	if _, err := os.Lstat(wd + "/mnt/file"); err == nil {
+		t.Errorf("file still exists after rename")
+	}
+
+	// Truncating needs no data.
+	if err := ioutil.WriteFile(wd+"/mnt/renamed", []byte("new"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if got := readFromFile(t, wd+"/mnt/renamed"); got != "new" {
+		t.Errorf("got %q, want %q", got, "new")
+	}
+}
+
+func TestUnionFsMetadataCopyUpSource(t *testing.T) {
+	wd, _ := ioutil.TempDir("", "unionfs")
+	defer os.RemoveAll(wd)
+
+	var fses []pathfs.FileSystem
+	for _, d := range []string{"rw/dir", "ro1/dir", "ro2/dir"} {
+		if err := os.MkdirAll(filepath.Join(wd, d), 0755); err != nil {
+			t.Fatalf("MkdirAll failed: %v", err)
+		}
+		fses = append(fses, pathfs.NewLoopbackFileSystem(filepath.Join(wd, filepath.Dir(d))))
+	}
+	WriteFile(t, wd+"/ro1/dir/file", "other")
+	WriteFile(t, wd+"/ro2/dir/file", "data")
+	WriteFile(t, wd+"/rw/dir/file", "")
+	if err := syscall.Setxattr(wd+"/rw/dir/file", metaCopyXAttr, encodeMetaCopy(fses[2].String(), "dir/file"), 0); err != nil {
+		t.Skipf("no user xattrs on %s: %v", wd, err)
+	}
+
+	// The data comes from the branch it was recorded for.
+	ufs := NewUnionFs(fses, testOpts).(*unionFS)
+	if b, _, _, _ := ufs.metaCopySource("dir/file", 0); b != 2 {
+		t.Fatalf("got data in branch %d, want 2", b)
+	}
+	if err := os.Remove(wd + "/ro2/dir/file"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if b, _, _, code := ufs.metaCopySource("dir/file", 0); b >= 0 || code != fuse.EIO {
+		t.Errorf("got data in branch %d, %v after it was removed, want EIO", b, code)
+	}
+}
+
+func TestUnionFsMetadataCopyUpOff(t *testing.T) {
+	// A branch with placeholders may be mounted without
+	// MetadataCopyUp.
+	wd, clean := setupUfs(t)
+	defer clean()
+
+	content := "hello world"
+	WriteFile(t, wd+"/ro/file", content)
+	WriteFile(t, wd+"/rw/file", "")
+	if err := syscall.Setxattr(wd+"/rw/file", metaCopyXAttr, encodeMetaCopy(roBranchName(wd), "file"), 0); err != nil {
+		t.Skipf("no user xattrs on %s: %v", wd, err)
+	}
+	if fi, err := os.Lstat(wd + "/mnt/file"); err != nil || fi.Size() != int64(len(content)) {
+		t.Errorf("got %v, %v, want size %d", fi, err, len(content))
+	}
+	if got := readFromFile(t, wd+"/mnt/file"); got != content {
+		t.Errorf("got %q, want %q", got, content)
+	}
+}
@@ -0,0 +1,401 @@
+package unionfs
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// BranchMode says how a branch of the union may be modified.
+type BranchMode int
+
+const (
+	// Read-write: files may be changed and created.
+	BranchRW = BranchMode(iota)
+
+	// Read-only: files are promoted to a read-write branch before
+	// they are changed.
+	BranchRO
+
+	// No-create: existing files may be changed in place, but new
+	// files, directories and promoted files go elsewhere.
+	BranchNC
+)
+
+func (m BranchMode) String() string {
+	switch m {
+	case BranchRW:
+		return "RW"
+	case BranchRO:
+		return "RO"
+	case BranchNC:
+		return "NC"
+	}
+	return fmt.Sprintf("BranchMode(%d)", int(m))
+}
+
+// PolicyBranch describes a branch to a placement policy.
+type PolicyBranch struct {
+	// Index of the branch, as passed to NewUnionFs.
+	Index      int
+	FileSystem pathfs.FileSystem
+}
+
+// CreatePolicy chooses the branch for new files and directories, and
+// for files that are promoted out of read-only branches.
+type CreatePolicy interface {
+	// Create returns the Index of the branch for name, chosen
+	// from branches, or -1 if none will do.  The branches are the
+	// read-write ones, in order.
+	Create(name string, branches []PolicyBranch) int
+}
+
+// SearchPolicy chooses which copy of a file is used, if more than one
+// writable branch has it.  Directories always come from the first
+// branch that has them, with the others merged in.
+type SearchPolicy interface {
+	// Search returns the Index of the branch to use, chosen from
+	// branches, which all have name.
+	Search(name string, branches []PolicyBranch) int
+}
+
+// firstFound picks the first branch.  It is the default create
+// policy.
+type firstFound struct{}
+
+func (firstFound) Create(name string, branches []PolicyBranch) int {
+	return branches[0].Index
+}
+
+// MostFreeSpace returns a create policy that picks the branch with
+// the most available space, as reported by StatFs.  The numbers are
+// reused for freeSpaceTTL, so creating many files does not call
+// StatFs for each.
+func MostFreeSpace() CreatePolicy {
+	return &mostFreeSpace{free: map[int]branchFree{}}
+}
+
+const freeSpaceTTL = time.Second
+
+type branchFree struct {
+	bytes uint64
+	known bool
+	when  time.Time
+}
+
+type mostFreeSpace struct {
+	mu sync.Mutex
+
+	// By branch index.
+	free map[int]branchFree
+}
+
+func (p *mostFreeSpace) branchFree(b PolicyBranch) branchFree {
+	p.mu.Lock()
+	f, ok := p.free[b.Index]
+	p.mu.Unlock()
+	if ok && time.Since(f.when) < freeSpaceTTL {
+		return f
+	}
+
+	f = branchFree{when: time.Now()}
+	if s := b.FileSystem.StatFs(""); s != nil {
+		f.bytes = s.Bavail * uint64(s.Bsize)
+		f.known = true
+	}
+	p.mu.Lock()
+	p.free[b.Index] = f
+	p.mu.Unlock()
+	return f
+}
+
+func (p *mostFreeSpace) Create(name string, branches []PolicyBranch) int {
+	best := -1
+	var bestFree uint64
+	for _, b := range branches {
+		f := p.branchFree(b)
+		if !f.known {
+			continue
+		}
+		if best < 0 || f.bytes > bestFree {
+			best, bestFree = b.Index, f.bytes
+		}
+	}
+	if best < 0 {
+		return branches[0].Index
+	}
+	return best
+}
+
+// ExistingPathFirst returns a create policy that picks the first
+// branch where the parent directory of the new entry exists already,
+// and asks fallback otherwise.  A nil fallback picks the first
+// branch.
+func ExistingPathFirst(fallback CreatePolicy) CreatePolicy {
+	if fallback == nil {
+		fallback = firstFound{}
+	}
+	return &existingPathFirst{fallback}
+}
+
+type existingPathFirst struct {
+	fallback CreatePolicy
+}
+
+func (p *existingPathFirst) Create(name string, branches []PolicyBranch) int {
+	dir := stripSlash(filepath.Dir(name))
+	if dir == "." {
+		dir = ""
+	}
+	for _, b := range branches {
+		if a, code := b.FileSystem.GetAttr(dir, nil); code.Ok() && a.IsDir() {
+			return b.Index
+		}
+	}
+	return p.fallback.Create(name, branches)
+}
+
+// RoundRobin returns a create policy that cycles through the
+// branches.
+func RoundRobin() CreatePolicy {
+	return &roundRobin{}
+}
+
+type roundRobin struct {
+	mu   sync.Mutex
+	next int
+}
+
+func (p *roundRobin) Create(name string, branches []PolicyBranch) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b := branches[p.next%len(branches)]
+	p.next++
+	return b.Index
+}
+
+// DirectoryAffinity returns a create policy that places everything
+// below the directories in dirs on the branch with the given index.
+// The deepest matching directory wins.  Entries outside these
+// directories, or pinned to a branch that cannot take them, are
+// placed by fallback.  A nil fallback picks the first branch.
+func DirectoryAffinity(dirs map[string]int, fallback CreatePolicy) CreatePolicy {
+	if fallback == nil {
+		fallback = firstFound{}
+	}
+	p := &directoryAffinity{
+		dirs:     map[string]int{},
+		fallback: fallback,
+	}
+	for d, i := range dirs {
+		p.dirs[strings.Trim(filepath.Clean(d), "/")] = i
+	}
+	return p
+}
+
+type directoryAffinity struct {
+	dirs     map[string]int
+	fallback CreatePolicy
+}
+
+func (p *directoryAffinity) Create(name string, branches []PolicyBranch) int {
+	for d := name; ; {
+		d = stripSlash(filepath.Dir(d))
+		if d == "." || d == "/" {
+			d = ""
+		}
+		if i, ok := p.dirs[d]; ok {
+			for _, b := range branches {
+				if b.Index == i {
+					return i
+				}
+			}
+			break
+		}
+		if d == "" {
+			break
+		}
+	}
+	return p.fallback.Create(name, branches)
+}
+
+// Newest returns a search policy that picks the copy with the latest
+// modification time.
+func Newest() SearchPolicy {
+	return newest{}
+}
+
+type newest struct{}
+
+func (newest) Search(name string, branches []PolicyBranch) int {
+	best := branches[0].Index
+	var bestTime int64
+	for _, b := range branches {
+		a, code := b.FileSystem.GetAttr(name, nil)
+		if !code.Ok() {
+			continue
+		}
+		if t := a.ModTime().UnixNano(); t > bestTime {
+			best, bestTime = b.Index, t
+		}
+	}
+	return best
+}
+
+// writable returns whether files in branch i can be changed in place.
+func (fs *unionFS) writable(i int) bool {
+	return i >= 0 && fs.modes[i] != BranchRO
+}
+
+// createBranch returns the branch for a new entry name.
+func (fs *unionFS) createBranch(name string) (int, fuse.Status) {
+	var candidates []PolicyBranch
+	for i, m := range fs.modes {
+		if m == BranchRW {
+			candidates = append(candidates, PolicyBranch{i, fs.fileSystems[i]})
+		}
+	}
+	if len(candidates) == 0 {
+		return -1, fuse.EROFS
+	}
+	policy := fs.options.CreatePolicy
+	if policy == nil {
+		policy = firstFound{}
+	}
+	i := policy.Create(name, candidates)
+	for _, c := range candidates {
+		if c.Index == i {
+			return i, fuse.OK
+		}
+	}
+	return -1, fuse.EROFS
+}
+
+// search applies the search policy to a file found first in branch
+// first, which is writable.
+func (fs *unionFS) search(name string, first int, last int, a *fuse.Attr) (int, *fuse.Attr) {
+	candidates := []PolicyBranch{{first, fs.fileSystems[first]}}
+	attrs := map[int]*fuse.Attr{first: a}
+	for i := first + 1; i <= last && fs.writable(i); i++ {
+		b, code := fs.fileSystems[i].GetAttr(name, nil)
+		if !code.Ok() {
+			continue
+		}
+		if fs.isWhiteout(i, b) || b.IsDir() {
+			break
+		}
+		candidates = append(candidates, PolicyBranch{i, fs.fileSystems[i]})
+		attrs[i] = b
+	}
+	if len(candidates) == 1 {
+		return first, a
+	}
+	i := fs.options.SearchPolicy.Search(name, candidates)
+	if attrs[i] == nil {
+		return first, a
+	}
+	return i, attrs[i]
+}
+
+// branchesWith returns the writable branches that have name.
+func (fs *unionFS) branchesWith(name string) []int {
+	var r []int
+	for i := range fs.fileSystems {
+		if !fs.writable(i) {
+			break
+		}
+		a, code := fs.fileSystems[i].GetAttr(name, nil)
+		if code.Ok() && !fs.isWhiteout(i, a) {
+			r = append(r, i)
+		}
+	}
+	return r
+}
+
+// branchDevice returns the device of the root of a branch that is a
+// local directory, such as a loopback file system.
+func branchDevice(b pathfs.FileSystem) (uint64, bool) {
+	l, ok := b.(interface {
+		GetPath(relPath string) string
+	})
+	if !ok {
+		return 0, false
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(l.GetPath(""), &st); err != nil {
+		return 0, false
+	}
+	return uint64(st.Dev), true
+}
+
+// StatFs sums the sizes of the branches, in units of the block size
+// of the first one.  Free space only counts on branches that take
+// new files.  Branches that are directories on the same device are
+// counted once; the union cannot tell whether other branches share
+// a file system.
+func (fs *unionFS) StatFs(name string) *nodefs.StatfsOut {
+	fs.branchLock.RLock()
+	defer fs.branchLock.RUnlock()
+	var out *nodefs.StatfsOut
+	seen := map[uint64]bool{}
+	for i, b := range fs.fileSystems {
+		s := b.StatFs("")
+		if s == nil || s.Bsize == 0 {
+			continue
+		}
+		if dev, ok := branchDevice(b); ok {
+			if seen[dev] {
+				continue
+			}
+			seen[dev] = true
+		}
+		if out == nil {
+			out = &nodefs.StatfsOut{
+				Bsize:   s.Bsize,
+				Frsize:  s.Frsize,
+				NameLen: s.NameLen,
+			}
+		}
+		scale := func(n uint64) uint64 {
+			return n * uint64(s.Bsize) / uint64(out.Bsize)
+		}
+		out.Blocks += scale(s.Blocks)
+		out.Files += s.Files
+		if fs.modes[i] == BranchRW {
+			out.Bfree += scale(s.Bfree)
+			out.Bavail += scale(s.Bavail)
+			out.Ffree += s.Ffree
+		}
+		if s.NameLen < out.NameLen {
+			out.NameLen = s.NameLen
+		}
+	}
+	return out
+}
+
+// branchModes checks the modes for n branches, filling in the
+// defaults if modes is nil.
+func branchModes(modes []BranchMode, n int) ([]BranchMode, error) {
+	if modes == nil {
+		modes = make([]BranchMode, n)
+		for i := 1; i < n; i++ {
+			modes[i] = BranchRO
+		}
+	}
+	if len(modes) != n || n == 0 || modes[0] == BranchRO {
+		return nil, fmt.Errorf("bad branch modes %v", modes)
+	}
+	for i := 1; i < n; i++ {
+		if modes[i-1] == BranchRO && modes[i] != BranchRO {
+			return nil, fmt.Errorf("writable branch %d follows a read-only branch", i)
+		}
+	}
+	return modes, nil
+}
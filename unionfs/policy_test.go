@@ -0,0 +1,230 @@
+package unionfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// setupBranchUfs mounts a union of the directories b0, b1 and ro in
+// a fresh work directory.
+func setupBranchUfs(t *testing.T, opts UnionFsOptions) (wd string, clean func()) {
+	if opts.BranchModes == nil {
+		opts.BranchModes = []BranchMode{BranchRW, BranchRW, BranchRO}
+	}
+	opts.BranchCacheTTL = testOpts.BranchCacheTTL
+	opts.DeletionCacheTTL = testOpts.DeletionCacheTTL
+	opts.DeletionDirName = testOpts.DeletionDirName
+	return setupUfsBranches(t, opts, "b0", "b1", "ro")
+}
+
+func checkExists(t *testing.T, name string, want bool) {
+	_, err := os.Lstat(name)
+	if got := err == nil; got != want {
+		t.Errorf("%s: exists %v, want %v", name, got, want)
+	}
+}
+
+func TestUnionFsBadBranchModes(t *testing.T) {
+	fses := []pathfs.FileSystem{pathfs.NewDefaultFileSystem(), pathfs.NewDefaultFileSystem()}
+	for _, modes := range [][]BranchMode{
+		{BranchRO, BranchRW},
+		{BranchRW},
+	} {
+		if ufs := NewUnionFs(fses, UnionFsOptions{BranchModes: modes}); ufs != nil {
+			t.Errorf("NewUnionFs(%v) succeeded", modes)
+		}
+	}
+}
+
+// statFsCounter reports free space, and counts StatFs calls.
+type statFsCounter struct {
+	pathfs.FileSystem
+	free  uint64
+	calls int
+}
+
+func (fs *statFsCounter) StatFs(name string) *nodefs.StatfsOut {
+	fs.calls++
+	return &nodefs.StatfsOut{Bsize: 1, Bavail: fs.free}
+}
+
+func TestUnionFsMostFreeSpace(t *testing.T) {
+	small := &statFsCounter{FileSystem: pathfs.NewDefaultFileSystem(), free: 10}
+	big := &statFsCounter{FileSystem: pathfs.NewDefaultFileSystem(), free: 20}
+	branches := []PolicyBranch{{0, small}, {1, big}}
+
+	p := MostFreeSpace()
+	for i := 0; i < 10; i++ {
+		if got := p.Create("file", branches); got != 1 {
+			t.Fatalf("got branch %d, want 1", got)
+		}
+	}
+	if small.calls != 1 || big.calls != 1 {
+		t.Errorf("got %d and %d StatFs calls, want 1 each", small.calls, big.calls)
+	}
+}
+
+// fixedStatFs reports a fixed size.
+type fixedStatFs struct {
+	pathfs.FileSystem
+	out nodefs.StatfsOut
+}
+
+func (fs *fixedStatFs) StatFs(name string) *nodefs.StatfsOut {
+	out := fs.out
+	return &out
+}
+
+func TestUnionFsStatFsShared(t *testing.T) {
+	wd, err := ioutil.TempDir("", "unionfs")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(wd)
+	os.Mkdir(wd+"/a", 0755)
+	os.Mkdir(wd+"/b", 0755)
+	a := pathfs.NewLoopbackFileSystem(wd + "/a")
+	local := a.StatFs("")
+	if local == nil {
+		t.Fatal("StatFs failed")
+	}
+
+	// Identical file systems that are not known to share a
+	// device are counted separately.
+	fixed := nodefs.StatfsOut{Bsize: local.Bsize, Blocks: 100, Files: 10}
+	ufs := NewUnionFs([]pathfs.FileSystem{
+		a,
+		pathfs.NewLoopbackFileSystem(wd + "/b"),
+		&fixedStatFs{pathfs.NewDefaultFileSystem(), fixed},
+		&fixedStatFs{pathfs.NewDefaultFileSystem(), fixed},
+	}, UnionFsOptions{Whiteouts: WhiteoutOverlay})
+	out := ufs.StatFs("")
+	if want := local.Blocks + 2*fixed.Blocks; out.Blocks != want {
+		t.Errorf("got %d blocks, want %d", out.Blocks, want)
+	}
+}
+
+func TestUnionFsRoundRobin(t *testing.T) {
+	wd, clean := setupBranchUfs(t, UnionFsOptions{CreatePolicy: RoundRobin()})
+	defer clean()
+
+	WriteFile(t, wd+"/ro/file", "ro")
+	for _, n := range []string{"a", "b"} {
+		WriteFile(t, wd+"/mnt/"+n, n)
+	}
+	// Promoted files are placed like new ones.
+	WriteFile(t, wd+"/mnt/file", "promoted")
+
+	checkExists(t, wd+"/b0/a", true)
+	checkExists(t, wd+"/b1/b", true)
+	checkExists(t, wd+"/b0/file", true)
+	for n, want := range map[string]string{"a": "a", "b": "b", "file": "promoted"} {
+		if got := readFromFile(t, wd+"/mnt/"+n); got != want {
+			t.Errorf("%s: got %q, want %q", n, got, want)
+		}
+	}
+
+	if err := os.Remove(wd + "/mnt/b"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	checkExists(t, wd+"/b1/b", false)
+	checkExists(t, wd+"/mnt/b", false)
+}
+
+func TestUnionFsNoCreateBranch(t *testing.T) {
+	wd, clean := setupBranchUfs(t, UnionFsOptions{
+		BranchModes: []BranchMode{BranchRW, BranchNC, BranchRO},
+	})
+	defer clean()
+
+	WriteFile(t, wd+"/b1/file", "old")
+	WriteFile(t, wd+"/mnt/file", "new")
+	WriteFile(t, wd+"/mnt/other", "other")
+
+	// Changed in place, but not used for new files.
+	if got := readFromFile(t, wd+"/b1/file"); got != "new" {
+		t.Errorf("got %q, want %q", got, "new")
+	}
+	checkExists(t, wd+"/b0/file", false)
+	checkExists(t, wd+"/b0/other", true)
+}
+
+func TestUnionFsExistingPathFirst(t *testing.T) {
+	wd, clean := setupBranchUfs(t, UnionFsOptions{CreatePolicy: ExistingPathFirst(nil)})
+	defer clean()
+
+	if err := os.Mkdir(wd+"/b1/dir", 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	WriteFile(t, wd+"/mnt/dir/file", "x")
+	WriteFile(t, wd+"/mnt/top", "x")
+
+	checkExists(t, wd+"/b1/dir/file", true)
+	checkExists(t, wd+"/b0/dir", false)
+	checkExists(t, wd+"/b0/top", true)
+}
+
+func TestUnionFsDirectoryAffinity(t *testing.T) {
+	wd, clean := setupBranchUfs(t, UnionFsOptions{
+		CreatePolicy: DirectoryAffinity(map[string]int{"/pinned": 1}, nil),
+	})
+	defer clean()
+
+	if err := os.MkdirAll(wd+"/mnt/pinned/sub", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	WriteFile(t, wd+"/mnt/pinned/sub/file", "x")
+	WriteFile(t, wd+"/mnt/free", "x")
+
+	checkExists(t, wd+"/b1/pinned/sub/file", true)
+	checkExists(t, wd+"/b0/free", true)
+	if got := dirNames(t, wd+"/mnt/pinned/sub"); len(got) != 1 || !got["file"] {
+		t.Errorf("got entries %v, want [file]", got)
+	}
+}
+
+func TestUnionFsNewestSearch(t *testing.T) {
+	wd, clean := setupBranchUfs(t, UnionFsOptions{SearchPolicy: Newest()})
+	defer clean()
+
+	WriteFile(t, wd+"/b0/file", "old")
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(wd+"/b0/file", old, old); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+	WriteFile(t, wd+"/b1/file", "new")
+
+	if got := readFromFile(t, wd+"/mnt/file"); got != "new" {
+		t.Errorf("got %q, want %q", got, "new")
+	}
+}
+
+func TestUnionFsRenameAcrossBranches(t *testing.T) {
+	wd, clean := setupBranchUfs(t, UnionFsOptions{})
+	defer clean()
+
+	for _, d := range []string{"b0/dir", "b1/dir"} {
+		if err := os.Mkdir(filepath.Join(wd, d), 0755); err != nil {
+			t.Fatalf("Mkdir failed: %v", err)
+		}
+	}
+	WriteFile(t, wd+"/b0/dir/a", "a")
+	WriteFile(t, wd+"/b1/dir/b", "b")
+
+	if err := os.Rename(wd+"/mnt/dir", wd+"/mnt/renamed"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	checkExists(t, wd+"/mnt/dir", false)
+	for _, n := range []string{"a", "b"} {
+		if got := readFromFile(t, wd+"/mnt/renamed/"+n); got != n {
+			t.Errorf("%s: got %q, want %q", n, got, n)
+		}
+	}
+	checkExists(t, wd+"/b1/renamed/b", true)
+}
@@ -0,0 +1,51 @@
+package unionfs
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/hanwen/go-fuse/raw"
+)
+
+func TestUnionFsRename2(t *testing.T) {
+	wd, clean := setupUfs(t)
+	defer clean()
+
+	if err := os.MkdirAll(wd+"/ro/dir", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	ioutil.WriteFile(wd+"/ro/dir/sub", []byte("sub"), 0644)
+	ioutil.WriteFile(wd+"/ro/file", []byte("ro"), 0644)
+	ioutil.WriteFile(wd+"/rw/other", []byte("rw"), 0644)
+
+	err := pathfs.Renameat2(wd+"/mnt/other", wd+"/mnt/file", raw.RENAME_NOREPLACE)
+	if err == syscall.EINVAL || err == syscall.ENOSYS {
+		t.Skipf("renameat2 not supported: %v", err)
+	}
+	if err != syscall.EEXIST {
+		t.Errorf("RENAME_NOREPLACE onto read-only file: got %v, want EEXIST", err)
+	}
+
+	if err := pathfs.Renameat2(wd+"/mnt/dir", wd+"/mnt/file", raw.RENAME_EXCHANGE); err != nil {
+		t.Fatalf("RENAME_EXCHANGE failed: %v", err)
+	}
+	if c := readFromFile(t, wd+"/mnt/dir"); c != "ro" {
+		t.Errorf("dir after exchange: got %q, want %q", c, "ro")
+	}
+	if c := readFromFile(t, wd+"/mnt/file/sub"); c != "sub" {
+		t.Errorf("file/sub after exchange: got %q, want %q", c, "sub")
+	}
+	if fileExists(wd + "/mnt/dir/sub") {
+		t.Errorf("dir/sub should be hidden after exchange")
+	}
+
+	if err := pathfs.Renameat2(wd+"/mnt/other", wd+"/mnt/new", raw.RENAME_NOREPLACE); err != nil {
+		t.Fatalf("RENAME_NOREPLACE failed: %v", err)
+	}
+	if c := readFromFile(t, wd+"/mnt/new"); c != "rw" {
+		t.Errorf("new: got %q, want %q", c, "rw")
+	}
+}
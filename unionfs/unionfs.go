@@ -56,6 +56,9 @@ func filePathHash(path string) string {
  without caching on our side, the kernel's negative dentry cache can
  answer is-deleted queries quickly.
 
+ * Alternatively, deletions can be recorded as overlayfs whiteouts;
+ see WhiteoutFormat.
+
 */
 type unionFS struct {
 	pathfs.FileSystem
@@ -63,17 +66,44 @@ type unionFS struct {
 	// The same, but as interfaces.
 	fileSystems []pathfs.FileSystem
 
+	// Held for writing while the read-only branches are changed,
+	// which replaces fileSystems, modes and roDeletions.
+	branchLock sync.RWMutex
+
+	// Serializes branch changes.  See changeBranches.
+	branchChangeMutex sync.Mutex
+
 	// A file-existence cache.
 	deletionCache *dirCache
 
+	// Deletion stores of the read-only branches, indexed by
+	// branch.  They are cached like deletionCache.
+	roDeletions []*dirCache
+
 	// A file -> branch cache.
 	branchCache *TimedCache
 
+	// The mode of each branch.
+	modes []BranchMode
+
 	// Map of files to hide.
 	hiddenFiles map[string]bool
 
 	options *UnionFsOptions
 	nodeFs  *pathfs.PathNodeFs
+
+	// Unfinished lazy copy-ups, by name, and the names of the
+	// branches that are being removed, which must not get new
+	// copy-ups or placeholders.
+	copyUpMutex sync.Mutex
+	copyUps     map[string]*copyUp
+	retiring    map[string]bool
+
+	// Names of hard-linked files in the read-only branches, and
+	// the copies of those that were promoted.  See hardlink.go.
+	linkMutex     sync.Mutex
+	links         map[linkKey]map[string]bool
+	promotedLinks map[linkKey]promotedLink
 }
 
 type UnionFsOptions struct {
@@ -81,6 +111,53 @@ type UnionFsOptions struct {
 	DeletionCacheTTL time.Duration
 	DeletionDirName  string
 	HiddenFiles      []string
+
+	// How to record deletions in the writable branch.
+	Whiteouts WhiteoutFormat
+
+	// If set, promoting a regular file creates a sparse file in
+	// the writable branch, whose contents are copied in chunks of
+	// CopyUpChunkSize bytes (default 1M) in the background.  Until
+	// then, reads of chunks that were not copied are served from
+	// the read-only branch.  The progress is kept in an xattr, so
+	// the writable branch must support user xattrs.  A copy-up
+	// that was interrupted by an unmount is resumed when the file
+	// is opened or truncated again.
+	LazyCopyUp      bool
+	CopyUpChunkSize int64
+
+	// If set, changing the attributes of a regular file in a
+	// read-only branch leaves a placeholder with the new
+	// attributes in the writable branch, and the data is only
+	// copied when the file is opened for writing.  This is like
+	// the metacopy feature of overlayfs.  The writable branch must
+	// support user xattrs.
+	MetadataCopyUp bool
+
+	// Modes of the branches, in the order passed to NewUnionFs.
+	// If nil, the first branch is read-write and the others are
+	// read-only.  The writable branches must come before the
+	// read-only ones, and the first branch must be writable,
+	// since it holds the deletion store or the whiteouts.
+	BranchModes []BranchMode
+
+	// Where to put new files and directories, and promoted
+	// files.  If nil, they go to the first read-write branch.
+	CreatePolicy CreatePolicy
+
+	// Which copy of a file to use if several writable branches
+	// have it.  If nil, the first one is used.
+	SearchPolicy SearchPolicy
+
+	// If set, a file of this name in the root of the union lists
+	// the branches, and takes commands to change the read-only
+	// ones.  See BranchController.
+	BranchControlFile string
+
+	// If set, ListXAttr includes the user.unionfs.* attributes
+	// that tell where entries come from.  They can be read with
+	// GetXAttr regardless.
+	ListUnionXAttrs bool
 }
 
 const (
@@ -92,6 +169,15 @@ func NewUnionFs(fileSystems []pathfs.FileSystem, options UnionFsOptions) pathfs.
 		options:     &options,
 		fileSystems: fileSystems,
 		FileSystem:  pathfs.NewDefaultFileSystem(),
+		copyUps:     map[string]*copyUp{},
+	}
+	g.dropLinks()
+
+	var err error
+	g.modes, err = branchModes(options.BranchModes, len(fileSystems))
+	if err != nil {
+		log.Println(err)
+		return nil
 	}
 
 	writable := g.fileSystems[0]
@@ -102,6 +188,7 @@ func NewUnionFs(fileSystems []pathfs.FileSystem, options UnionFsOptions) pathfs.
 	}
 
 	g.deletionCache = newDirCache(writable, options.DeletionDirName, options.DeletionCacheTTL)
+	g.roDeletions = g.newRoDeletions(fileSystems)
 	g.branchCache = NewTimedCache(
 		func(n string) (interface{}, bool) { return g.getBranchAttrNoCache(n), true },
 		options.BranchCacheTTL)
@@ -124,6 +211,10 @@ func (fs *unionFS) OnMount(nodeFs *pathfs.PathNodeFs) {
 // The isDeleted() method tells us if a path has a marker in the deletion store.
 // It may return an error code if the store could not be accessed.
 func (fs *unionFS) isDeleted(name string) (deleted bool, code fuse.Status) {
+	if fs.overlayWhiteouts() {
+		// Whiteouts are found by getBranch.
+		return false, fuse.OK
+	}
 	marker := fs.deletionPath(name)
 	haveCache, found := fs.deletionCache.HasEntry(filepath.Base(marker))
 	if haveCache {
@@ -144,6 +235,9 @@ func (fs *unionFS) isDeleted(name string) (deleted bool, code fuse.Status) {
 }
 
 func (fs *unionFS) createDeletionStore() (code fuse.Status) {
+	if fs.overlayWhiteouts() {
+		return fuse.OK
+	}
 	writable := fs.fileSystems[0]
 	fi, code := writable.GetAttr(fs.options.DeletionDirName, nil)
 	if code == fuse.ENOENT {
@@ -170,10 +264,14 @@ type branchResult struct {
 	attr   *fuse.Attr
 	code   fuse.Status
 	branch int
+
+	// For directories, the lowest branch that contributes
+	// entries.
+	last int
 }
 
 func (fs branchResult) String() string {
-	return fmt.Sprintf("{%v %v branch %d}", fs.attr, fs.code, fs.branch)
+	return fmt.Sprintf("{%v %v branch %d-%d}", fs.attr, fs.code, fs.branch, fs.last)
 }
 
 func (fs *unionFS) getBranchAttrNoCache(name string) branchResult {
@@ -182,33 +280,56 @@ func (fs *unionFS) getBranchAttrNoCache(name string) branchResult {
 	parent, base := path.Split(name)
 	parent = stripSlash(parent)
 
-	parentBranch := 0
+	first, last := 0, len(fs.fileSystems)-1
 	if base != "" {
-		parentBranch = fs.getBranch(parent).branch
-	}
-	for i, fs := range fs.fileSystems {
-		if i < parentBranch {
-			continue
+		p := fs.getBranch(parent)
+		if p.branch < 0 {
+			return branchResult{nil, fuse.ENOENT, -1, -1}
 		}
-
-		a, s := fs.GetAttr(name, nil)
+		first, last = p.branch, p.last
+	}
+	for i := first; i <= last; i++ {
+		a, s := fs.fileSystems[i].GetAttr(name, nil)
 		if s.Ok() {
-			if i > 0 {
-				// Needed to make hardlinks work.
-				a.Ino = 0
+			if fs.isWhiteout(i, a) {
+				break
+			}
+			// The branch may return its cached attributes,
+			// which setBranchInode must not change.
+			attr := *a
+			a = &attr
+			if !a.IsDir() && fs.writable(i) && fs.options.SearchPolicy != nil {
+				i, a = fs.search(name, i, last, a)
 			}
-			return branchResult{
+			if fs.writable(i) && a.IsRegular() {
+				fs.recordCopy(name, i, a)
+			} else if a.IsRegular() && a.Nlink > 1 {
+				fs.recordLink(name, i, a)
+			}
+			r := branchResult{
 				attr:   a,
 				code:   s,
 				branch: i,
+				last:   last,
+			}
+			if a.IsDir() {
+				r.last = fs.lastDirBranch(name, i, last)
+			}
+			if fs.writable(i) {
+				fs.setMetaCopyAttr(name, i, a)
 			}
+			setBranchInode(a, i)
+			return r
 		} else {
 			if s != fuse.ENOENT {
 				log.Printf("getattr: %v:  Got error %v from branch %v", name, s, i)
 			}
 		}
+		if fs.hasMarker(i, name) {
+			break
+		}
 	}
-	return branchResult{nil, fuse.ENOENT, -1}
+	return branchResult{nil, fuse.ENOENT, -1, -1}
 }
 
 ////////////////
@@ -219,6 +340,10 @@ func (fs *unionFS) deletionPath(name string) string {
 }
 
 func (fs *unionFS) removeDeletion(name string) {
+	if fs.overlayWhiteouts() {
+		// Done by clearWhiteout, before creating name.
+		return
+	}
 	marker := fs.deletionPath(name)
 	fs.deletionCache.RemoveEntry(path.Base(marker))
 
@@ -233,6 +358,9 @@ func (fs *unionFS) removeDeletion(name string) {
 }
 
 func (fs *unionFS) putDeletion(name string) (code fuse.Status) {
+	if fs.overlayWhiteouts() {
+		return fs.putWhiteout(name)
+	}
 	code = fs.createDeletionStore()
 	if !code.Ok() {
 		return code
@@ -272,20 +400,49 @@ func (fs *unionFS) putDeletion(name string) (code fuse.Status) {
 ////////////////
 // Promotion.
 
-func (fs *unionFS) Promote(name string, srcResult branchResult, context *fuse.Context) (code fuse.Status) {
-	writable := fs.fileSystems[0]
+// Promote copies name out of a read-only branch into the writable
+// branch chosen by the create policy, and returns that branch.
+func (fs *unionFS) Promote(name string, srcResult branchResult, context *fuse.Context) (int, fuse.Status) {
+	dst, code := fs.createBranch(name)
+	if code.Ok() {
+		code = fs.promoteTo(name, srcResult, dst, context)
+	}
+	return dst, code
+}
+
+func (fs *unionFS) promoteTo(name string, srcResult branchResult, dst int, context *fuse.Context) (code fuse.Status) {
+	writable := fs.fileSystems[dst]
 	sourceFs := fs.fileSystems[srcResult.branch]
 
 	// Promote directories.
-	fs.promoteDirsTo(name)
+	fs.promoteDirsTo(name, dst)
 
 	if srcResult.attr.IsRegular() {
-		code = pathfs.CopyFile(sourceFs, writable, name, name, context)
+		code = fuse.ENOSYS
+		linked := false
+		if srcResult.attr.Nlink > 1 && !fs.writable(srcResult.branch) {
+			code = fs.linkToCopy(name, srcResult, dst)
+			linked = code.Ok()
+		}
+		// Links share the copy, which a lazy copy-up keyed by
+		// name cannot track.  Branches that are being removed
+		// get no new copy-ups.
+		if !code.Ok() && fs.options.LazyCopyUp && srcResult.attr.Nlink <= 1 && !fs.isRetiring(srcResult.branch) {
+			code = fs.lazyPromote(name, srcResult, dst, context)
+			if !code.Ok() {
+				log.Printf("lazy copy-up of %q failed, copying: %v", name, code)
+			}
+		}
+		if !code.Ok() {
+			code = pathfs.CopyFile(sourceFs, writable, name, name, context)
+		}
 
-		if code.Ok() {
+		// A link has the attributes of the copy, which may have
+		// changed since.
+		if code.Ok() && !linked {
 			code = writable.Chmod(name, srcResult.attr.Mode&07777|0200, context)
 		}
-		if code.Ok() {
+		if code.Ok() && !linked {
 			aTime := srcResult.attr.AccessTime()
 			mTime := srcResult.attr.ModTime()
 			code = writable.Utimens(name, &aTime, &mTime, context)
@@ -296,24 +453,11 @@ func (fs *unionFS) Promote(name string, srcResult branchResult, context *fuse.Co
 			if !code.Ok() {
 				break
 			}
-			var uf *unionFsFile
-			f := fileWrapper.File
-			for f != nil {
-				ok := false
-				uf, ok = f.(*unionFsFile)
-				if ok {
-					break
-				}
-				f = f.InnerFile()
-			}
-			if uf == nil {
-				panic("no unionFsFile found inside")
-			}
-
-			if uf.layer > 0 {
-				uf.layer = 0
+			uf := findUnionFsFile(fileWrapper.File)
+			if !fs.writable(uf.layer) {
+				uf.layer = dst
 				f := uf.File
-				uf.File, code = fs.fileSystems[0].Open(name, fileWrapper.OpenFlags, context)
+				uf.File, code = fs.openWritable(name, dst, fileWrapper.OpenFlags, context)
 				f.Flush()
 				f.Release()
 			}
@@ -338,9 +482,12 @@ func (fs *unionFS) Promote(name string, srcResult branchResult, context *fuse.Co
 		return code
 	} else {
 		r := fs.getBranch(name)
-		r.branch = 0
+		r.branch = dst
 		fs.branchCache.Set(name, r)
 	}
+	if srcResult.attr.IsRegular() && srcResult.attr.Nlink > 1 && !fs.writable(srcResult.branch) {
+		fs.promoteLinks(name, srcResult, dst)
+	}
 
 	return fuse.OK
 }
@@ -349,36 +496,62 @@ func (fs *unionFS) Promote(name string, srcResult branchResult, context *fuse.Co
 // Below: implement interface for a FileSystem.
 
 func (fs *unionFS) Link(orig string, newName string, context *fuse.Context) (code fuse.Status) {
+	fs.branchLock.RLock()
+	code, promoted := fs.link(orig, newName, context)
+	fs.branchLock.RUnlock()
+	if promoted {
+		// Hairy: for the link to be hooked up to the existing
+		// inode, PathNodeFs must see a client inode for the
+		// original.  We force PathNodeFs to see the new Inode
+		// number.  This calls back into GetAttr, so it must
+		// run without branchLock.
+		if inode := fs.nodeFs.Node(orig); inode != nil {
+			var a fuse.Attr
+			inode.Node().GetAttr(&a, nil, nil)
+		}
+	}
+	return code
+}
+
+// link implements Link.  It returns whether orig was promoted.
+func (fs *unionFS) link(orig string, newName string, context *fuse.Context) (code fuse.Status, promoted bool) {
 	origResult := fs.getBranch(orig)
 	code = origResult.code
-	if code.Ok() && origResult.branch > 0 {
-		code = fs.Promote(orig, origResult, context)
+	branch := origResult.branch
+	if code.Ok() && !fs.writable(branch) {
+		branch, code = fs.Promote(orig, origResult, context)
 	}
-	if code.Ok() && origResult.branch > 0 {
-		// Hairy: for the link to be hooked up to the existing
-		// inode, PathNodeFs must see a client inode for the
-		// original.  We force a refresh of the attribute (so
-		// the Ino is filled in.), and then force PathNodeFs
-		// to see the Inode number.
+	if code.Ok() && !fs.writable(origResult.branch) {
+		// Refresh the attribute, so the Ino is filled in.
 		fs.branchCache.GetFresh(orig)
-		inode := fs.nodeFs.Node(orig)
-		var a fuse.Attr
-		inode.Node().GetAttr(&a, nil, nil)
+		promoted = true
 	}
 	if code.Ok() {
-		code = fs.promoteDirsTo(newName)
+		code = fs.promoteDirsTo(newName, branch)
 	}
 	if code.Ok() {
-		code = fs.fileSystems[0].Link(orig, newName, context)
+		// The copy-up state is per name, so it cannot be shared.
+		// One that was interrupted is resumed first.
+		_, code = fs.getCopyUp(orig, branch)
+	}
+	if code.Ok() {
+		fs.finishCopyUps(orig)
+		whiteout := fs.clearWhiteout(newName)
+		code = fs.fileSystems[branch].Link(orig, newName, context)
+		if !code.Ok() && whiteout {
+			fs.restoreWhiteout(newName)
+		}
 	}
 	if code.Ok() {
 		fs.removeDeletion(newName)
 		fs.branchCache.GetFresh(newName)
 	}
-	return code
+	return code, promoted
 }
 
 func (fs *unionFS) Rmdir(path string, context *fuse.Context) (code fuse.Status) {
+	fs.branchLock.RLock()
+	defer fs.branchLock.RUnlock()
 	r := fs.getBranch(path)
 	if r.code != fuse.OK {
 		return r.code
@@ -387,7 +560,7 @@ func (fs *unionFS) Rmdir(path string, context *fuse.Context) (code fuse.Status)
 		return fuse.Status(syscall.ENOTDIR)
 	}
 
-	stream, code := fs.OpenDir(path, context)
+	stream, code := fs.openDir(path, context)
 	found := false
 	for _ = range stream {
 		found = true
@@ -396,23 +569,28 @@ func (fs *unionFS) Rmdir(path string, context *fuse.Context) (code fuse.Status)
 		return fuse.Status(syscall.ENOTEMPTY)
 	}
 
-	if r.branch > 0 {
-		code = fs.putDeletion(path)
-		return code
-	}
-	code = fs.fileSystems[0].Rmdir(path, context)
-	if code != fuse.OK {
-		return code
+	for _, i := range fs.branchesWith(path) {
+		var cleared []string
+		if i == 0 {
+			cleared = fs.clearWhiteoutsIn(path)
+		}
+		code = fs.fileSystems[i].Rmdir(path, context)
+		if code != fuse.OK {
+			fs.restoreWhiteout(cleared...)
+			return code
+		}
 	}
 
 	r = fs.branchCache.GetFresh(path).(branchResult)
-	if r.branch > 0 {
+	if r.branch >= 0 {
 		code = fs.putDeletion(path)
 	}
 	return code
 }
 
 func (fs *unionFS) Mkdir(path string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	fs.branchLock.RLock()
+	defer fs.branchLock.RUnlock()
 	deleted, code := fs.isDeleted(path)
 	if !code.Ok() {
 		return code
@@ -425,20 +603,29 @@ func (fs *unionFS) Mkdir(path string, mode uint32, context *fuse.Context) (code
 		}
 	}
 
-	code = fs.promoteDirsTo(path)
+	branch, code := fs.createBranch(path)
 	if code.Ok() {
-		code = fs.fileSystems[0].Mkdir(path, mode, context)
+		code = fs.promoteDirsTo(path, branch)
 	}
+	whiteout := false
 	if code.Ok() {
-		fs.removeDeletion(path)
-		attr := &fuse.Attr{
-			Mode: fuse.S_IFDIR | mode,
+		whiteout = fs.clearWhiteout(path)
+		code = fs.fileSystems[branch].Mkdir(path, mode, context)
+		if !code.Ok() && whiteout {
+			fs.restoreWhiteout(path)
 		}
-		fs.branchCache.Set(path, branchResult{attr, fuse.OK, 0})
+	}
+	if code.Ok() && whiteout {
+		// Hide what the whiteout hid.
+		fs.setOpaque(path, branch)
+	}
+	if code.Ok() {
+		fs.removeDeletion(path)
+		fs.branchCache.GetFresh(path)
 	}
 
 	var stream []fuse.DirEntry
-	stream, code = fs.OpenDir(path, context)
+	stream, code = fs.openDir(path, context)
 	if code.Ok() {
 		// This shouldn't happen, but let's be safe.
 		for _, entry := range stream {
@@ -450,9 +637,18 @@ func (fs *unionFS) Mkdir(path string, mode uint32, context *fuse.Context) (code
 }
 
 func (fs *unionFS) Symlink(pointedTo string, linkName string, context *fuse.Context) (code fuse.Status) {
-	code = fs.promoteDirsTo(linkName)
+	fs.branchLock.RLock()
+	defer fs.branchLock.RUnlock()
+	branch, code := fs.createBranch(linkName)
+	if code.Ok() {
+		code = fs.promoteDirsTo(linkName, branch)
+	}
 	if code.Ok() {
-		code = fs.fileSystems[0].Symlink(pointedTo, linkName, context)
+		whiteout := fs.clearWhiteout(linkName)
+		code = fs.fileSystems[branch].Symlink(pointedTo, linkName, context)
+		if !code.Ok() && whiteout {
+			fs.restoreWhiteout(linkName)
+		}
 	}
 	if code.Ok() {
 		fs.removeDeletion(linkName)
@@ -462,18 +658,28 @@ func (fs *unionFS) Symlink(pointedTo string, linkName string, context *fuse.Cont
 }
 
 func (fs *unionFS) Truncate(path string, size uint64, context *fuse.Context) (code fuse.Status) {
-	if path == _DROP_CACHE {
+	fs.branchLock.RLock()
+	defer fs.branchLock.RUnlock()
+	if path == _DROP_CACHE || fs.isControlFile(path) {
 		return fuse.OK
 	}
 
 	r := fs.getBranch(path)
-	if r.branch > 0 {
-		code = fs.Promote(path, r, context)
-		r.branch = 0
+	if !r.code.Ok() {
+		return r.code
+	}
+	if !fs.writable(r.branch) {
+		r.branch, code = fs.Promote(path, r, context)
 	}
 
 	if code.Ok() {
-		code = fs.fileSystems[0].Truncate(path, size, context)
+		code = fs.completeMetaCopy(path, r.branch, size > 0, context)
+	}
+	if code.Ok() {
+		code = fs.truncateCopyUp(path, r.branch, size)
+	}
+	if code.Ok() {
+		code = fs.fileSystems[r.branch].Truncate(path, size, context)
 	}
 	if code.Ok() {
 		r.attr.Size = size
@@ -485,16 +691,17 @@ func (fs *unionFS) Truncate(path string, size uint64, context *fuse.Context) (co
 }
 
 func (fs *unionFS) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) (code fuse.Status) {
+	fs.branchLock.RLock()
+	defer fs.branchLock.RUnlock()
 	name = stripSlash(name)
 	r := fs.getBranch(name)
 
 	code = r.code
-	if code.Ok() && r.branch > 0 {
-		code = fs.Promote(name, r, context)
-		r.branch = 0
+	if code.Ok() && !fs.writable(r.branch) {
+		r.branch, code = fs.promoteMetadata(name, r, context)
 	}
 	if code.Ok() {
-		code = fs.fileSystems[0].Utimens(name, atime, mtime, context)
+		code = fs.fileSystems[r.branch].Utimens(name, atime, mtime, context)
 	}
 	if code.Ok() {
 		now := time.Now()
@@ -505,6 +712,8 @@ func (fs *unionFS) Utimens(name string, atime *time.Time, mtime *time.Time, cont
 }
 
 func (fs *unionFS) Chown(name string, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
+	fs.branchLock.RLock()
+	defer fs.branchLock.RUnlock()
 	name = stripSlash(name)
 	r := fs.getBranch(name)
 	if r.attr == nil || r.code != fuse.OK {
@@ -516,14 +725,13 @@ func (fs *unionFS) Chown(name string, uid uint32, gid uint32, context *fuse.Cont
 	}
 
 	if r.attr.Uid != uid || r.attr.Gid != gid {
-		if r.branch > 0 {
-			code := fs.Promote(name, r, context)
+		if !fs.writable(r.branch) {
+			r.branch, code = fs.promoteMetadata(name, r, context)
 			if code != fuse.OK {
 				return code
 			}
-			r.branch = 0
 		}
-		fs.fileSystems[0].Chown(name, uid, gid, context)
+		fs.fileSystems[r.branch].Chown(name, uid, gid, context)
 	}
 	r.attr.Uid = uid
 	r.attr.Gid = gid
@@ -534,6 +742,8 @@ func (fs *unionFS) Chown(name string, uid uint32, gid uint32, context *fuse.Cont
 }
 
 func (fs *unionFS) Chmod(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	fs.branchLock.RLock()
+	defer fs.branchLock.RUnlock()
 	name = stripSlash(name)
 	r := fs.getBranch(name)
 	if r.attr == nil {
@@ -549,14 +759,13 @@ func (fs *unionFS) Chmod(name string, mode uint32, context *fuse.Context) (code
 	oldMode := r.attr.Mode & permMask
 
 	if oldMode != mode {
-		if r.branch > 0 {
-			code := fs.Promote(name, r, context)
+		if !fs.writable(r.branch) {
+			r.branch, code = fs.promoteMetadata(name, r, context)
 			if code != fuse.OK {
 				return code
 			}
-			r.branch = 0
 		}
-		fs.fileSystems[0].Chmod(name, mode, context)
+		fs.fileSystems[r.branch].Chmod(name, mode, context)
 	}
 	r.attr.Mode = (r.attr.Mode &^ permMask) | mode
 	now := time.Now()
@@ -566,6 +775,8 @@ func (fs *unionFS) Chmod(name string, mode uint32, context *fuse.Context) (code
 }
 
 func (fs *unionFS) Access(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	fs.branchLock.RLock()
+	defer fs.branchLock.RUnlock()
 	// We always allow writing.
 	mode = mode &^ raw.W_OK
 	if name == "" {
@@ -579,16 +790,20 @@ func (fs *unionFS) Access(name string, mode uint32, context *fuse.Context) (code
 }
 
 func (fs *unionFS) Unlink(name string, context *fuse.Context) (code fuse.Status) {
+	fs.branchLock.RLock()
+	defer fs.branchLock.RUnlock()
 	r := fs.getBranch(name)
-	if r.branch == 0 {
-		code = fs.fileSystems[0].Unlink(name, context)
+	for fs.writable(r.branch) {
+		// Remove all writable copies.
+		fs.cancelCopyUp(name)
+		code = fs.fileSystems[r.branch].Unlink(name, context)
 		if code != fuse.OK {
 			return code
 		}
 		r = fs.branchCache.GetFresh(name).(branchResult)
 	}
 
-	if r.branch > 0 {
+	if r.branch >= 0 {
 		// It would be nice to do the putDeletion async.
 		code = fs.putDeletion(name)
 	}
@@ -596,6 +811,8 @@ func (fs *unionFS) Unlink(name string, context *fuse.Context) (code fuse.Status)
 }
 
 func (fs *unionFS) Readlink(name string, context *fuse.Context) (out string, code fuse.Status) {
+	fs.branchLock.RLock()
+	defer fs.branchLock.RUnlock()
 	r := fs.getBranch(name)
 	if r.branch >= 0 {
 		return fs.fileSystems[r.branch].Readlink(name, context)
@@ -607,7 +824,9 @@ func stripSlash(fn string) string {
 	return strings.TrimRight(fn, string(filepath.Separator))
 }
 
-func (fs *unionFS) promoteDirsTo(filename string) fuse.Status {
+// promoteDirsTo creates the parent directories of filename in the
+// given writable branch, as far as they are missing.
+func (fs *unionFS) promoteDirsTo(filename string, branch int) fuse.Status {
 	dirName, _ := filepath.Split(filename)
 	dirName = stripSlash(dirName)
 
@@ -623,7 +842,10 @@ func (fs *unionFS) promoteDirsTo(filename string) fuse.Status {
 			log.Println("path component is not a directory.", dirName, r)
 			return fuse.EPERM
 		}
-		if r.branch == 0 {
+		if r.branch == branch {
+			break
+		}
+		if a, code := fs.fileSystems[branch].GetAttr(dirName, nil); code.Ok() && a.IsDir() {
 			break
 		}
 		todo = append(todo, dirName)
@@ -632,35 +854,45 @@ func (fs *unionFS) promoteDirsTo(filename string) fuse.Status {
 		dirName = stripSlash(dirName)
 	}
 
+	writable := fs.fileSystems[branch]
 	for i := range todo {
 		j := len(todo) - i - 1
 		d := todo[j]
 		r := results[j]
-		code := fs.fileSystems[0].Mkdir(d, r.attr.Mode&07777|0200, nil)
+		code := writable.Mkdir(d, r.attr.Mode&07777|0200, nil)
 		if code != fuse.OK {
-			log.Println("Error creating dir leading to path", d, code, fs.fileSystems[0])
+			log.Println("Error creating dir leading to path", d, code, writable)
 			return fuse.EPERM
 		}
 
 		aTime := r.attr.AccessTime()
 		mTime := r.attr.ModTime()
-		fs.fileSystems[0].Utimens(d, &aTime, &mTime, nil)
-		r.branch = 0
+		writable.Utimens(d, &aTime, &mTime, nil)
+		if !fs.writable(r.branch) || branch < r.branch {
+			r.branch = branch
+		}
 		fs.branchCache.Set(d, r)
 	}
 	return fuse.OK
 }
 
 func (fs *unionFS) Create(name string, flags uint32, mode uint32, context *fuse.Context) (fuseFile nodefs.File, code fuse.Status) {
-	writable := fs.fileSystems[0]
-
-	code = fs.promoteDirsTo(name)
+	fs.branchLock.RLock()
+	defer fs.branchLock.RUnlock()
+	branch, code := fs.createBranch(name)
+	if code.Ok() {
+		code = fs.promoteDirsTo(name, branch)
+	}
 	if code != fuse.OK {
 		return nil, code
 	}
-	fuseFile, code = writable.Create(name, flags, mode, context)
+	whiteout := fs.clearWhiteout(name)
+	fuseFile, code = fs.fileSystems[branch].Create(name, flags, mode, context)
+	if !code.Ok() && whiteout {
+		fs.restoreWhiteout(name)
+	}
 	if code.Ok() {
-		fuseFile = fs.newUnionFsFile(fuseFile, 0)
+		fuseFile = fs.newUnionFsFile(fuseFile, branch)
 		fs.removeDeletion(name)
 
 		now := time.Now()
@@ -668,12 +900,14 @@ func (fs *unionFS) Create(name string, flags uint32, mode uint32, context *fuse.
 			Mode: fuse.S_IFREG | mode,
 		}
 		a.SetTimes(nil, &now, &now)
-		fs.branchCache.Set(name, branchResult{&a, fuse.OK, 0})
+		fs.branchCache.Set(name, branchResult{&a, fuse.OK, branch, branch})
 	}
 	return fuseFile, code
 }
 
 func (fs *unionFS) GetAttr(name string, context *fuse.Context) (a *fuse.Attr, s fuse.Status) {
+	fs.branchLock.RLock()
+	defer fs.branchLock.RUnlock()
 	_, hidden := fs.hiddenFiles[name]
 	if hidden {
 		return nil, fuse.ENOENT
@@ -683,6 +917,12 @@ func (fs *unionFS) GetAttr(name string, context *fuse.Context) (a *fuse.Attr, s
 			Mode: fuse.S_IFREG | 0777,
 		}, fuse.OK
 	}
+	if fs.isControlFile(name) {
+		return &fuse.Attr{
+			Mode: fuse.S_IFREG | 0644,
+			Size: uint64(len(fs.branchListing())),
+		}, fuse.OK
+	}
 	if name == fs.options.DeletionDirName {
 		return nil, fuse.ENOENT
 	}
@@ -705,9 +945,17 @@ func (fs *unionFS) GetAttr(name string, context *fuse.Context) (a *fuse.Attr, s
 }
 
 func (fs *unionFS) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
-	if name == _DROP_CACHE {
+	fs.branchLock.RLock()
+	defer fs.branchLock.RUnlock()
+	if name == _DROP_CACHE || fs.isControlFile(name) {
+		return nil, fuse.ENODATA
+	}
+	if attr == overlayOpaqueXAttr || attr == overlayUserOpaqueXAttr {
 		return nil, fuse.ENODATA
 	}
+	if strings.HasPrefix(attr, unionXAttrPrefix) {
+		return fs.unionXAttr(name, attr)
+	}
 
 	r := fs.getBranch(name)
 	if r.branch >= 0 {
@@ -717,6 +965,12 @@ func (fs *unionFS) GetXAttr(name string, attr string, context *fuse.Context) ([]
 }
 
 func (fs *unionFS) OpenDir(directory string, context *fuse.Context) (stream []fuse.DirEntry, status fuse.Status) {
+	fs.branchLock.RLock()
+	defer fs.branchLock.RUnlock()
+	return fs.openDir(directory, context)
+}
+
+func (fs *unionFS) openDir(directory string, context *fuse.Context) (stream []fuse.DirEntry, status fuse.Status) {
 	dirBranch := fs.getBranch(directory)
 	if dirBranch.branch < 0 {
 		return nil, fuse.ENOENT
@@ -727,26 +981,33 @@ func (fs *unionFS) OpenDir(directory string, context *fuse.Context) (stream []fu
 	var wg sync.WaitGroup
 	var deletions map[string]bool
 
-	wg.Add(1)
-	go func() {
-		deletions = newDirnameMap(fs.fileSystems[0], fs.options.DeletionDirName)
-		wg.Done()
-	}()
+	if fs.overlayWhiteouts() {
+		deletions = map[string]bool{}
+	} else {
+		wg.Add(1)
+		go func() {
+			deletions = newDirnameMap(fs.fileSystems[0], fs.options.DeletionDirName)
+			wg.Done()
+		}()
+	}
 
-	entries := make([]map[string]uint32, len(fs.fileSystems))
+	entries := make([]map[string]fuse.DirEntry, len(fs.fileSystems))
 	for i := range fs.fileSystems {
-		entries[i] = make(map[string]uint32)
+		entries[i] = make(map[string]fuse.DirEntry)
 	}
 
 	statuses := make([]fuse.Status, len(fs.fileSystems))
 	for i, l := range fs.fileSystems {
-		if i >= dirBranch.branch {
+		if i >= dirBranch.branch && i <= dirBranch.last {
 			wg.Add(1)
 			go func(j int, pfs pathfs.FileSystem) {
 				ch, s := pfs.OpenDir(directory, context)
 				statuses[j] = s
 				for _, v := range ch {
-					entries[j][v.Name] = v.Mode
+					if v.Ino != 0 && j > 0 {
+						v.Ino = branchInode(v.Ino, j)
+					}
+					entries[j][v.Name] = v
 				}
 				wg.Done()
 			}(i, l)
@@ -763,29 +1024,33 @@ func (fs *unionFS) OpenDir(directory string, context *fuse.Context) (stream []fu
 		}
 	}
 
-	results := entries[0]
+	results := map[string]fuse.DirEntry{}
+	hidden := map[string]bool{}
 
 	// TODO(hanwen): should we do anything with the return
 	// statuses?
-	for i, m := range entries {
+	for i := dirBranch.branch; i <= dirBranch.last; i++ {
 		if statuses[i] != fuse.OK {
 			continue
 		}
-		if i == 0 {
-			// We don't need to further process the first
-			// branch: it has no deleted files.
-			continue
-		}
-		for k, v := range m {
-			_, ok := results[k]
-			if ok {
+		for k, v := range entries[i] {
+			if _, ok := results[k]; ok || hidden[k] {
 				continue
 			}
 
-			deleted := deletions[filePathHash(filepath.Join(directory, k))]
-			if !deleted {
-				results[k] = v
+			full := filepath.Join(directory, k)
+			if !fs.writable(i) && (deletions[filePathHash(full)] || fs.markedAbove(dirBranch.branch, i, full)) {
+				hidden[k] = true
+				continue
 			}
+			if v.Mode&syscall.S_IFMT == syscall.S_IFCHR {
+				a, code := fs.fileSystems[i].GetAttr(full, context)
+				if code.Ok() && fs.isWhiteout(i, a) {
+					hidden[k] = true
+					continue
+				}
+			}
+			results[k] = v
 		}
 	}
 	if directory == "" {
@@ -796,22 +1061,30 @@ func (fs *unionFS) OpenDir(directory string, context *fuse.Context) (stream []fu
 	}
 
 	stream = make([]fuse.DirEntry, 0, len(results))
-	for k, v := range results {
-		stream = append(stream, fuse.DirEntry{
-			Name: k,
-			Mode: v,
-		})
+	for _, v := range results {
+		stream = append(stream, v)
 	}
 	return stream, fuse.OK
 }
 
+// markedAbove returns whether the deletion store of a read-only
+// branch in [first, i) hides name.
+func (fs *unionFS) markedAbove(first int, i int, name string) bool {
+	for j := first; j < i; j++ {
+		if fs.hasMarker(j, name) {
+			return true
+		}
+	}
+	return false
+}
+
 // recursivePromote promotes path, and if a directory, everything
-// below that directory.  It returns a list of all promoted paths, in
-// full, including the path itself.
-func (fs *unionFS) recursivePromote(path string, pathResult branchResult, context *fuse.Context) (names []string, code fuse.Status) {
+// below that directory, into the writable branch dst.  It returns a
+// list of all promoted paths, in full, including the path itself.
+func (fs *unionFS) recursivePromote(path string, pathResult branchResult, dst int, context *fuse.Context) (names []string, code fuse.Status) {
 	names = []string{}
-	if pathResult.branch > 0 {
-		code = fs.Promote(path, pathResult, context)
+	if !fs.writable(pathResult.branch) {
+		code = fs.promoteTo(path, pathResult, dst, context)
 	}
 
 	if code.Ok() {
@@ -820,7 +1093,7 @@ func (fs *unionFS) recursivePromote(path string, pathResult branchResult, contex
 
 	if code.Ok() && pathResult.attr != nil && pathResult.attr.IsDir() {
 		var stream []fuse.DirEntry
-		stream, code = fs.OpenDir(path, context)
+		stream, code = fs.openDir(path, context)
 		for _, e := range stream {
 			if !code.Ok() {
 				break
@@ -828,7 +1101,7 @@ func (fs *unionFS) recursivePromote(path string, pathResult branchResult, contex
 			subnames := []string{}
 			p := filepath.Join(path, e.Name)
 			r := fs.getBranch(p)
-			subnames, code = fs.recursivePromote(p, r, context)
+			subnames, code = fs.recursivePromote(p, r, dst, context)
 			names = append(names, subnames...)
 		}
 	}
@@ -839,18 +1112,36 @@ func (fs *unionFS) recursivePromote(path string, pathResult branchResult, contex
 	return names, code
 }
 
-func (fs *unionFS) renameDirectory(srcResult branchResult, srcDir string, dstDir string, context *fuse.Context) (code fuse.Status) {
-	names := []string{}
-	if code.Ok() {
-		names, code = fs.recursivePromote(srcDir, srcResult, context)
+// promoteBranch returns the branch to promote into for renaming.
+func (fs *unionFS) promoteBranch(name string, results ...branchResult) (int, fuse.Status) {
+	for _, r := range results {
+		if fs.writable(r.branch) {
+			return r.branch, fuse.OK
+		}
 	}
+	return fs.createBranch(name)
+}
+
+func (fs *unionFS) renameDirectory(srcResult branchResult, srcDir string, dstDir string, flags uint32, context *fuse.Context) (code fuse.Status) {
+	names := []string{}
+	dst, code := fs.promoteBranch(srcDir, srcResult)
 	if code.Ok() {
-		code = fs.promoteDirsTo(dstDir)
+		names, code = fs.recursivePromote(srcDir, srcResult, dst, context)
 	}
 
+	whiteout := false
+	var branches []int
 	if code.Ok() {
-		writable := fs.fileSystems[0]
-		code = writable.Rename(srcDir, dstDir, context)
+		fs.finishCopyUps(srcDir)
+		whiteout = fs.clearWhiteout(dstDir)
+		branches, code = fs.renameWritable(srcDir, dstDir, flags, context)
+		if !code.Ok() && whiteout {
+			fs.restoreWhiteout(dstDir)
+		}
+	}
+	if code.Ok() && whiteout {
+		// The lowest copy hides the read-only branches.
+		fs.setOpaque(dstDir, branches[len(branches)-1])
 	}
 
 	if code.Ok() {
@@ -858,13 +1149,10 @@ func (fs *unionFS) renameDirectory(srcResult branchResult, srcDir string, dstDir
 			relative := strings.TrimLeft(srcName[len(srcDir):], string(filepath.Separator))
 			dst := filepath.Join(dstDir, relative)
 			fs.removeDeletion(dst)
+			fs.branchCache.DropEntry(dst)
 
-			srcResult := fs.getBranch(srcName)
-			srcResult.branch = 0
-			fs.branchCache.Set(dst, srcResult)
-
-			srcResult = fs.branchCache.GetFresh(srcName).(branchResult)
-			if srcResult.branch > 0 {
+			srcResult := fs.branchCache.GetFresh(srcName).(branchResult)
+			if srcResult.branch >= 0 {
 				code = fs.putDeletion(srcName)
 			}
 		}
@@ -872,7 +1160,162 @@ func (fs *unionFS) renameDirectory(srcResult branchResult, srcDir string, dstDir
 	return code
 }
 
+// renameWritable renames src to dst in all writable branches that
+// have src, and removes dst from the other writable branches.  It
+// returns the branches that had src.
+func (fs *unionFS) renameWritable(src string, dst string, flags uint32, context *fuse.Context) ([]int, fuse.Status) {
+	branches := fs.branchesWith(src)
+	if len(branches) == 0 {
+		return nil, fuse.ENOENT
+	}
+	renamed := map[int]bool{}
+	for _, i := range branches {
+		code := fs.promoteDirsTo(dst, i)
+		if code.Ok() {
+			code = fs.renameBranch(src, dst, i, flags, context)
+		}
+		if !code.Ok() {
+			return nil, code
+		}
+		renamed[i] = true
+	}
+
+	for _, i := range fs.branchesWith(dst) {
+		if renamed[i] {
+			continue
+		}
+		a, code := fs.fileSystems[i].GetAttr(dst, context)
+		if code.Ok() && a.IsDir() {
+			var cleared []string
+			if i == 0 {
+				cleared = fs.clearWhiteoutsIn(dst)
+			}
+			code = fs.fileSystems[i].Rmdir(dst, context)
+			if !code.Ok() {
+				fs.restoreWhiteout(cleared...)
+			}
+		} else if code.Ok() {
+			code = fs.fileSystems[i].Unlink(dst, context)
+		}
+		if !code.Ok() {
+			return nil, code
+		}
+	}
+	return branches, fuse.OK
+}
+
+// renameBranch renames within a writable branch.
+func (fs *unionFS) renameBranch(src string, dst string, branch int, flags uint32, context *fuse.Context) fuse.Status {
+	writable := fs.fileSystems[branch]
+	if flags == 0 {
+		return writable.Rename(src, dst, context)
+	}
+	rfs, ok := writable.(pathfs.Rename2FileSystem)
+	if !ok {
+		return fuse.EINVAL
+	}
+	return rfs.Rename2(src, dst, flags, context)
+}
+
 func (fs *unionFS) Rename(src string, dst string, context *fuse.Context) (code fuse.Status) {
+	fs.branchLock.RLock()
+	defer fs.branchLock.RUnlock()
+	return fs.rename(src, dst, 0, context)
+}
+
+// Rename2 supports RENAME_NOREPLACE and RENAME_EXCHANGE across
+// branches.  RENAME_WHITEOUT is accepted, since the union already
+// marks the source as deleted if a read-only branch still has it.
+func (fs *unionFS) Rename2(src string, dst string, flags uint32, context *fuse.Context) (code fuse.Status) {
+	fs.branchLock.RLock()
+	defer fs.branchLock.RUnlock()
+	switch flags &^ raw.RENAME_WHITEOUT {
+	case 0:
+		return fs.rename(src, dst, 0, context)
+	case raw.RENAME_NOREPLACE:
+		// The writable branch checks again, in case dst is
+		// created concurrently.
+		dstResult := fs.getBranch(dst)
+		if dstResult.code.Ok() {
+			return fuse.Status(syscall.EEXIST)
+		}
+		if dstResult.code != fuse.ENOENT {
+			return dstResult.code
+		}
+		return fs.rename(src, dst, raw.RENAME_NOREPLACE, context)
+	case raw.RENAME_EXCHANGE:
+		if flags&raw.RENAME_WHITEOUT != 0 {
+			return fuse.EINVAL
+		}
+		return fs.exchange(src, dst, context)
+	}
+	return fuse.EINVAL
+}
+
+// exchange promotes both paths with everything below them, swaps
+// them on the writable branch, and hides the entries of read-only
+// branches that no longer exist after the swap.
+func (fs *unionFS) exchange(a string, b string, context *fuse.Context) (code fuse.Status) {
+	aResult := fs.getBranch(a)
+	if !aResult.code.Ok() {
+		return aResult.code
+	}
+	bResult := fs.getBranch(b)
+	if !bResult.code.Ok() {
+		return bResult.code
+	}
+
+	dst, code := fs.promoteBranch(a, aResult, bResult)
+	if !code.Ok() {
+		return code
+	}
+	aNames, code := fs.recursivePromote(a, aResult, dst, context)
+	if !code.Ok() {
+		return code
+	}
+	bNames, code := fs.recursivePromote(b, bResult, dst, context)
+	if !code.Ok() {
+		return code
+	}
+	if !fs.onlyIn(a, dst) || !fs.onlyIn(b, dst) {
+		// Cannot be done atomically.
+		return fuse.Status(syscall.EXDEV)
+	}
+	fs.finishCopyUps(a)
+	fs.finishCopyUps(b)
+	if code = fs.renameBranch(a, b, dst, raw.RENAME_EXCHANGE, context); !code.Ok() {
+		return code
+	}
+
+	moved := map[string]string{}
+	for _, n := range aNames {
+		moved[n] = b + n[len(a):]
+	}
+	for _, n := range bNames {
+		moved[n] = a + n[len(b):]
+	}
+	for _, dst := range moved {
+		fs.removeDeletion(dst)
+		fs.branchCache.DropEntry(dst)
+	}
+	for src := range moved {
+		r := fs.branchCache.GetFresh(src).(branchResult)
+		if r.branch >= 0 && !fs.writable(r.branch) {
+			if code := fs.putDeletion(src); !code.Ok() {
+				return code
+			}
+		}
+	}
+	return fuse.OK
+}
+
+// onlyIn returns whether the writable branch holding name is branch.
+func (fs *unionFS) onlyIn(name string, branch int) bool {
+	b := fs.branchesWith(name)
+	return len(b) == 1 && b[0] == branch
+}
+
+func (fs *unionFS) rename(src string, dst string, flags uint32, context *fuse.Context) (code fuse.Status) {
 	srcResult := fs.getBranch(src)
 	code = srcResult.code
 	if code.Ok() {
@@ -880,17 +1323,19 @@ func (fs *unionFS) Rename(src string, dst string, context *fuse.Context) (code f
 	}
 
 	if srcResult.attr.IsDir() {
-		return fs.renameDirectory(srcResult, src, dst, context)
+		return fs.renameDirectory(srcResult, src, dst, flags, context)
 	}
 
-	if code.Ok() && srcResult.branch > 0 {
-		code = fs.Promote(src, srcResult, context)
+	if code.Ok() && !fs.writable(srcResult.branch) {
+		_, code = fs.Promote(src, srcResult, context)
 	}
 	if code.Ok() {
-		code = fs.promoteDirsTo(dst)
-	}
-	if code.Ok() {
-		code = fs.fileSystems[0].Rename(src, dst, context)
+		fs.finishCopyUps(src)
+		whiteout := fs.clearWhiteout(dst)
+		_, code = fs.renameWritable(src, dst, flags, context)
+		if !code.Ok() && whiteout {
+			fs.restoreWhiteout(dst)
+		}
 	}
 
 	if code.Ok() {
@@ -899,7 +1344,7 @@ func (fs *unionFS) Rename(src string, dst string, context *fuse.Context) (code f
 		fs.branchCache.DropEntry(dst)
 
 		srcResult := fs.branchCache.GetFresh(src)
-		if srcResult.(branchResult).branch > 0 {
+		if srcResult.(branchResult).branch >= 0 {
 			code = fs.putDeletion(src)
 		}
 	}
@@ -912,6 +1357,11 @@ func (fs *unionFS) DropBranchCache(names []string) {
 
 func (fs *unionFS) DropDeletionCache() {
 	fs.deletionCache.DropCache()
+	for _, c := range fs.roDeletions {
+		if c != nil {
+			c.DropCache()
+		}
+	}
 }
 
 func (fs *unionFS) DropSubFsCaches() {
@@ -928,6 +1378,8 @@ func (fs *unionFS) DropSubFsCaches() {
 }
 
 func (fs *unionFS) Open(name string, flags uint32, context *fuse.Context) (fuseFile nodefs.File, status fuse.Status) {
+	fs.branchLock.RLock()
+	defer fs.branchLock.RUnlock()
 	if name == _DROP_CACHE {
 		if flags&fuse.O_ANYWRITE != 0 {
 			log.Println("Forced cache drop on", fs)
@@ -938,6 +1390,14 @@ func (fs *unionFS) Open(name string, flags uint32, context *fuse.Context) (fuseF
 		}
 		return nodefs.NewDevNullFile(), fuse.OK
 	}
+	if fs.isControlFile(name) {
+		// Direct I/O, so the kernel needs no invalidation
+		// for the listing to change.
+		return &nodefs.WithFlags{
+			File:      &controlFile{nodefs.NewDataFile([]byte(fs.branchListing())), fs},
+			FuseFlags: raw.FOPEN_DIRECT_IO,
+		}, fuse.OK
+	}
 	r := fs.getBranch(name)
 	if r.branch < 0 {
 		// This should not happen, as a GetAttr() should have
@@ -945,17 +1405,24 @@ func (fs *unionFS) Open(name string, flags uint32, context *fuse.Context) (fuseF
 		log.Println("UnionFs: open of non-existent file:", name)
 		return nil, fuse.ENOENT
 	}
-	if flags&fuse.O_ANYWRITE != 0 && r.branch > 0 {
-		code := fs.Promote(name, r, context)
+	if flags&fuse.O_ANYWRITE != 0 && !fs.writable(r.branch) {
+		branch, code := fs.Promote(name, r, context)
 		if code != fuse.OK {
 			return nil, code
 		}
-		r.branch = 0
+		r.branch = branch
 		now := time.Now()
 		r.attr.SetTimes(nil, &now, nil)
 		fs.branchCache.Set(name, r)
 	}
-	fuseFile, status = fs.fileSystems[r.branch].Open(name, uint32(flags), context)
+	if fs.writable(r.branch) {
+		fuseFile, status = fs.openPlaceholder(name, r.branch, flags, context)
+		if fuseFile == nil && status.Ok() {
+			fuseFile, status = fs.openWritable(name, r.branch, flags, context)
+		}
+	} else {
+		fuseFile, status = fs.fileSystems[r.branch].Open(name, uint32(flags), context)
+	}
 	if fuseFile != nil {
 		fuseFile = fs.newUnionFsFile(fuseFile, r.branch)
 	}
@@ -970,10 +1437,6 @@ func (fs *unionFS) String() string {
 	return fmt.Sprintf("UnionFs(%v)", names)
 }
 
-func (fs *unionFS) StatFs(name string) *nodefs.StatfsOut {
-	return fs.fileSystems[0].StatFs("")
-}
-
 type unionFsFile struct {
 	nodefs.File
 	ufs   *unionFS
@@ -1002,7 +1465,9 @@ func (fs *unionFsFile) InnerFile() (file nodefs.File) {
 func (fs *unionFsFile) Flush() (code fuse.Status) {
 	code = fs.File.Flush()
 	path := fs.ufs.nodeFs.Path(fs.node)
+	fs.ufs.branchLock.RLock()
 	fs.ufs.branchCache.GetFresh(path)
+	fs.ufs.branchLock.RUnlock()
 	return code
 }
 
@@ -1014,6 +1479,44 @@ func (fs *unionFsFile) GetAttr(out *fuse.Attr) fuse.Status {
 	code := fs.File.GetAttr(out)
 	if code.Ok() {
 		out.Mode |= 0200
+		setBranchInode(out, fs.layer)
 	}
 	return code
 }
+
+// setBranchInode makes inode numbers from read-only branches
+// distinct from those of other branches, by folding the branch
+// index into the top bits.  The result is stable across mounts, so
+// it can be reported as st_ino with nodefs.Options.ReportInodes.
+func setBranchInode(a *fuse.Attr, branch int) {
+	checkBranchInode(a.Ino, branch)
+	if branch == 0 {
+		return
+	}
+	a.Ino = branchInode(a.Ino, branch)
+}
+
+// branchInodeBits is the number of bits of the inode numbers of a
+// branch that are kept as is.  The branches must use inode numbers
+// below 1<<branchInodeBits, and there may be at most
+// 1<<(64-branchInodeBits) of them; otherwise inode numbers of
+// different branches can collide.
+const branchInodeBits = 56
+
+func branchInode(ino uint64, branch int) uint64 {
+	return ino ^ uint64(branch)<<branchInodeBits
+}
+
+var branchInodeWarning sync.Once
+
+// checkBranchInode logs once if ino from branch does not fit
+// branchInodeBits, as then the union may report the same inode
+// number for different files.
+func checkBranchInode(ino uint64, branch int) {
+	if ino>>branchInodeBits == 0 && uint64(branch)>>(64-branchInodeBits) == 0 {
+		return
+	}
+	branchInodeWarning.Do(func() {
+		log.Printf("inode %d of branch %d does not fit in %d bits; inode numbers may collide", ino, branch, branchInodeBits)
+	})
+}
@@ -59,30 +59,44 @@ func setRecursiveWritable(t *testing.T, dir string, writable bool) {
 // Creates 3 directories on a temporary dir: /mnt with the overlayed
 // (unionfs) mount, rw with modifiable data, and ro on the bottom.
 func setupUfs(t *testing.T) (workdir string, cleanup func()) {
+	return setupUfsWithOptions(t, testOpts)
+}
+
+func setupUfsWithOptions(t *testing.T, ufsOpts UnionFsOptions) (workdir string, cleanup func()) {
+	return setupUfsBranches(t, ufsOpts, "rw", "ro")
+}
+
+// setupUfsBranches mounts a union of the given branch directories on
+// mnt, all in a fresh work directory.  The last branch is read
+// through a CachingFileSystem.  If the options need user xattrs, the
+// test is skipped when the first branch does not support them.
+func setupUfsBranches(t *testing.T, ufsOpts UnionFsOptions, branches ...string) (workdir string, cleanup func()) {
 	// Make sure system setting does not affect test.
 	syscall.Umask(0)
 
 	wd, _ := ioutil.TempDir("", "unionfs")
-	err := os.Mkdir(wd+"/mnt", 0700)
-	if err != nil {
-		t.Fatalf("Mkdir failed: %v", err)
-	}
-
-	err = os.Mkdir(wd+"/rw", 0700)
-	if err != nil {
-		t.Fatalf("Mkdir failed: %v", err)
+	for _, d := range append([]string{"mnt"}, branches...) {
+		if err := os.Mkdir(filepath.Join(wd, d), 0700); err != nil {
+			t.Fatalf("Mkdir failed: %v", err)
+		}
 	}
 
-	os.Mkdir(wd+"/ro", 0700)
-	if err != nil {
-		t.Fatalf("Mkdir failed: %v", err)
+	if ufsOpts.LazyCopyUp || ufsOpts.MetadataCopyUp {
+		if err := syscall.Setxattr(filepath.Join(wd, branches[0]), "user.test", []byte("x"), 0); err != nil {
+			os.RemoveAll(wd)
+			t.Skipf("no user xattrs on %s: %v", wd, err)
+		}
 	}
 
 	var fses []pathfs.FileSystem
-	fses = append(fses, pathfs.NewLoopbackFileSystem(wd+"/rw"))
-	fses = append(fses,
-		NewCachingFileSystem(pathfs.NewLoopbackFileSystem(wd+"/ro"), 0))
-	ufs := NewUnionFs(fses, testOpts)
+	for i, d := range branches {
+		fs := pathfs.NewLoopbackFileSystem(filepath.Join(wd, d))
+		if i == len(branches)-1 {
+			fs = NewCachingFileSystem(fs, 0)
+		}
+		fses = append(fses, fs)
+	}
+	ufs := NewUnionFs(fses, ufsOpts)
 
 	// We configure timeouts are smaller, so we can check for
 	// UnionFs's cache consistency.
@@ -1452,3 +1466,45 @@ func TestUnionFsCheckHiddenFiles(t *testing.T) {
 		t.Fatal("unexpected names", names)
 	}
 }
+
+func TestUnionFsReportInodes(t *testing.T) {
+	wd, _ := ioutil.TempDir("", "unionfs")
+	defer os.RemoveAll(wd)
+	for _, d := range []string{"mnt", "rw", "ro"} {
+		if err := os.Mkdir(wd+"/"+d, 0700); err != nil {
+			t.Fatalf("Mkdir failed: %v", err)
+		}
+	}
+	WriteFile(t, wd+"/rw/rwfile", "a")
+	WriteFile(t, wd+"/ro/rofile", "b")
+
+	var fses []pathfs.FileSystem
+	fses = append(fses, pathfs.NewLoopbackFileSystem(wd+"/rw"))
+	fses = append(fses, pathfs.NewLoopbackFileSystem(wd+"/ro"))
+	ufs := NewUnionFs(fses, testOpts)
+	nodeFs := pathfs.NewPathNodeFs(ufs, &pathfs.PathNodeFsOptions{ClientInodes: true})
+	opts := nodefs.NewOptions()
+	opts.ReportInodes = true
+	state, _, err := nodefs.MountFileSystem(wd+"/mnt", nodeFs, opts)
+	if err != nil {
+		t.Fatalf("MountNodeFileSystem failed: %v", err)
+	}
+	state.SetDebug(fuse.VerboseTest())
+	go state.Serve()
+	defer state.Unmount()
+
+	ino := func(name string) uint64 {
+		var st syscall.Stat_t
+		if err := syscall.Lstat(name, &st); err != nil {
+			t.Fatalf("Lstat failed: %v", err)
+		}
+		return st.Ino
+	}
+
+	if got, want := ino(wd+"/mnt/rwfile"), ino(wd+"/rw/rwfile"); got != want {
+		t.Errorf("rw branch: got ino %d, want %d", got, want)
+	}
+	if got, want := ino(wd+"/mnt/rofile"), ino(wd+"/ro/rofile")^1<<56; got != want {
+		t.Errorf("ro branch: got ino %d, want %d", got, want)
+	}
+}
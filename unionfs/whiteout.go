@@ -0,0 +1,335 @@
+package unionfs
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// WhiteoutFormat selects how deletions are recorded in the writable
+// branch.  Whatever the format, overlayfs whiteouts in read-only
+// branches are honored, as are deletion stores that read-only
+// branches carry under DeletionDirName.  Opaque directories in
+// read-only branches are recognized by trusted.overlay.opaque, or by
+// user.overlay.opaque with WhiteoutOverlayUser.
+type WhiteoutFormat int
+
+const (
+	// Deletions are files under UnionFsOptions.DeletionDirName,
+	// named by a hash of the deleted path.
+	WhiteoutDeletionStore = WhiteoutFormat(iota)
+
+	// Deletions are character devices with device number 0/0,
+	// and directories created over a deletion are marked with
+	// the trusted.overlay.opaque xattr, like the kernel's
+	// overlayfs does.  This needs CAP_MKNOD and CAP_SYS_ADMIN on
+	// the writable branch.
+	WhiteoutOverlay
+
+	// Like WhiteoutOverlay, but with user.overlay.opaque, as
+	// used by overlayfs with the "userxattr" mount option.
+	WhiteoutOverlayUser
+)
+
+func (f WhiteoutFormat) String() string {
+	switch f {
+	case WhiteoutDeletionStore:
+		return "store"
+	case WhiteoutOverlay:
+		return "overlay"
+	case WhiteoutOverlayUser:
+		return "overlay-user"
+	}
+	return fmt.Sprintf("WhiteoutFormat(%d)", int(f))
+}
+
+const (
+	overlayOpaqueXAttr     = "trusted.overlay.opaque"
+	overlayUserOpaqueXAttr = "user.overlay.opaque"
+)
+
+func (fs *unionFS) overlayWhiteouts() bool {
+	return fs.options.Whiteouts != WhiteoutDeletionStore
+}
+
+// isWhiteout returns whether a is an overlayfs whiteout in the given
+// branch.  With the deletion store, a 0/0 device in the writable
+// branch is just a device.
+func (fs *unionFS) isWhiteout(branch int, a *fuse.Attr) bool {
+	if fs.writable(branch) && !fs.overlayWhiteouts() {
+		return false
+	}
+	return a.IsChar() && a.Rdev == 0
+}
+
+// opaqueXAttr returns the xattr that marks opaque directories.  With
+// the deletion store, read-only branches are read as overlayfs writes
+// them without "userxattr".
+func (fs *unionFS) opaqueXAttr() string {
+	if fs.options.Whiteouts == WhiteoutOverlayUser {
+		return overlayUserOpaqueXAttr
+	}
+	return overlayOpaqueXAttr
+}
+
+// isOpaque returns whether the directory name in branch hides the
+// directories of the same name in the branches below it.
+func (fs *unionFS) isOpaque(branch int, name string) bool {
+	if fs.writable(branch) && !fs.overlayWhiteouts() {
+		return false
+	}
+	data, code := fs.fileSystems[branch].GetXAttr(name, fs.opaqueXAttr(), nil)
+	return code.Ok() && string(data) == "y"
+}
+
+// newRoDeletions returns the caches for the deletion stores of the
+// read-only branches of fses, using the current modes.
+func (fs *unionFS) newRoDeletions(fses []pathfs.FileSystem) []*dirCache {
+	caches := make([]*dirCache, len(fses))
+	if fs.options.DeletionDirName == "" {
+		return caches
+	}
+	for i, b := range fses {
+		if !fs.writable(i) {
+			caches[i] = newDirCache(b, fs.options.DeletionDirName, fs.options.DeletionCacheTTL)
+		}
+	}
+	return caches
+}
+
+// hasMarker returns whether the deletion store of read-only branch
+// hides name in the branches below it.  The store may change while
+// mounted, so while it is not cached, the marker is looked up.
+func (fs *unionFS) hasMarker(branch int, name string) bool {
+	c := fs.roDeletions[branch]
+	if fs.writable(branch) || c == nil {
+		return false
+	}
+	hash := filePathHash(name)
+	if haveCache, found := c.HasEntry(hash); haveCache {
+		return found
+	}
+	a, code := fs.fileSystems[branch].GetAttr(filepath.Join(fs.options.DeletionDirName, hash), nil)
+	return code.Ok() && a.IsRegular()
+}
+
+// lastDirBranch returns the lowest branch whose contents show up in
+// the directory name, which was found in branch first.
+func (fs *unionFS) lastDirBranch(name string, first int, last int) int {
+	for j := first; j <= last; j++ {
+		if j > first {
+			a, code := fs.fileSystems[j].GetAttr(name, nil)
+			if code.Ok() && (!a.IsDir() || fs.isWhiteout(j, a)) {
+				return j - 1
+			}
+		}
+		if fs.isOpaque(j, name) || fs.hasMarker(j, name) {
+			return j
+		}
+	}
+	return last
+}
+
+// clearWhiteout removes a whiteout for name in the writable branch,
+// so something new can be created there.  It returns whether there
+// was one; if so, and the creation fails, the caller must put it
+// back with restoreWhiteout.
+func (fs *unionFS) clearWhiteout(name string) bool {
+	if !fs.overlayWhiteouts() {
+		return false
+	}
+	writable := fs.fileSystems[0]
+	a, code := writable.GetAttr(name, nil)
+	if !code.Ok() || !fs.isWhiteout(0, a) {
+		return false
+	}
+	code = writable.Unlink(name, nil)
+	if !code.Ok() {
+		return false
+	}
+	fs.branchCache.DropEntry(name)
+	return true
+}
+
+// clearWhiteoutsIn removes the whiteouts in the writable branch
+// directory dir, so it can be removed.  It returns the names of the
+// removed whiteouts.
+func (fs *unionFS) clearWhiteoutsIn(dir string) (cleared []string) {
+	if !fs.overlayWhiteouts() {
+		return nil
+	}
+	writable := fs.fileSystems[0]
+	stream, code := writable.OpenDir(dir, nil)
+	if !code.Ok() {
+		return nil
+	}
+	for _, e := range stream {
+		if e.Mode&syscall.S_IFMT != syscall.S_IFCHR {
+			continue
+		}
+		name := filepath.Join(dir, e.Name)
+		if fs.clearWhiteout(name) {
+			cleared = append(cleared, name)
+		}
+	}
+	return cleared
+}
+
+// restoreWhiteout puts back whiteouts removed by clearWhiteout or
+// clearWhiteoutsIn, after the operation they made room for failed.
+func (fs *unionFS) restoreWhiteout(names ...string) {
+	for _, name := range names {
+		if code := fs.fileSystems[0].Mknod(name, syscall.S_IFCHR, 0, nil); !code.Ok() {
+			log.Printf("cannot restore whiteout %q: %v", name, code)
+		}
+		fs.branchCache.DropEntry(name)
+	}
+}
+
+// putWhiteout hides name in the branches below the writable one.
+func (fs *unionFS) putWhiteout(name string) fuse.Status {
+	dir, _ := filepath.Split(name)
+	dir = stripSlash(dir)
+	if dir != "" && !fs.getBranch(dir).code.Ok() {
+		// Gone with its parent.
+		return fuse.OK
+	}
+	code := fs.promoteDirsTo(name, 0)
+	if code.Ok() {
+		code = fs.fileSystems[0].Mknod(name, syscall.S_IFCHR, 0, nil)
+	}
+	if !code.Ok() {
+		return code
+	}
+	fs.branchCache.Set(name, branchResult{nil, fuse.ENOENT, -1, -1})
+	return fuse.OK
+}
+
+// setOpaque marks a directory in a writable branch as hiding the
+// branches below.
+func (fs *unionFS) setOpaque(name string, branch int) fuse.Status {
+	code := fs.fileSystems[branch].SetXAttr(name, fs.opaqueXAttr(), []byte("y"), 0, nil)
+	if code.Ok() {
+		fs.branchCache.DropEntry(name)
+	}
+	return code
+}
+
+// MigrateDeletionStore converts the deletion store of a writable
+// branch, as written with WhiteoutDeletionStore, into overlayfs
+// whiteouts, and removes the store.  Directories that must be created
+// for the whiteouts get the mode they have in the read-only branches,
+// top first.  It should be run while the branches are not in use.
+func MigrateDeletionStore(writable pathfs.FileSystem, deletionDirName string, readOnly ...pathfs.FileSystem) error {
+	stream, code := writable.OpenDir(deletionDirName, nil)
+	if code == fuse.ENOENT {
+		return nil
+	}
+	if !code.Ok() {
+		return fmt.Errorf("OpenDir(%q): %v", deletionDirName, code)
+	}
+
+	var names []string
+	for _, e := range stream {
+		marker := filepath.Join(deletionDirName, e.Name)
+		name, err := readMarker(writable, marker)
+		if err != nil {
+			return err
+		}
+		names = append(names, name)
+	}
+
+	// Parents sort before their children, so we can skip paths
+	// that are already hidden by a whiteout of their parent.
+	sort.Strings(names)
+	var done []string
+	for _, name := range names {
+		covered := false
+		for _, d := range done {
+			if strings.HasPrefix(name, d+"/") {
+				covered = true
+			}
+		}
+		if covered {
+			continue
+		}
+		if err := putMigratedWhiteout(writable, readOnly, name); err != nil {
+			return err
+		}
+		done = append(done, name)
+	}
+
+	for _, e := range stream {
+		marker := filepath.Join(deletionDirName, e.Name)
+		if code := writable.Unlink(marker, nil); !code.Ok() {
+			return fmt.Errorf("Unlink(%q): %v", marker, code)
+		}
+	}
+	if code := writable.Rmdir(deletionDirName, nil); !code.Ok() {
+		return fmt.Errorf("Rmdir(%q): %v", deletionDirName, code)
+	}
+	return nil
+}
+
+func readMarker(fs pathfs.FileSystem, marker string) (string, error) {
+	a, code := fs.GetAttr(marker, nil)
+	if !code.Ok() {
+		return "", fmt.Errorf("GetAttr(%q): %v", marker, code)
+	}
+	f, code := fs.Open(marker, 0, nil)
+	if !code.Ok() {
+		return "", fmt.Errorf("Open(%q): %v", marker, code)
+	}
+	defer f.Release()
+	buf := make([]byte, a.Size)
+	res, code := f.Read(buf, 0)
+	if !code.Ok() {
+		return "", fmt.Errorf("Read(%q): %v", marker, code)
+	}
+	data, code := res.Bytes(buf)
+	res.Done()
+	if !code.Ok() {
+		return "", fmt.Errorf("Read(%q): %v", marker, code)
+	}
+	return string(data), nil
+}
+
+func putMigratedWhiteout(fs pathfs.FileSystem, readOnly []pathfs.FileSystem, name string) error {
+	if _, code := fs.GetAttr(name, nil); code.Ok() {
+		// Recreated after the deletion.
+		return nil
+	}
+
+	// The whiteout goes into the directory as it appears in the
+	// writable branch.
+	dir := ""
+	comps := strings.Split(name, "/")
+	for _, c := range comps[:len(comps)-1] {
+		dir = filepath.Join(dir, c)
+		code := fs.Mkdir(dir, lowerDirMode(readOnly, dir), nil)
+		if !code.Ok() && code != fuse.Status(syscall.EEXIST) {
+			return fmt.Errorf("Mkdir(%q): %v", dir, code)
+		}
+	}
+	if code := fs.Mknod(name, syscall.S_IFCHR, 0, nil); !code.Ok() {
+		return fmt.Errorf("Mknod(%q): %v", name, code)
+	}
+	return nil
+}
+
+// lowerDirMode returns the mode for promoting the directory dir of
+// the first read-only branch that has it, as Promote does.
+func lowerDirMode(readOnly []pathfs.FileSystem, dir string) uint32 {
+	for _, b := range readOnly {
+		if a, code := b.GetAttr(dir, nil); code.Ok() && a.IsDir() {
+			return a.Mode&07777 | 0200
+		}
+	}
+	return 0755
+}
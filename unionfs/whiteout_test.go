@@ -0,0 +1,273 @@
+package unionfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+func isWhiteoutFile(t *testing.T, name string) bool {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(name, &st); err != nil {
+		return false
+	}
+	return st.Mode&syscall.S_IFMT == syscall.S_IFCHR && st.Rdev == 0
+}
+
+func mkWhiteout(t *testing.T, name string) {
+	if err := syscall.Mknod(name, syscall.S_IFCHR, 0); err != nil {
+		t.Fatalf("Mknod failed: %v", err)
+	}
+}
+
+func TestUnionFsOverlayWhiteouts(t *testing.T) {
+	opts := testOpts
+	opts.Whiteouts = WhiteoutOverlay
+	wd, clean := setupUfsWithOptions(t, opts)
+	defer clean()
+
+	os.Mkdir(wd+"/ro/dir", 0755)
+	for _, f := range []string{"file", "dir/sub"} {
+		if err := ioutil.WriteFile(filepath.Join(wd, "ro", f), []byte("x"), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+
+	if err := os.Remove(wd + "/mnt/file"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := os.RemoveAll(wd + "/mnt/dir"); err != nil {
+		t.Fatalf("RemoveAll failed: %v", err)
+	}
+	for _, f := range []string{"file", "dir"} {
+		if !isWhiteoutFile(t, filepath.Join(wd, "rw", f)) {
+			t.Errorf("%s: no whiteout in rw", f)
+		}
+	}
+	if _, err := os.Lstat(wd + "/rw/" + testOpts.DeletionDirName); err == nil {
+		t.Errorf("deletion store was created")
+	}
+	if names := dirNames(t, wd+"/mnt"); len(names) != 0 {
+		t.Errorf("got entries %v, want none", names)
+	}
+
+	// A directory over a whiteout is opaque.
+	if err := os.Mkdir(wd+"/mnt/dir", 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	buf := make([]byte, 10)
+	sz, err := syscall.Getxattr(wd+"/rw/dir", overlayOpaqueXAttr, buf)
+	if err != nil {
+		t.Errorf("Getxattr(%s): %v", overlayOpaqueXAttr, err)
+	} else if string(buf[:sz]) != "y" {
+		t.Errorf("Getxattr(%s): got %q", overlayOpaqueXAttr, buf[:sz])
+	}
+	if names := dirNames(t, wd+"/mnt/dir"); len(names) != 0 {
+		t.Errorf("got entries %v in opaque dir, want none", names)
+	}
+	if _, err := syscall.Getxattr(wd+"/mnt/dir", overlayOpaqueXAttr, buf); err != syscall.ENODATA {
+		t.Errorf("opaque xattr should be hidden, got %v", err)
+	}
+
+	// A file over a whiteout replaces it.
+	if err := ioutil.WriteFile(wd+"/mnt/file", []byte("new"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if c, err := ioutil.ReadFile(wd + "/rw/file"); err != nil || string(c) != "new" {
+		t.Errorf("rw/file: got %q, %v", c, err)
+	}
+}
+
+// Overlayfs whiteouts and deletion stores in read-only branches are
+// honored, whatever format the writable branch uses.
+func TestUnionFsReadOnlyWhiteouts(t *testing.T) {
+	wd, err := ioutil.TempDir("", "unionfs")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(wd)
+	for _, d := range []string{"mnt", "rw", "ro1", "ro2", "ro1/dir", "ro2/dir",
+		"ro1/opaque", "ro2/opaque", "ro1/" + testOpts.DeletionDirName} {
+		if err := os.Mkdir(filepath.Join(wd, d), 0755); err != nil {
+			t.Fatalf("Mkdir failed: %v", err)
+		}
+	}
+	for _, f := range []string{"ro2/whiteout", "ro2/marked", "ro2/dir/file", "ro2/opaque/hidden", "ro1/opaque/shown"} {
+		if err := ioutil.WriteFile(filepath.Join(wd, f), []byte("x"), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	mkWhiteout(t, wd+"/ro1/whiteout")
+	if err := syscall.Setxattr(wd+"/ro1/opaque", overlayOpaqueXAttr, []byte("y"), 0); err != nil {
+		t.Fatalf("Setxattr failed: %v", err)
+	}
+	marker := filepath.Join(wd, "ro1", testOpts.DeletionDirName, filePathHash("marked"))
+	if err := ioutil.WriteFile(marker, []byte("marked"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	var fses []pathfs.FileSystem
+	for _, d := range []string{"rw", "ro1", "ro2"} {
+		fses = append(fses, pathfs.NewLoopbackFileSystem(filepath.Join(wd, d)))
+	}
+	ufs := NewUnionFs(fses, testOpts)
+	state, _, err := nodefs.MountFileSystem(wd+"/mnt", pathfs.NewPathNodeFs(ufs, nil), nil)
+	if err != nil {
+		t.Fatalf("MountFileSystem failed: %v", err)
+	}
+	state.SetDebug(fuse.VerboseTest())
+	go state.Serve()
+	defer state.Unmount()
+
+	checkMapEq(t, dirNames(t, wd+"/mnt"), map[string]bool{"dir": true, "opaque": true})
+	for _, f := range []string{"whiteout", "marked", "opaque/hidden"} {
+		if _, err := os.Lstat(filepath.Join(wd, "mnt", f)); !os.IsNotExist(err) {
+			t.Errorf("%s: got %v, want ENOENT", f, err)
+		}
+	}
+	checkMapEq(t, dirNames(t, wd+"/mnt/opaque"), map[string]bool{"shown": true})
+	if _, err := os.Lstat(wd + "/mnt/dir/file"); err != nil {
+		t.Errorf("merged dir: %v", err)
+	}
+
+	// The deletion store is read again once its cache expires.
+	marker = filepath.Join(wd, "ro1", testOpts.DeletionDirName, filePathHash("dir/file"))
+	if err := ioutil.WriteFile(marker, []byte("dir/file"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	time.Sleep(2 * entryTtl)
+	if _, code := ufs.GetAttr("dir/file", nil); code != fuse.ENOENT {
+		t.Errorf("dir/file after adding marker: got %v, want ENOENT", code)
+	}
+}
+
+func TestUnionFsRestoreWhiteout(t *testing.T) {
+	wd, err := ioutil.TempDir("", "unionfs")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(wd)
+	for _, d := range []string{"rw", "ro", "rw/dir"} {
+		if err := os.Mkdir(filepath.Join(wd, d), 0755); err != nil {
+			t.Fatalf("Mkdir failed: %v", err)
+		}
+	}
+	WriteFile(t, wd+"/ro/file", "ro")
+	mkWhiteout(t, wd+"/rw/file")
+
+	opts := testOpts
+	opts.Whiteouts = WhiteoutOverlay
+	ufs := NewUnionFs([]pathfs.FileSystem{
+		pathfs.NewLoopbackFileSystem(wd + "/rw"),
+		pathfs.NewLoopbackFileSystem(wd + "/ro"),
+	}, opts)
+
+	// Directories cannot be hard-linked, so this fails after the
+	// whiteout was removed to make room.
+	if code := ufs.Link("dir", "file", nil); code.Ok() {
+		t.Fatalf("Link of a directory succeeded")
+	}
+	if !isWhiteoutFile(t, wd+"/rw/file") {
+		t.Errorf("whiteout was not restored")
+	}
+	if _, code := ufs.GetAttr("file", nil); code != fuse.ENOENT {
+		t.Errorf("GetAttr: got %v, want ENOENT", code)
+	}
+}
+
+func TestUnionFsMigrateDeletionStore(t *testing.T) {
+	wd, err := ioutil.TempDir("", "unionfs")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(wd)
+
+	store := filepath.Join(wd, testOpts.DeletionDirName)
+	os.Mkdir(store, 0755)
+	for _, name := range []string{"file", "dir", "dir/sub", "a/b/c"} {
+		if err := ioutil.WriteFile(filepath.Join(store, filePathHash(name)), []byte(name), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+
+	ro, err := ioutil.TempDir("", "unionfs")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(ro)
+	modes := map[string]os.FileMode{"a": 0750, "a/b": 0711}
+	for _, d := range []string{"a", "a/b"} {
+		if err := os.Mkdir(filepath.Join(ro, d), modes[d]); err != nil {
+			t.Fatalf("Mkdir failed: %v", err)
+		}
+		os.Chmod(filepath.Join(ro, d), modes[d])
+	}
+
+	err = MigrateDeletionStore(pathfs.NewLoopbackFileSystem(wd), testOpts.DeletionDirName,
+		pathfs.NewLoopbackFileSystem(ro))
+	if err != nil {
+		t.Fatalf("MigrateDeletionStore failed: %v", err)
+	}
+	for _, f := range []string{"file", "dir", "a/b/c"} {
+		if !isWhiteoutFile(t, filepath.Join(wd, f)) {
+			t.Errorf("%s: not a whiteout", f)
+		}
+	}
+	for d, mode := range modes {
+		if fi, err := os.Lstat(filepath.Join(wd, d)); err != nil || fi.Mode().Perm() != mode {
+			t.Errorf("%s: got %v, %v, want mode %v", d, fi, err, mode)
+		}
+	}
+	if _, err := os.Lstat(store); !os.IsNotExist(err) {
+		t.Errorf("deletion store still exists: %v", err)
+	}
+}
+
+func TestUnionFsOpaqueXAttr(t *testing.T) {
+	wd, err := ioutil.TempDir("", "unionfs")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(wd)
+	for _, d := range []string{"rw", "ro", "rw/dir", "ro/dir"} {
+		if err := os.Mkdir(filepath.Join(wd, d), 0755); err != nil {
+			t.Fatalf("Mkdir failed: %v", err)
+		}
+	}
+	if err := syscall.Setxattr(wd+"/rw/dir", overlayOpaqueXAttr, []byte("y"), 0); err != nil {
+		t.Fatalf("Setxattr failed: %v", err)
+	}
+	if err := syscall.Setxattr(wd+"/ro/dir", overlayUserOpaqueXAttr, []byte("y"), 0); err != nil {
+		t.Fatalf("Setxattr failed: %v", err)
+	}
+
+	fses := []pathfs.FileSystem{
+		pathfs.NewLoopbackFileSystem(wd + "/rw"),
+		pathfs.NewLoopbackFileSystem(wd + "/ro"),
+	}
+	for _, c := range []struct {
+		format WhiteoutFormat
+		rw, ro bool
+	}{
+		{WhiteoutDeletionStore, false, false},
+		{WhiteoutOverlay, true, false},
+		{WhiteoutOverlayUser, false, true},
+	} {
+		opts := testOpts
+		opts.Whiteouts = c.format
+		ufs := NewUnionFs(fses, opts).(*unionFS)
+		if got := ufs.isOpaque(0, "dir"); got != c.rw {
+			t.Errorf("%v: writable branch: got opaque %v, want %v", c.format, got, c.rw)
+		}
+		if got := ufs.isOpaque(1, "dir"); got != c.ro {
+			t.Errorf("%v: read-only branch: got opaque %v, want %v", c.format, got, c.ro)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package unionfs
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Attributes in the user.unionfs. namespace are not passed to the
+// branches.  Some are used internally; the ones below are computed
+// on the fly, to show where the entries of the union come from.
+const (
+	unionXAttrPrefix = "user.unionfs."
+
+	// The branch that serves the entry: its index, mode and
+	// name, as in the branch control file.
+	branchXAttr = "user.unionfs.branch"
+
+	// For entries in a writable branch that also exist in a
+	// read-only branch: "y" if they were copied up, "partial" for
+	// a lazy copy-up in progress, and "metadata" for a
+	// metadata-only copy.
+	copiedUpXAttr = "user.unionfs.copied_up"
+
+	// For directories: the names of the entries that were
+	// deleted, one per line.
+	whiteoutXAttr = "user.unionfs.whiteout"
+
+	// For directories: a line "NAME BRANCH SHADOWED..." for each
+	// entry that hides copies in lower branches, listing the
+	// index of the branch that serves it, and of those it hides.
+	shadowedXAttr = "user.unionfs.shadowed"
+)
+
+func (fs *unionFS) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	fs.branchLock.RLock()
+	defer fs.branchLock.RUnlock()
+	if name == _DROP_CACHE || fs.isControlFile(name) {
+		return nil, fuse.OK
+	}
+	r := fs.getBranch(name)
+	if r.branch < 0 {
+		return nil, fuse.ENOENT
+	}
+	attrs, code := fs.fileSystems[r.branch].ListXAttr(name, context)
+	if code == fuse.ENOSYS && fs.options.ListUnionXAttrs {
+		attrs, code = nil, fuse.OK
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+
+	var out []string
+	for _, a := range attrs {
+		if a != overlayOpaqueXAttr && a != overlayUserOpaqueXAttr && !strings.HasPrefix(a, unionXAttrPrefix) {
+			out = append(out, a)
+		}
+	}
+	if fs.options.ListUnionXAttrs {
+		out = append(out, branchXAttr)
+		if fs.copiedUp(name, r) != "" {
+			out = append(out, copiedUpXAttr)
+		}
+		if r.attr.IsDir() {
+			out = append(out, whiteoutXAttr, shadowedXAttr)
+		}
+	}
+	return out, fuse.OK
+}
+
+// unionXAttr returns the attribute attr in the user.unionfs.
+// namespace.
+func (fs *unionFS) unionXAttr(name string, attr string) ([]byte, fuse.Status) {
+	r := fs.getBranch(name)
+	if r.branch < 0 {
+		return nil, fuse.ENOENT
+	}
+	var val string
+	switch attr {
+	case branchXAttr:
+		val = fs.branchLine(r.branch)
+	case copiedUpXAttr:
+		val = fs.copiedUp(name, r)
+	case whiteoutXAttr:
+		if !r.attr.IsDir() {
+			return nil, fuse.ENODATA
+		}
+		val = fs.deletedIn(name, r)
+	case shadowedXAttr:
+		if !r.attr.IsDir() {
+			return nil, fuse.ENODATA
+		}
+		val = fs.shadowedIn(name)
+	}
+	if val == "" && attr != whiteoutXAttr && attr != shadowedXAttr {
+		return nil, fuse.ENODATA
+	}
+	return []byte(val), fuse.OK
+}
+
+// copiedUp returns the value of copiedUpXAttr for name.
+func (fs *unionFS) copiedUp(name string, r branchResult) string {
+	if !fs.writable(r.branch) || r.attr.IsDir() {
+		return ""
+	}
+	if b, _, _, code := fs.metaCopySource(name, r.branch); b >= 0 || !code.Ok() {
+		return "metadata"
+	}
+	lower := false
+	for _, i := range fs.shadowed(name, r) {
+		lower = lower || !fs.writable(i)
+	}
+	if !lower {
+		return ""
+	}
+	if _, code := fs.fileSystems[r.branch].GetXAttr(name, copyUpXAttr, nil); code.Ok() {
+		return "partial"
+	}
+	return "y"
+}
+
+// shadowed returns the branches below r whose entry for name is
+// hidden by the one in r.  Directories only hide the branches
+// below those that are merged into them.
+func (fs *unionFS) shadowed(name string, r branchResult) []int {
+	last := len(fs.fileSystems) - 1
+	if name != "" {
+		p := fs.getBranch(stripSlash(path.Dir(name)))
+		if p.branch < 0 {
+			return nil
+		}
+		last = p.last
+	}
+	from := r.branch + 1
+	if r.attr.IsDir() {
+		from = r.last + 1
+	}
+
+	var out []int
+	for i := r.branch + 1; i <= last; i++ {
+		if fs.hasMarker(i-1, name) {
+			break
+		}
+		a, code := fs.fileSystems[i].GetAttr(name, nil)
+		if !code.Ok() {
+			continue
+		}
+		if fs.isWhiteout(i, a) {
+			break
+		}
+		if i >= from {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+// deletedIn lists the names that the branches of the directory dir
+// have, but the union hides.
+func (fs *unionFS) deletedIn(dir string, r branchResult) string {
+	visible := map[string]bool{}
+	stream, _ := fs.openDir(dir, nil)
+	for _, e := range stream {
+		visible[e.Name] = true
+	}
+
+	var names []string
+	seen := map[string]bool{}
+	for i := r.branch; i <= r.last; i++ {
+		stream, _ := fs.fileSystems[i].OpenDir(dir, nil)
+		for _, e := range stream {
+			if visible[e.Name] || seen[e.Name] {
+				continue
+			}
+			if dir == "" && (e.Name == fs.options.DeletionDirName || fs.hiddenFiles[e.Name]) {
+				continue
+			}
+			seen[e.Name] = true
+			names = append(names, e.Name)
+		}
+	}
+	sort.Strings(names)
+	return lines(names)
+}
+
+// shadowedIn lists the entries of the directory dir that hide
+// entries of lower branches.
+func (fs *unionFS) shadowedIn(dir string) string {
+	stream, _ := fs.openDir(dir, nil)
+	var out []string
+	for _, e := range stream {
+		name := path.Join(dir, e.Name)
+		r := fs.getBranch(name)
+		if r.branch < 0 {
+			continue
+		}
+		s := fs.shadowed(name, r)
+		if len(s) == 0 {
+			continue
+		}
+		line := fmt.Sprintf("%s %d", e.Name, r.branch)
+		for _, i := range s {
+			line += fmt.Sprintf(" %d", i)
+		}
+		out = append(out, line)
+	}
+	sort.Strings(out)
+	return lines(out)
+}
+
+func lines(l []string) string {
+	var b bytes.Buffer
+	for _, s := range l {
+		b.WriteString(s)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
@@ -0,0 +1,88 @@
+package unionfs
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func readXAttr(name string, attr string) (string, error) {
+	buf := make([]byte, 4096)
+	n, err := syscall.Getxattr(name, attr, buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}
+
+func readXAttrNames(t *testing.T, name string) map[string]bool {
+	buf := make([]byte, 4096)
+	n, err := syscall.Listxattr(name, buf)
+	if err != nil {
+		t.Fatalf("Listxattr(%s) failed: %v", name, err)
+	}
+	r := map[string]bool{}
+	for _, a := range strings.Split(string(buf[:n]), "\x00") {
+		if a != "" {
+			r[a] = true
+		}
+	}
+	return r
+}
+
+func TestUnionFsUnionXAttrs(t *testing.T) {
+	opts := testOpts
+	opts.ListUnionXAttrs = true
+	wd, clean := setupUfsWithOptions(t, opts)
+	defer clean()
+
+	if err := os.Mkdir(wd+"/ro/dir", 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	for _, n := range []string{"file", "del", "dir/a"} {
+		WriteFile(t, wd+"/ro/"+n, "ro")
+	}
+	WriteFile(t, wd+"/mnt/file", "changed")
+	WriteFile(t, wd+"/mnt/new", "new")
+	if err := os.Remove(wd + "/mnt/del"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+
+	for _, c := range []struct {
+		name, attr, want string
+	}{
+		{"file", branchXAttr, "0 RW "},
+		{"file", copiedUpXAttr, "y"},
+		{"new", branchXAttr, "0 RW "},
+		{"dir/a", branchXAttr, "1 RO "},
+		{"", whiteoutXAttr, "del\n"},
+		{"", shadowedXAttr, "file 0 1\n"},
+	} {
+		got, err := readXAttr(wd+"/mnt/"+c.name, c.attr)
+		if err != nil || !strings.HasPrefix(got, c.want) {
+			t.Errorf("%s %s: got %q, %v, want %q", c.name, c.attr, got, err, c.want)
+		}
+	}
+	if _, err := readXAttr(wd+"/mnt/new", copiedUpXAttr); err != syscall.ENODATA {
+		t.Errorf("new %s: got %v, want ENODATA", copiedUpXAttr, err)
+	}
+
+	attrs := readXAttrNames(t, wd+"/mnt/file")
+	if !attrs[branchXAttr] || !attrs[copiedUpXAttr] || attrs[whiteoutXAttr] {
+		t.Errorf("got attributes %v", attrs)
+	}
+}
+
+func TestUnionFsUnionXAttrsUnlisted(t *testing.T) {
+	wd, clean := setupUfs(t)
+	defer clean()
+
+	WriteFile(t, wd+"/ro/file", "ro")
+	if got, err := readXAttr(wd+"/mnt/file", branchXAttr); err != nil || !strings.HasPrefix(got, "1 RO ") {
+		t.Errorf("got %q, %v", got, err)
+	}
+	if attrs := readXAttrNames(t, wd+"/mnt/file"); len(attrs) != 0 {
+		t.Errorf("got attributes %v, want none", attrs)
+	}
+}
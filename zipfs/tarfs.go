@@ -2,12 +2,14 @@ package zipfs
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"compress/bzip2"
 	"compress/gzip"
 	"fmt"
 	"github.com/hanwen/go-fuse/fuse"
 	"io"
+	"io/ioutil"
 	"os"
 	"strings"
 	"syscall"
@@ -32,14 +34,30 @@ type TarFile struct {
 
 func (f *TarFile) Stat(out *fuse.Attr) {
 	HeaderToFileInfo(out, &f.Header)
-	out.Mode |= syscall.S_IFREG
+	out.Mode = out.Mode&07777 | syscall.S_IFREG
 }
 
 func (f *TarFile) Data() []byte {
 	return f.data
 }
 
+// NewTarTree returns the files of the tar stream r, without the
+// directories.  Entries after a read error are dropped.
 func NewTarTree(r io.Reader) map[string]MemFile {
+	files, _ := ReadTarTree(r)
+	for n, f := range files {
+		if f.(*TarFile).Typeflag == tar.TypeDir || strings.HasSuffix(n, "/") {
+			delete(files, n)
+		}
+	}
+	return files
+}
+
+// ReadTarTree returns the entries of the tar stream r, keyed by
+// name.  Unlike NewTarTree, it keeps the directories, so their
+// attributes are known, and it fails on read errors.  The entries
+// are *TarFile, which have the tar header.
+func ReadTarTree(r io.Reader) (map[string]MemFile, error) {
 	files := map[string]MemFile{}
 	tr := tar.NewReader(r)
 
@@ -51,7 +69,7 @@ func NewTarTree(r io.Reader) map[string]MemFile {
 			break
 		}
 		if err != nil {
-			// handle error
+			return files, err
 		}
 
 		if hdr.Typeflag == 'L' {
@@ -67,19 +85,17 @@ func NewTarTree(r io.Reader) map[string]MemFile {
 			longName = nil
 		}
 
-		if strings.HasSuffix(hdr.Name, "/") {
-			continue
-		}
-
 		buf := bytes.NewBuffer(make([]byte, 0, hdr.Size))
-		io.Copy(buf, tr)
+		if _, err := io.Copy(buf, tr); err != nil {
+			return files, err
+		}
 
 		files[hdr.Name] = &TarFile{
 			Header: *hdr,
 			data:   buf.Bytes(),
 		}
 	}
-	return files
+	return files, nil
 }
 
 func NewTarCompressedTree(name string, format string) (map[string]MemFile, error) {
@@ -89,19 +105,56 @@ func NewTarCompressedTree(name string, format string) (map[string]MemFile, error
 	}
 	defer f.Close()
 
-	var stream io.Reader
+	stream, err := decompress(f, format)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	return NewTarTree(stream), nil
+}
+
+// ReadTarFile is like ReadTarTree for the tarball name, which may be
+// gzipped or bzipped.  The compression is detected from the data.
+func ReadTarFile(name string) (map[string]MemFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	magic, err := r.Peek(3)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	format := ""
+	switch {
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		format = "gz"
+	case string(magic) == "BZh":
+		format = "bz2"
+	}
+	stream, err := decompress(r, format)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	files, err := ReadTarTree(stream)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return files, nil
+}
+
+// decompress returns the data of r, compressed in format "gz",
+// "bz2", or not at all if format is empty.
+func decompress(r io.Reader, format string) (io.ReadCloser, error) {
 	switch format {
 	case "gz":
-		unzip, err := gzip.NewReader(f)
-		if err != nil {
-			return nil, err
-		}
-		defer unzip.Close()
-		stream = unzip
+		return gzip.NewReader(r)
 	case "bz2":
-		unzip := bzip2.NewReader(f)
-		stream = unzip
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
 	}
-
-	return NewTarTree(stream), nil
+	return ioutil.NopCloser(r), nil
 }
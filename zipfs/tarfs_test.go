@@ -0,0 +1,36 @@
+package zipfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+)
+
+func TestTarTreeDirs(t *testing.T) {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	w.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0700})
+	w.WriteHeader(&tar.Header{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 4})
+	w.Write([]byte("data"))
+	w.Close()
+
+	files, err := ReadTarTree(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadTarTree failed: %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("got %v, want dir/ and dir/file", files)
+	}
+	if d, ok := files["dir/"].(*TarFile); !ok || d.Mode != 0700 {
+		t.Errorf("got directory %v", files["dir/"])
+	}
+
+	files = NewTarTree(bytes.NewReader(buf.Bytes()))
+	if len(files) != 1 || string(files["dir/file"].Data()) != "data" {
+		t.Errorf("got %v, want dir/file only", files)
+	}
+
+	if _, err := ReadTarTree(bytes.NewReader(buf.Bytes()[:600])); err == nil {
+		t.Errorf("ReadTarTree of a truncated tarball succeeded")
+	}
+}